@@ -98,6 +98,7 @@ const WIDGET_CONFIG = {
   storageByRole: { w: 2, h: 2, minW: 1, minH: 2 },
   trashStatistics: { w: 2, h: 2, minW: 1, minH: 2 },
   avgFileSizeByType: { w: 2, h: 3, minW: 2, minH: 3 },
+  imageJobs: { w: 4, h: 3, minW: 2, minH: 3 },
 };
 
 // Import all chart components
@@ -115,6 +116,7 @@ import {
   StorageByRoleChart,
   TrashStatisticsChart,
   AverageFileSizeByTypeChart,
+  ImageJobsChart,
 } from "./charts";
 
 import DashboardFilters from "./DashboardFilters";
@@ -126,6 +128,8 @@ const AdminDashboard = () => {
     systemStats,
     loading,
     fetchSystemStats,
+    imageJobStats,
+    fetchImageJobStats,
     dashboardPreferences,
     fetchDashboardPreferences,
     saveDashboardPreferences,
@@ -315,8 +319,21 @@ const AdminDashboard = () => {
   }, [user, filters]); // Reload when filters change
 
   const loadStats = async () => {
+    // Image job counters are kept per day up to today, so only the start
+    // date of the filter applies to them
+    const days = Math.min(
+      Math.max(
+        Math.ceil((Date.now() - new Date(filters.startDate)) / 86400000),
+        1,
+      ),
+      365,
+    );
+
     try {
-      await fetchSystemStats(filters);
+      await Promise.all([
+        fetchSystemStats(filters),
+        fetchImageJobStats({ days }),
+      ]);
     } catch (error) {
       logger.error("Failed to load system stats", { error: error.message });
     }
@@ -840,6 +857,16 @@ const AdminDashboard = () => {
                 />
               </div>
             )}
+
+          {/* Image Jobs per Day */}
+          {isWidgetVisible("imageJobs") && imageJobStats && (
+            <div key="imageJobs" className={styles.gridItem}>
+              {isEditing && (
+                <div className={`${styles.dragHandle} drag-handle`}>::</div>
+              )}
+              <ImageJobsChart imageJobStats={imageJobStats} />
+            </div>
+          )}
         </ResponsiveGridLayout>
       )}
 
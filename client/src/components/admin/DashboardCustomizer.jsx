@@ -83,6 +83,12 @@ export const AVAILABLE_WIDGETS = [
     description: "Average file sizes by type",
     category: "files",
   },
+  {
+    id: "imageJobs",
+    name: "Image Jobs",
+    description: "Completed and failed image jobs per day",
+    category: "activity",
+  },
 ];
 
 // Default visible widgets (all of them)
@@ -0,0 +1,234 @@
+import React, { useState } from "react";
+import {
+  BarChart,
+  Bar,
+  LineChart,
+  Line,
+  XAxis,
+  YAxis,
+  CartesianGrid,
+  Tooltip,
+  ResponsiveContainer,
+  Legend,
+} from "recharts";
+import { Image as ImageIcon } from "lucide-react";
+import GraphTypeSelector from "./GraphTypeSelector";
+import styles from "./ChartCard.module.css";
+
+const ImageJobsChart = ({ imageJobStats }) => {
+  const [graphType, setGraphType] = useState("bar");
+
+  if (!imageJobStats) {
+    return null;
+  }
+
+  const { queues, daily } = imageJobStats;
+  const data = (daily || []).map((day) => ({
+    // Daily counters are kept per UTC day
+    date: new Date(`${day.date}T00:00:00Z`).toLocaleDateString("en-US", {
+      month: "short",
+      day: "numeric",
+      timeZone: "UTC",
+    }),
+    completed: day.completed,
+    failed: day.failed,
+  }));
+
+  const tooltipStyle = {
+    backgroundColor: "#fff",
+    border: "1px solid #e5e7eb",
+    borderRadius: "8px",
+    color: "#1f2937",
+  };
+
+  const renderChartContent = () => {
+    switch (graphType) {
+      case "line":
+        return (
+          <ResponsiveContainer width="100%" height="100%">
+            <LineChart data={data}>
+              <CartesianGrid strokeDasharray="3 3" opacity={0.1} />
+              <XAxis
+                dataKey="date"
+                stroke="var(--text-secondary)"
+                fontSize={11}
+                angle={-45}
+                textAnchor="end"
+                height={60}
+              />
+              <YAxis stroke="var(--text-secondary)" fontSize={12} />
+              <Tooltip contentStyle={tooltipStyle} />
+              <Legend wrapperStyle={{ paddingTop: "10px", fontSize: "12px" }} />
+              <Line
+                type="monotone"
+                dataKey="completed"
+                stroke="#10b981"
+                strokeWidth={2}
+                dot={{ r: 3 }}
+                name="Completed"
+              />
+              <Line
+                type="monotone"
+                dataKey="failed"
+                stroke="#ef4444"
+                strokeWidth={2}
+                dot={{ r: 3 }}
+                name="Failed"
+              />
+            </LineChart>
+          </ResponsiveContainer>
+        );
+
+      case "table":
+        return (
+          <div
+            className={styles.tableContainer}
+            style={{ height: "100%", overflowY: "auto" }}
+          >
+            <table
+              style={{
+                width: "100%",
+                borderCollapse: "collapse",
+                fontSize: "0.9rem",
+              }}
+            >
+              <thead>
+                <tr style={{ borderBottom: "1px solid var(--border-color)" }}>
+                  <th
+                    style={{
+                      textAlign: "left",
+                      padding: "8px",
+                      color: "var(--text-secondary)",
+                    }}
+                  >
+                    Date
+                  </th>
+                  <th
+                    style={{
+                      textAlign: "right",
+                      padding: "8px",
+                      color: "var(--text-secondary)",
+                    }}
+                  >
+                    Completed
+                  </th>
+                  <th
+                    style={{
+                      textAlign: "right",
+                      padding: "8px",
+                      color: "var(--text-secondary)",
+                    }}
+                  >
+                    Failed
+                  </th>
+                </tr>
+              </thead>
+              <tbody>
+                {data.map((entry, index) => (
+                  <tr
+                    key={index}
+                    style={{
+                      borderBottom: "1px solid var(--border-color-light)",
+                    }}
+                  >
+                    <td style={{ padding: "8px" }}>{entry.date}</td>
+                    <td style={{ textAlign: "right", padding: "8px" }}>
+                      {entry.completed}
+                    </td>
+                    <td style={{ textAlign: "right", padding: "8px" }}>
+                      {entry.failed}
+                    </td>
+                  </tr>
+                ))}
+              </tbody>
+            </table>
+          </div>
+        );
+
+      case "bar":
+      default:
+        return (
+          <ResponsiveContainer width="100%" height="100%">
+            <BarChart data={data}>
+              <CartesianGrid strokeDasharray="3 3" opacity={0.1} />
+              <XAxis
+                dataKey="date"
+                stroke="var(--text-secondary)"
+                fontSize={11}
+                angle={-45}
+                textAnchor="end"
+                height={60}
+              />
+              <YAxis stroke="var(--text-secondary)" fontSize={12} />
+              <Tooltip cursor={false} contentStyle={tooltipStyle} />
+              <Legend wrapperStyle={{ paddingTop: "10px", fontSize: "12px" }} />
+              <Bar
+                dataKey="completed"
+                stackId="jobs"
+                fill="#10b981"
+                name="Completed"
+              />
+              <Bar
+                dataKey="failed"
+                stackId="jobs"
+                fill="#ef4444"
+                radius={[4, 4, 0, 0]}
+                name="Failed"
+              />
+            </BarChart>
+          </ResponsiveContainer>
+        );
+    }
+  };
+
+  return (
+    <div className={styles.chartCard}>
+      <div className={styles.chartHeader}>
+        <div style={{ display: "flex", alignItems: "center", gap: "8px" }}>
+          <h3 className={styles.chartTitle}>Image Jobs</h3>
+          <ImageIcon size={18} color="var(--text-secondary)" />
+        </div>
+        <GraphTypeSelector
+          selectedType={graphType}
+          onSelect={setGraphType}
+          validTypes={["bar", "line", "table"]}
+        />
+      </div>
+      <div className={styles.chartContent}>
+        {data.length > 0 && renderChartContent()}
+        <div
+          style={{
+            marginTop: "1rem",
+            padding: "1rem",
+            backgroundColor: "var(--bg-secondary)",
+            borderRadius: "8px",
+            fontSize: "0.875rem",
+            display: "flex",
+            justifyContent: "space-between",
+          }}
+        >
+          <span style={{ color: "var(--text-secondary)" }}>
+            Pending:{" "}
+            <span style={{ fontWeight: 600, color: "var(--text-primary)" }}>
+              {queues?.pending ?? 0}
+            </span>
+          </span>
+          <span style={{ color: "var(--text-secondary)" }}>
+            Retrying:{" "}
+            <span style={{ fontWeight: 600, color: "var(--text-primary)" }}>
+              {queues?.retry ?? 0}
+            </span>
+          </span>
+          <span style={{ color: "var(--text-secondary)" }}>
+            Failed (kept):{" "}
+            <span style={{ fontWeight: 600, color: "var(--text-primary)" }}>
+              {queues?.failed ?? 0}
+            </span>
+          </span>
+        </div>
+      </div>
+    </div>
+  );
+};
+
+export default ImageJobsChart;
@@ -14,3 +14,4 @@ export { default as UploadPatternsByHourChart } from "./UploadPatternsByHourChar
 export { default as StorageByRoleChart } from "./StorageByRoleChart";
 export { default as TrashStatisticsChart } from "./TrashStatisticsChart";
 export { default as AverageFileSizeByTypeChart } from "./AverageFileSizeByTypeChart";
+export { default as ImageJobsChart } from "./ImageJobsChart";
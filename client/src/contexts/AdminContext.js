@@ -10,6 +10,7 @@ export const AdminProvider = ({ children }) => {
   const [files, setFiles] = useState([]);
   const [activity, setActivity] = useState(null);
   const [storageReport, setStorageReport] = useState(null);
+  const [imageJobStats, setImageJobStats] = useState(null);
   const [dashboardPreferences, setDashboardPreferences] = useState(null);
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState(null);
@@ -377,6 +378,34 @@ export const AdminProvider = ({ children }) => {
     }
   }, []);
 
+  /**
+   * Fetch image queue lengths and per-day completed/failed job counts
+   */
+  const fetchImageJobStats = useCallback(async (params = {}) => {
+    try {
+      logger.info("Fetching image job statistics", params);
+
+      const response = await api.admin.getImageJobStats(params);
+      setImageJobStats(response.data);
+
+      logger.info("Image job statistics fetched successfully", {
+        days: response.data.daily.length,
+      });
+
+      return response.data;
+    } catch (err) {
+      const errorMessage =
+        err.response?.data?.error || "Failed to fetch image job statistics";
+      logger.error("Error fetching image job stats", {
+        error: errorMessage,
+        status: err.response?.status,
+      });
+      // Don't set error state - the widget is hidden while Redis is down
+      setImageJobStats(null);
+      return null;
+    }
+  }, []);
+
   /**
    * Fetch dashboard preferences
    */
@@ -438,6 +467,7 @@ export const AdminProvider = ({ children }) => {
     files,
     activity,
     storageReport,
+    imageJobStats,
     dashboardPreferences,
     loading,
     error,
@@ -454,6 +484,7 @@ export const AdminProvider = ({ children }) => {
     deleteFile,
     fetchActivity,
     fetchStorageReport,
+    fetchImageJobStats,
     fetchDashboardPreferences,
     saveDashboardPreferences,
   };
@@ -532,6 +532,8 @@ const api = {
     // Activity and reports
     getActivity: (params) => axios.get(`${API_URL}/admin/activity`, { params }),
     getStorageReport: () => axios.get(`${API_URL}/admin/storage-report`),
+    getImageJobStats: (params) =>
+      axios.get(`${API_URL}/admin/image-jobs`, { params }),
 
     // Dashboard preferences
     getDashboardPreferences: () =>
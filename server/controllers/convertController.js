@@ -0,0 +1,156 @@
+const redisQueue = require('../utils/redisQueue');
+const { v4: uuidv4 } = require('uuid');
+const path = require('path');
+const fs = require('fs');
+const logger = require('../utils/logger');
+const { traceparentFor } = require('../utils/traceContext');
+const File = require('../models/File');
+
+// Extensions of the formats images can be converted to
+const CONVERT_EXTENSIONS = { jpeg: 'jpg', png: 'png', webp: 'webp' };
+
+// Options passed through to the worker, which validates their values
+const CONVERT_OPTIONS = ['format', 'lossless', 'quality', 'maxWidth', 'maxHeight', 'stripMetadata'];
+
+/**
+ * Find a convert job of the requesting user
+ * @returns {Promise<Object|null>} the job's status hash
+ */
+async function findOwnJob(req) {
+  const job = await redisQueue.getConvertJob(req.params.jobId);
+  if (!job || job.userId !== req.user.id) {
+    return null;
+  }
+  return job;
+}
+
+/**
+ * Request a conversion of an image ("download as")
+ * @route POST /downloads/convert
+ */
+exports.requestConvert = async (req, res) => {
+  try {
+    const { fileId } = req.body; // Plus the options, e.g. { format: 'jpeg', quality: 85 }
+
+    if (!fileId) {
+      return res.status(400).json({ error: 'fileId is required' });
+    }
+    if (!CONVERT_EXTENSIONS[req.body.format]) {
+      return res.status(400).json({ error: 'format must be jpeg, png or webp' });
+    }
+
+    const file = await File.findOne({ _id: fileId, owner: req.user.id, trash: false });
+    if (!file || !fs.existsSync(file.path)) {
+      return res.status(404).json({ error: 'File not found' });
+    }
+    if (!redisQueue.isImageFile(file.type)) {
+      return res.status(400).json({ error: 'Only images can be converted' });
+    }
+
+    const convert = {};
+    for (const option of CONVERT_OPTIONS) {
+      if (req.body[option] !== undefined) {
+        convert[option] = req.body[option];
+      }
+    }
+
+    if (!redisQueue.isConnected) {
+      return res.status(503).json({ error: 'Service unavailable. Could not queue job.' });
+    }
+
+    const jobId = uuidv4();
+    const sent = await redisQueue.sendConvertJob({
+      jobId,
+      filePath: file.path,
+      userId: req.user.id,
+      fileName: `${path.parse(file.name).name}.${CONVERT_EXTENSIONS[convert.format]}`,
+      convert,
+      traceparent: traceparentFor(req)
+    });
+
+    // Invalid options are the only other reason a job is not queued
+    if (!sent) {
+      return res.status(400).json({ error: 'Invalid conversion options' });
+    }
+
+    res.status(202).json({
+      success: true,
+      jobId,
+      status: 'PENDING',
+      message: 'Convert job queued successfully'
+    });
+
+  } catch (error) {
+    logger.error('Error requesting conversion:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+};
+
+/**
+ * Get the status of a convert job
+ * @route GET /downloads/convert/:jobId/status
+ */
+exports.getConvertStatus = async (req, res) => {
+  try {
+    const { jobId } = req.params;
+    const job = await findOwnJob(req);
+
+    if (!job) {
+      return res.status(404).json({ error: 'Job not found' });
+    }
+
+    res.json({
+      jobId,
+      status: job.status,
+      progress: job.progress,
+      message: job.message
+    });
+
+  } catch (error) {
+    logger.error('Error getting convert status:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+};
+
+/**
+ * Download the converted image. The file is kept until the worker's gc
+ * removes it after the job's status expires.
+ * @route GET /downloads/convert/:jobId
+ */
+exports.downloadConverted = async (req, res) => {
+  try {
+    const { jobId } = req.params;
+    const job = await findOwnJob(req);
+
+    if (!job) {
+      return res.status(404).json({ error: 'Job not found' });
+    }
+
+    if (job.status === 'FAILED') {
+      return res.status(500).json({ error: 'Conversion failed', details: job.message });
+    }
+
+    if (job.status !== 'READY') {
+      return res.status(409).json({ error: 'Conversion not ready yet', status: job.status });
+    }
+
+    const filePath = job.filePath;
+
+    if (!filePath || !fs.existsSync(filePath)) {
+      return res.status(500).json({ error: 'Converted file not found on server' });
+    }
+
+    res.download(filePath, job.fileName || path.basename(filePath), (err) => {
+      if (err) {
+        if (!res.headersSent) {
+          res.status(500).json({ error: 'Download failed' });
+        }
+        logger.error(`Download error for convert job ${jobId}:`, err);
+      }
+    });
+
+  } catch (error) {
+    logger.error('Error downloading converted image:', error);
+    res.status(500).json({ error: 'Internal server error' });
+  }
+};
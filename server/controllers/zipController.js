@@ -3,6 +3,7 @@ const { v4: uuidv4 } = require('uuid');
 const path = require('path');
 const fs = require('fs');
 const logger = require('../utils/logger');
+const { traceparentFor } = require('../utils/traceContext');
 const File = require('../models/File');
 const Folder = require('../models/Folder');
 
@@ -74,7 +75,8 @@ exports.requestZip = async (req, res) => {
     const sent = await redisQueue.sendZipJob({
       jobId,
       items: resolvedItems, // Pass resolved physical paths
-      userId
+      userId,
+      traceparent: traceparentFor(req)
     });
 
     if (!sent) {
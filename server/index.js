@@ -37,6 +37,10 @@ const { verifyEmailConfig } = require("./config/emailConfig");
 // Import Redis queue and cache
 const redisQueue = require("./utils/redisQueue");
 const redisCache = require("./utils/redisCache");
+const {
+  handleImageEvent,
+  scheduleVersionReconcile,
+} = require("./utils/imageVersions");
 
 // Import routes
 const authRouter = require("./routes/auth");
@@ -46,6 +50,7 @@ const usersRouter = require("./routes/users");
 const sharedRouter = require("./routes/shared");
 const adminRouter = require("./routes/admin");
 const zipRouter = require("./routes/zipRoutes");
+const convertRouter = require("./routes/convertRoutes");
 const guestRouter = require("./routes/guest");
 const trashRouter = require("./routes/trash");
 
@@ -160,6 +165,7 @@ app.use("/api/shared", authenticateToken, sharedRouter);
 app.use("/api/admin", authenticateToken, adminRouter);
 app.use("/api/trash", authenticateToken, trashRouter);
 app.use("/api/downloads/zip", zipRouter); // Zip download endpoints
+app.use("/api/downloads/convert", convertRouter); // "Download as" endpoints
 
 app.get("/", (req, res) => {
   res.send(
@@ -180,6 +186,11 @@ mongoose.connection.once("open", async () => {
   // Initialize Redis connections
   await redisQueue.connect();
   await redisCache.connect();
+
+  // Register the versions image edit jobs write as files, including those
+  // completed while no server was subscribed
+  await redisQueue.subscribeImageEvents(handleImageEvent);
+  scheduleVersionReconcile();
 });
 
 // Error logging middleware (should be after routes)
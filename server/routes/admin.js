@@ -8,6 +8,7 @@ const { requireRole } = require("../middleware/roleAuth");
 const { formatBytes, getDirectorySize } = require("../utils/storageHelpers");
 const { getUserUploadDir } = require("../utils/fileHelpers");
 const redisCache = require("../utils/redisCache");
+const redisQueue = require("../utils/redisQueue");
 
 const router = express.Router();
 
@@ -1044,6 +1045,39 @@ router.get("/storage-report", async (req, res) => {
   }
 });
 
+/**
+ * GET /api/admin/image-jobs
+ * Get image processing queue lengths and per-day completed/failed counts
+ */
+router.get("/image-jobs", async (req, res) => {
+  try {
+    const days = Math.min(Math.max(parseInt(req.query.days) || 30, 1), 365);
+
+    logger.info("Admin fetching image job stats", {
+      adminId: req.user.id,
+      days,
+    });
+
+    const [queues, daily] = await Promise.all([
+      redisQueue.getQueueStats(),
+      redisQueue.getDailyStats(days),
+    ]);
+
+    if (!queues) {
+      return res.status(503).json({ error: "Redis is not available" });
+    }
+
+    res.json({ queues, daily: daily || [] });
+  } catch (error) {
+    logger.error("Error fetching image job stats", {
+      adminId: req.user.id,
+      error: error.message,
+      stack: error.stack,
+    });
+    res.status(500).json({ error: "Failed to fetch image job statistics" });
+  }
+});
+
 /**
  * GET /api/admin/dashboard/preferences
  * Get admin's dashboard preferences (visible widgets and order)
@@ -0,0 +1,15 @@
+const express = require('express');
+const router = express.Router();
+const convertController = require('../controllers/convertController');
+const { authenticateToken } = require('../middleware/auth');
+
+// Request a new convert job
+router.post('/', authenticateToken, convertController.requestConvert);
+
+// Get convert job status
+router.get('/:jobId/status', authenticateToken, convertController.getConvertStatus);
+
+// Download the converted image
+router.get('/:jobId', authenticateToken, convertController.downloadConverted);
+
+module.exports = router;
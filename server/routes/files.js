@@ -30,6 +30,7 @@ const {
   generateUploadId,
 } = require("../utils/chunkHelpers");
 const redisQueue = require("../utils/redisQueue");
+const { traceparentFor } = require("../utils/traceContext");
 const { checkLockStatus } = require("../utils/lockHelpers");
 const { cacheMiddleware } = require("../middleware/cache");
 const redisCache = require("../utils/redisCache");
@@ -126,6 +127,7 @@ router.post("/upload", upload.single("file"), async (req, res) => {
           fileName: req.file.originalname,
           userId: req.user.id,
           mimetype: req.file.mimetype,
+          traceparent: traceparentFor(req),
         })
         .catch((error) => {
           logger.error("Failed to send image to processing queue", {
@@ -479,6 +481,65 @@ async function streamFileWithDisconnectHandling(
   });
 }
 
+/**
+ * Send a worker-generated derivative of an original, or return false if it
+ * does not exist yet. The ETag carries the profile version recorded in
+ * <name>_manifest.json plus the file's mtime and size, so regenerated files
+ * (profile bumps, reprocessing, edits) get a new tag. Without a matching
+ * ?v=<version> the response must be revalidated; with one it is immutable.
+ * @param {string} originalPath - Path of the original upload
+ * @param {string} operation - Derivative name, e.g. "thumbnail"
+ */
+function sendDerivative(req, res, originalPath, operation) {
+  const fileName = path.basename(originalPath, path.extname(originalPath));
+  const processedDir = path.join(path.dirname(originalPath), "processed");
+  const derivativePath = path.join(
+    processedDir,
+    `${fileName}_${operation}.webp`,
+  );
+
+  let stat;
+  try {
+    stat = fs.statSync(derivativePath);
+  } catch {
+    return false;
+  }
+
+  let version = "";
+  try {
+    const manifest = JSON.parse(
+      fs.readFileSync(
+        path.join(processedDir, `${fileName}_manifest.json`),
+        "utf8",
+      ),
+    );
+    version = manifest.derivatives?.[operation]?.version || "";
+  } catch {
+    // Derivatives that predate manifests are tagged by mtime and size only
+  }
+
+  const etag = `"${version || "0"}-${stat.mtime.getTime().toString(16)}-${stat.size.toString(16)}"`;
+  res.set({
+    "Cache-Control":
+      version && req.query.v === version
+        ? "public, max-age=31536000, immutable"
+        : "public, no-cache",
+    ETag: etag,
+  });
+
+  // Check if client has cached version
+  const cached = (req.headers["if-none-match"] || "")
+    .split(",")
+    .map((tag) => tag.trim().replace(/^W\//, ""));
+  if (cached.includes(etag) || cached.includes("*")) {
+    res.status(304).end();
+    return true;
+  }
+
+  res.type("image/webp").sendFile(path.resolve(derivativePath));
+  return true;
+}
+
 // Get thumbnail for preview (from worker-processed images)
 router.get("/thumbnail/:fileId", async (req, res) => {
   try {
@@ -527,31 +588,9 @@ router.get("/thumbnail/:fileId", async (req, res) => {
       return res.status(404).json({ error: "File not found on disk" });
     }
 
-    // Extract the file's base name (UUID-originalname without extension)
-    const filePath = file.path;
-    const fileName = path.basename(filePath, path.extname(filePath));
-
-    // Construct path to worker-processed thumbnail image
-    const userDir = path.dirname(filePath);
-    const processedDir = path.join(userDir, "processed");
-    const thumbnailPath = path.join(processedDir, `${fileName}_thumbnail.webp`);
-
-    // Check if worker-generated thumbnail exists
-    if (fs.existsSync(thumbnailPath)) {
-      const stat = fs.statSync(thumbnailPath);
-      const etag = `"${stat.mtime.getTime().toString(16)}-${stat.size.toString(16)}"`;
-
-      // Check if client has cached version
-      if (req.headers["if-none-match"] === etag) {
-        return res.status(304).end();
-      }
-
-      res.set({
-        "Content-Type": "image/webp",
-        "Cache-Control": "public, max-age=31536000, immutable",
-        ETag: etag,
-      });
-      return res.sendFile(path.resolve(thumbnailPath));
+    // Serve the worker-generated thumbnail
+    if (sendDerivative(req, res, file.path, "thumbnail")) {
+      return;
     }
 
     // Fallback: return 404 if thumbnail not yet processed by worker
@@ -573,31 +612,9 @@ router.get("/blur/:fileId", async (req, res) => {
       return res.status(404).json({ error: "File not found" });
     }
 
-    // Extract the file's base name (UUID-originalname without extension)
-    const filePath = file.path;
-    const fileName = path.basename(filePath, path.extname(filePath));
-
-    // Construct path to processed blur image
-    const userDir = path.dirname(filePath);
-    const processedDir = path.join(userDir, "processed");
-    const blurPath = path.join(processedDir, `${fileName}_blur.webp`);
-
-    // Check if blur image exists
-    if (fs.existsSync(blurPath)) {
-      const stat = fs.statSync(blurPath);
-      const etag = `"${stat.mtime.getTime().toString(16)}-${stat.size.toString(16)}"`;
-
-      // Check if client has cached version
-      if (req.headers["if-none-match"] === etag) {
-        return res.status(304).end();
-      }
-
-      res.set({
-        "Content-Type": "image/webp",
-        "Cache-Control": "public, max-age=31536000, immutable",
-        ETag: etag,
-      });
-      return res.sendFile(path.resolve(blurPath));
+    // Serve the processed blur image
+    if (sendDerivative(req, res, file.path, "blur")) {
+      return;
     }
 
     // Fallback: return 404 if blur image not yet processed
@@ -619,34 +636,9 @@ router.get("/low-quality/:fileId", async (req, res) => {
       return res.status(404).json({ error: "File not found" });
     }
 
-    // Extract the file's base name (UUID-originalname without extension)
-    const filePath = file.path;
-    const fileName = path.basename(filePath, path.extname(filePath));
-
-    // Construct path to processed low-quality image
-    const userDir = path.dirname(filePath);
-    const processedDir = path.join(userDir, "processed");
-    const lowQualityPath = path.join(
-      processedDir,
-      `${fileName}_low-quality.webp`,
-    );
-
-    // Check if low-quality image exists
-    if (fs.existsSync(lowQualityPath)) {
-      const stat = fs.statSync(lowQualityPath);
-      const etag = `"${stat.mtime.getTime().toString(16)}-${stat.size.toString(16)}"`;
-
-      // Check if client has cached version
-      if (req.headers["if-none-match"] === etag) {
-        return res.status(304).end();
-      }
-
-      res.set({
-        "Content-Type": "image/webp",
-        "Cache-Control": "public, max-age=31536000, immutable",
-        ETag: etag,
-      });
-      return res.sendFile(path.resolve(lowQualityPath));
+    // Serve the processed low-quality image
+    if (sendDerivative(req, res, file.path, "low-quality")) {
+      return;
     }
 
     // Fallback: return 404 if low-quality image not yet processed
@@ -818,6 +810,7 @@ router.delete("/:id", async (req, res) => {
         `${fileName}_thumbnail.webp`,
         `${fileName}_blur.webp`,
         `${fileName}_low-quality.webp`,
+        `${fileName}_manifest.json`,
       ];
 
       processedFiles.forEach((file) => {
@@ -1194,6 +1187,7 @@ router.post("/:id/copy", async (req, res) => {
           fileName: copyName,
           userId: req.user.id,
           mimetype: sourceFile.type,
+          traceparent: traceparentFor(req),
         })
         .catch((error) => {
           logger.error("Failed to send copied image to processing queue", {
@@ -1213,6 +1207,77 @@ router.post("/:id/copy", async (req, res) => {
   }
 });
 
+// Edit an image: queue the edits; the new version appears as a file next
+// to the original once the image worker has written it
+router.post("/:id/edit", async (req, res) => {
+  try {
+    const { id } = req.params;
+    const { edits } = req.body;
+
+    if (!Array.isArray(edits) || edits.length === 0) {
+      return res.status(400).json({ error: "edits must be a non-empty array" });
+    }
+
+    const file = await File.findById(id);
+    if (!file || file.trash) {
+      return res.status(404).json({ error: "File not found" });
+    }
+    // The version is stored and counted as the owner's
+    if (file.owner.toString() !== req.user.id) {
+      return res.status(403).json({ error: "Access denied" });
+    }
+    if (!redisQueue.isImageFile(file.type)) {
+      return res.status(400).json({ error: "Only images can be edited" });
+    }
+
+    const { isLocked, lockedItem } = await checkLockStatus(file);
+    if (isLocked) {
+      return res.status(403).json({
+        error: `Item is locked${
+          lockedItem._id.toString() !== file._id.toString()
+            ? ` (inherited from ${lockedItem.name})`
+            : ""
+        }`,
+      });
+    }
+
+    // The version's size is only known once written; expect the original's
+    const user = await User.findById(req.user.id);
+    if (!user) {
+      return res.status(404).json({ error: "User not found" });
+    }
+    const storageError = validateStorageForUpload(user, file.size);
+    if (storageError) {
+      return res.status(413).json(storageError);
+    }
+
+    if (!redisQueue.isConnected) {
+      return res.status(503).json({ error: "Image processing is unavailable" });
+    }
+    const queued = await redisQueue.sendImageEditJob({
+      fileId: file._id.toString(),
+      filePath: file.path,
+      userId: req.user.id,
+      edits,
+      traceparent: traceparentFor(req),
+    });
+    // Invalid edits are the only other reason a job is not queued
+    if (!queued) {
+      return res.status(400).json({ error: "Invalid edits" });
+    }
+
+    logger.info("Image edit queued", {
+      userId: req.user.id,
+      fileId: file._id,
+      edits: edits.map((edit) => edit.op),
+    });
+
+    res.status(202).json({ message: "Edit queued" });
+  } catch (error) {
+    res.status(500).json({ error: error.message });
+  }
+});
+
 // Move file
 router.put("/:id/move", async (req, res) => {
   try {
@@ -1726,6 +1791,7 @@ router.post("/chunked-upload/:uploadId/complete", async (req, res) => {
             fileName: finalFileName,
             userId: req.user.id,
             mimetype: session.fileType,
+            traceparent: traceparentFor(req),
           })
           .catch((error) => {
             logger.error("Failed to send image to processing queue", {
@@ -0,0 +1,195 @@
+const fs = require("fs");
+const path = require("path");
+const cron = require("node-cron");
+const logger = require("./logger");
+const redisQueue = require("./redisQueue");
+const redisCache = require("./redisCache");
+const File = require("../models/File");
+const User = require("../models/User");
+const { handlePostUploadNotification } = require("./storageHelpers");
+
+/**
+ * Image Version Utilities
+ * Registers the versions image edit jobs write as files of their own
+ */
+
+// Types of the formats the worker writes edited versions in
+const VERSION_TYPES = {
+  ".jpg": "image/jpeg",
+  ".jpeg": "image/jpeg",
+  ".png": "image/png",
+  ".webp": "image/webp",
+};
+
+// <name>.v<N>.<ext>, as named by the worker
+const VERSION_SUFFIX = /\.v(\d+)(\.[^.]+)$/;
+
+/**
+ * Register the version an edit job wrote as a File in the original's
+ * folder, named "<name> (v<N>).<ext>", and count it against the owner's
+ * storage. Its derivatives are already built under the new path.
+ * @param {Object} event - job.completed event with an edited path
+ * @returns {Promise<Object|null>} the new File, or null when skipped
+ */
+async function registerEditedVersion(event) {
+  const editedPath = event.edited;
+
+  const fileId = await redisQueue.getEditSource(event.jobId);
+  if (!fileId) {
+    logger.warn("Edited version has no recorded source, not registered", {
+      jobId: event.jobId,
+      path: editedPath,
+    });
+    return null;
+  }
+  if (!(await redisQueue.claimEditedVersion(editedPath))) {
+    return null;
+  }
+
+  try {
+    return await createVersionFile(event.jobId, fileId, editedPath);
+  } catch (error) {
+    await redisQueue.releaseEditedVersion(editedPath);
+    throw error;
+  }
+}
+
+/**
+ * Create the File of an edited version claimed by registerEditedVersion,
+ * unless one already exists for its path
+ * @param {string} jobId - Job ID of the edit job
+ * @param {string} fileId - ID of the edited file
+ * @param {string} editedPath - Path of the new version
+ * @returns {Promise<Object|null>} the new File, or null when skipped
+ */
+async function createVersionFile(jobId, fileId, editedPath) {
+  if (await File.exists({ path: editedPath })) {
+    return null;
+  }
+
+  const source = await File.findById(fileId);
+  if (!source) {
+    logger.warn("Source of edited version no longer exists", {
+      fileId,
+      path: editedPath,
+    });
+    return null;
+  }
+
+  const stats = await fs.promises.stat(editedPath);
+  const match = editedPath.match(VERSION_SUFFIX);
+  const ext = match ? match[2] : path.extname(editedPath);
+  // Versions of a version are numbered after the original, so name them so
+  const baseName = path.parse(source.name).name.replace(/ \(v\d+\)$/, "");
+  const name = match
+    ? `${baseName} (v${match[1]})${ext}`
+    : path.basename(editedPath);
+
+  const file = new File({
+    name,
+    type: VERSION_TYPES[ext.toLowerCase()] || source.type,
+    path: editedPath,
+    size: stats.size,
+    parent: source.parent,
+    owner: source.owner,
+    tags: source.tags,
+  });
+  await file.save();
+
+  const user = await User.findByIdAndUpdate(
+    source.owner,
+    { $inc: { storageUsed: stats.size } },
+    { new: true },
+  );
+  if (user) {
+    handlePostUploadNotification(user, stats.size).catch((error) => {
+      logger.error("Failed to send storage notification after edit", {
+        userId: source.owner,
+        error: error.message,
+      });
+    });
+  }
+
+  redisCache.invalidateUserCache(source.owner.toString());
+
+  logger.info("Edited version registered", {
+    fileId: file._id,
+    sourceFileId: source._id,
+    jobId,
+    path: editedPath,
+    size: stats.size,
+  });
+
+  return file;
+}
+
+/**
+ * Handle an event from the image worker's image:events channel
+ * @param {Object} event - The published event
+ */
+async function handleImageEvent(event) {
+  if (event.type === "job.completed" && event.edited) {
+    await registerEditedVersion(event);
+  }
+}
+
+/**
+ * Register the versions of completed edit jobs whose job.completed event
+ * was missed, e.g. while no server was subscribed. They are found on the
+ * worker's image:done list while their source record is kept.
+ * @returns {Promise<number>} how many versions were registered
+ */
+async function reconcileEditedVersions() {
+  const pending = await redisQueue.getPendingEdits();
+  if (pending.length === 0) {
+    return 0;
+  }
+
+  const completed = await redisQueue.findCompletedEdits(new Set(pending));
+  let registered = 0;
+  for (const job of completed) {
+    try {
+      const file = await registerEditedVersion({
+        jobId: job.jobId,
+        edited: job.outputPath,
+      });
+      if (file) {
+        registered++;
+      }
+    } catch (error) {
+      logger.error("Failed to register edited version", {
+        jobId: job.jobId,
+        path: job.outputPath,
+        error: error.message,
+      });
+    }
+  }
+
+  if (registered > 0) {
+    logger.info("Registered missed edited versions", {
+      registered,
+      pending: pending.length,
+    });
+  }
+  return registered;
+}
+
+/**
+ * Reconcile edited versions now and every five minutes
+ */
+function scheduleVersionReconcile() {
+  const run = () =>
+    reconcileEditedVersions().catch((error) => {
+      logger.logError(error, { operation: "reconcile-edited-versions" });
+    });
+
+  run();
+  cron.schedule("*/5 * * * *", run);
+}
+
+module.exports = {
+  registerEditedVersion,
+  handleImageEvent,
+  reconcileEditedVersions,
+  scheduleVersionReconcile,
+};
@@ -0,0 +1,181 @@
+const imageJobSchema = require("../../schemas/image-job.schema.json");
+const zipJobSchema = require("../../schemas/zip-job.schema.json");
+
+// The keywords check implements, and annotations it may ignore
+const SUPPORTED_KEYWORDS = new Set([
+  "type",
+  "const",
+  "enum",
+  "anyOf",
+  "if",
+  "then",
+  "else",
+  "required",
+  "properties",
+  "additionalProperties",
+  "items",
+  "minItems",
+  "maxItems",
+  "minLength",
+  "minimum",
+  "maximum",
+]);
+const ANNOTATIONS = new Set([
+  "$schema",
+  "$id",
+  "$comment",
+  "title",
+  "description",
+  "default",
+  "examples",
+]);
+
+/**
+ * Throw if a schema uses a keyword check does not implement, so a schema
+ * change that adds pattern, oneOf, $ref or the like fails at startup instead
+ * of being silently ignored.
+ */
+const assertSupported = (schema, at) => {
+  for (const [keyword, value] of Object.entries(schema)) {
+    if (!SUPPORTED_KEYWORDS.has(keyword) && !ANNOTATIONS.has(keyword)) {
+      throw new Error(`${at}: unsupported JSON Schema keyword "${keyword}"`);
+    }
+    if (keyword === "type" && typeof value !== "string") {
+      throw new Error(`${at}: only a single type is supported`);
+    }
+    if (keyword === "additionalProperties" && value !== false) {
+      throw new Error(`${at}: only additionalProperties: false is supported`);
+    }
+  }
+
+  for (const keyword of ["if", "then", "else", "items"]) {
+    if (schema[keyword]) {
+      assertSupported(schema[keyword], `${at}.${keyword}`);
+    }
+  }
+  (schema.anyOf || []).forEach((alt, i) =>
+    assertSupported(alt, `${at}.anyOf[${i}]`),
+  );
+  for (const [name, field] of Object.entries(schema.properties || {})) {
+    assertSupported(field, `${at}.properties.${name}`);
+  }
+};
+
+assertSupported(imageJobSchema, "image-job.schema.json");
+assertSupported(zipJobSchema, "zip-job.schema.json");
+
+// Job payload versions this server produces; the workers reject newer ones
+const IMAGE_JOB_VERSION = imageJobSchema.properties.version.const;
+const ZIP_JOB_VERSION = zipJobSchema.properties.version.const;
+
+const typeOf = (value) => {
+  if (Array.isArray(value)) return "array";
+  if (value === null) return "null";
+  if (Number.isInteger(value)) return "integer";
+  return typeof value;
+};
+
+/**
+ * Check a value against the subset of JSON Schema the job schemas use:
+ * type, const, enum, anyOf, if/then/else, required, properties,
+ * additionalProperties: false, items, minItems, maxItems, minLength, minimum
+ * and maximum. assertSupported rejects schemas using anything else.
+ * Rules JSON Schema cannot express, such as resize needing maxWidth or
+ * maxHeight, are left to the workers.
+ * @returns {string[]} one message per problem, empty when valid
+ */
+const check = (schema, value, at, errors) => {
+  const actual = typeOf(value);
+
+  if (schema.if) {
+    const branch = check(schema.if, value, at, []).length === 0 ? schema.then : schema.else;
+    if (branch) {
+      check(branch, value, at, errors);
+    }
+  }
+  if (schema.anyOf) {
+    // Report the problems of the closest alternative of the value's type
+    const results = schema.anyOf.map((alt) => check(alt, value, at, []));
+    if (!results.some((r) => r.length === 0)) {
+      const sameType = schema.anyOf
+        .map((alt, i) => (!alt.type || alt.type === actual ? results[i] : null))
+        .filter(Boolean);
+      const candidates = sameType.length > 0 ? sameType : results;
+      errors.push(...candidates.reduce((a, b) => (b.length < a.length ? b : a)));
+    }
+  }
+
+  if (schema.type) {
+    const ok =
+      schema.type === actual || (schema.type === "number" && actual === "integer");
+    if (!ok) {
+      errors.push(`${at}: must be ${schema.type}, got ${actual}`);
+      return errors;
+    }
+  }
+  if ("const" in schema && value !== schema.const) {
+    errors.push(`${at}: must be ${JSON.stringify(schema.const)}`);
+  }
+  if (schema.enum && !schema.enum.includes(value)) {
+    errors.push(`${at}: must be one of ${schema.enum.join(", ")}`);
+  }
+  if (schema.minLength !== undefined && actual === "string" && value.length < schema.minLength) {
+    errors.push(`${at}: must not be empty`);
+  }
+  if (schema.minimum !== undefined && typeof value === "number" && value < schema.minimum) {
+    errors.push(`${at}: must be at least ${schema.minimum}`);
+  }
+  if (schema.maximum !== undefined && typeof value === "number" && value > schema.maximum) {
+    errors.push(`${at}: must be at most ${schema.maximum}`);
+  }
+
+  if (actual === "array") {
+    if (schema.minItems !== undefined && value.length < schema.minItems) {
+      errors.push(`${at}: must have at least ${schema.minItems} item(s)`);
+    }
+    if (schema.maxItems !== undefined && value.length > schema.maxItems) {
+      errors.push(`${at}: must have at most ${schema.maxItems} item(s)`);
+    }
+    if (schema.items) {
+      value.forEach((item, i) => check(schema.items, item, `${at}[${i}]`, errors));
+    }
+  }
+
+  if (actual === "object") {
+    for (const name of schema.required || []) {
+      if (value[name] === undefined) {
+        errors.push(`${at}.${name}: is required`);
+      }
+    }
+    const properties = schema.properties || {};
+    for (const [name, field] of Object.entries(value)) {
+      if (field === undefined) continue;
+      if (properties[name]) {
+        check(properties[name], field, `${at}.${name}`, errors);
+      } else if (schema.additionalProperties === false) {
+        errors.push(`${at}.${name}: unknown field`);
+      }
+    }
+  }
+
+  return errors;
+};
+
+/**
+ * Validate an image job payload against schemas/image-job.schema.json
+ * @returns {string[]} problems, empty when valid
+ */
+const validateImageJob = (job) => check(imageJobSchema, job, "job", []);
+
+/**
+ * Validate a zip job payload against schemas/zip-job.schema.json
+ * @returns {string[]} problems, empty when valid
+ */
+const validateZipJob = (job) => check(zipJobSchema, job, "job", []);
+
+module.exports = {
+  IMAGE_JOB_VERSION,
+  ZIP_JOB_VERSION,
+  validateImageJob,
+  validateZipJob,
+};
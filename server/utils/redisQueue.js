@@ -2,11 +2,36 @@ const redis = require("redis");
 const logger = require("./logger");
 const path = require("path");
 const { getBaseDir } = require("./fileHelpers");
+const {
+  IMAGE_JOB_VERSION,
+  ZIP_JOB_VERSION,
+  validateImageJob,
+  validateZipJob,
+} = require("./jobSchema");
+
+// Image job priority lanes, drained by the worker with weighted fairness
+const IMAGE_QUEUES = {
+  high: "image:jobs:high",
+  normal: "image:jobs",
+  bulk: "image:jobs:bulk",
+};
 
 class RedisQueue {
   constructor() {
     this.client = null;
+    this.subscriber = null;
     this.isConnected = false;
+    // "streams" publishes jobs to <queue>:stream for consumer-group workers
+    this.transport = process.env.JOB_QUEUE_TRANSPORT || "list";
+    // Namespace for worker keys; must match the workers' REDIS_KEY_PREFIX
+    this.keyPrefix = process.env.REDIS_KEY_PREFIX || "";
+  }
+
+  /**
+   * Apply the configured key prefix to a worker queue or status key
+   */
+  key(name) {
+    return `${this.keyPrefix}${name}`;
   }
 
   async connect() {
@@ -17,13 +42,17 @@ class RedisQueue {
     const redisHost = process.env.REDIS_HOST || "localhost";
     const redisPort = process.env.REDIS_PORT || 6379;
     const redisDB = process.env.REDIS_DB || 0;
+    const useTLS = process.env.REDIS_TLS === "true";
 
     try {
       this.client = redis.createClient({
         socket: {
           host: redisHost,
           port: redisPort,
+          tls: useTLS,
+          rejectUnauthorized: process.env.REDIS_TLS_SKIP_VERIFY !== "true",
         },
+        password: process.env.REDIS_PASSWORD || undefined,
         database: redisDB,
       });
 
@@ -53,6 +82,10 @@ class RedisQueue {
   }
 
   async disconnect() {
+    if (this.subscriber) {
+      await this.subscriber.quit();
+      this.subscriber = null;
+    }
     if (this.client) {
       await this.client.quit();
       this.isConnected = false;
@@ -60,6 +93,22 @@ class RedisQueue {
     }
   }
 
+  /**
+   * Push a job onto a worker queue using the configured transport.
+   * Workers in stream mode also drain the list, so either side can migrate first.
+   * @param {string} queueName - List name, e.g. "image:jobs"
+   * @param {Object} job - Job payload
+   */
+  async enqueue(queueName, job) {
+    if (this.transport === "streams") {
+      await this.client.xAdd(this.key(`${queueName}:stream`), "*", {
+        job: JSON.stringify(job),
+      });
+      return;
+    }
+    await this.client.rPush(this.key(queueName), JSON.stringify(job));
+  }
+
   /**
    * Check if a file is an image based on its mimetype
    */
@@ -85,6 +134,8 @@ class RedisQueue {
    * @param {string} jobData.userId - User ID
    * @param {string} jobData.mimetype - File mimetype
    * @param {Array<string>} jobData.operations - Operations to perform (default: ["thumbnail", "blur", "low-quality"])
+   * @param {string} [jobData.priority] - "high", "normal" (default) or "bulk"
+   * @param {string} [jobData.traceparent] - W3C trace context to continue in the worker
    */
   async sendImageJob(jobData) {
     if (!this.isConnected || !this.client) {
@@ -112,22 +163,41 @@ class RedisQueue {
       const outputDir = path.join(getBaseDir(), jobData.userId, "processed");
 
       const job = {
+        version: IMAGE_JOB_VERSION,
         jobId: jobId,
+        userId: String(jobData.userId),
         inputPath: path.resolve(jobData.filePath),
         outputDir: path.resolve(outputDir),
         operations: jobData.operations || ["thumbnail", "blur", "low-quality"],
         timestamp: Date.now(),
         retryCount: 0,
+        priority: IMAGE_QUEUES[jobData.priority] ? jobData.priority : "normal",
       };
+      if (jobData.traceparent) {
+        job.traceparent = jobData.traceparent;
+      }
+
+      // The worker would fail an invalid job anyway; catch it before it is queued
+      const problems = validateImageJob(job);
+      if (problems.length > 0) {
+        logger.error("Invalid image job, not queued", {
+          jobId: job.jobId,
+          fileName: jobData.fileName,
+          problems,
+        });
+        return false;
+      }
 
-      // Push job to Redis queue using RPUSH (FIFO)
-      await this.client.rPush("image:jobs", JSON.stringify(job));
+      // Push job to Redis queue (RPUSH or XADD depending on transport)
+      await this.enqueue(IMAGE_QUEUES[job.priority], job);
 
       logger.info("Image processing job sent to queue", {
         jobId: job.jobId,
         fileName: jobData.fileName,
         userId: jobData.userId,
         operations: job.operations,
+        priority: job.priority,
+        traceparent: job.traceparent,
       });
 
       return true;
@@ -141,7 +211,108 @@ class RedisQueue {
   }
 
   /**
-   * Get queue statistics
+   * Send an image edit job. The worker applies the edits to the original,
+   * writes the result as <name>.v<N>.<ext> next to it and builds the new
+   * version's derivatives; the path arrives in the job.completed event,
+   * which registerEditedVersion turns into a File next to the original.
+   * @param {Object} jobData - The job data
+   * @param {string} jobData.fileId - File the edits apply to
+   * @param {string} jobData.filePath - Absolute path to the original
+   * @param {string} jobData.userId - User ID
+   * @param {Array<Object>} jobData.edits - Transforms in order, e.g. {op: "rotate", angle: 90}
+   * @param {string} [jobData.priority] - "high" (default), "normal" or "bulk"
+   * @param {string} [jobData.traceparent] - W3C trace context to continue in the worker
+   */
+  async sendImageEditJob(jobData) {
+    if (!this.isConnected || !this.client) {
+      logger.warn("Redis not connected - skipping image edit job", {
+        filePath: jobData.filePath,
+      });
+      return false;
+    }
+
+    try {
+      const jobId = path.parse(path.basename(jobData.filePath)).name;
+      const outputDir = path.join(getBaseDir(), jobData.userId, "processed");
+
+      const job = {
+        version: IMAGE_JOB_VERSION,
+        type: "edit",
+        jobId: jobId,
+        userId: String(jobData.userId),
+        inputPath: path.resolve(jobData.filePath),
+        outputDir: path.resolve(outputDir),
+        operations: ["thumbnail", "blur", "low-quality"],
+        edits: jobData.edits,
+        timestamp: Date.now(),
+        retryCount: 0,
+        // The user is waiting on the result
+        priority: IMAGE_QUEUES[jobData.priority] ? jobData.priority : "high",
+      };
+      if (jobData.traceparent) {
+        job.traceparent = jobData.traceparent;
+      }
+
+      const problems = validateImageJob(job);
+      if (problems.length > 0) {
+        logger.error("Invalid image edit job, not queued", {
+          jobId: job.jobId,
+          problems,
+        });
+        return false;
+      }
+
+      // Remember the source file for the job.completed event; the worker
+      // gives up on a job well within a day
+      await this.client.setEx(
+        this.key(`image:edit:${job.jobId}`),
+        86400,
+        String(jobData.fileId),
+      );
+
+      await this.enqueue(IMAGE_QUEUES[job.priority], job);
+
+      logger.info("Image edit job sent to queue", {
+        jobId: job.jobId,
+        userId: jobData.userId,
+        edits: job.edits.map((edit) => edit.op),
+        priority: job.priority,
+        traceparent: job.traceparent,
+      });
+
+      return true;
+    } catch (error) {
+      logger.error("Failed to send image edit job to queue", {
+        error: error.message,
+        filePath: jobData.filePath,
+      });
+      return false;
+    }
+  }
+
+  /**
+   * Count the jobs waiting on a queue. With the streams transport this
+   * includes <queue>:stream, whose entries the workers delete once
+   * finished, so it holds queued and running jobs. The list still counts
+   * while workers drain it.
+   * @param {string} queueName - Unprefixed queue name
+   */
+  async queueLength(queueName) {
+    const listed = this.client.lLen(this.key(queueName));
+    if (this.transport !== "streams") {
+      return listed;
+    }
+    const [list, stream] = await Promise.all([
+      listed,
+      this.client.xLen(this.key(`${queueName}:stream`)),
+    ]);
+    return list + stream;
+  }
+
+  /**
+   * Get queue statistics. `pending` counts work still to do; `done` and
+   * `failed` are the retained terminal jobs, bounded by the worker's
+   * retention settings.
    */
   async getQueueStats() {
     if (!this.isConnected || !this.client) {
@@ -149,31 +320,226 @@ class RedisQueue {
     }
 
     try {
-      const [jobs, retry, failed, done] = await Promise.all([
-        this.client.lLen("image:jobs"),
-        this.client.lLen("image:retry"),
-        this.client.lLen("image:failed"),
-        this.client.lLen("image:done"),
+      const [high, jobs, bulk, retry, failed, done] = await Promise.all([
+        this.queueLength(IMAGE_QUEUES.high),
+        this.queueLength(IMAGE_QUEUES.normal),
+        this.queueLength(IMAGE_QUEUES.bulk),
+        this.queueLength("image:retry"),
+        this.client.lLen(this.key("image:failed")),
+        this.client.lLen(this.key("image:done")),
       ]);
 
       return {
+        high,
         jobs,
+        bulk,
         retry,
         failed,
         done,
-        total: jobs + retry + failed + done,
+        pending: high + jobs + bulk + retry,
       };
     } catch (error) {
       logger.error("Failed to get queue stats", { error: error.message });
       return null;
     }
   }
+
+  /**
+   * Get per-day image job outcomes rolled up by the worker
+   * (IMAGE_DAILY_STATS_DAYS), oldest first. Days without a record count 0.
+   * @param {number} days - Number of days up to and including today (UTC)
+   */
+  async getDailyStats(days = 30) {
+    if (!this.isConnected || !this.client) {
+      return null;
+    }
+
+    try {
+      const dates = [];
+      for (let i = days - 1; i >= 0; i--) {
+        const day = new Date(Date.now() - i * 86400000);
+        dates.push(day.toISOString().slice(0, 10));
+      }
+
+      const counters = await Promise.all(
+        dates.map((date) =>
+          this.client.hGetAll(this.key(`image:stats:daily:${date}`)),
+        ),
+      );
+
+      return dates.map((date, i) => ({
+        date,
+        completed: parseInt(counters[i].completed || "0", 10),
+        failed: parseInt(counters[i].failed || "0", 10),
+      }));
+    } catch (error) {
+      logger.error("Failed to get daily image job stats", {
+        error: error.message,
+      });
+      return null;
+    }
+  }
+
+  /**
+   * Get the ID of the file an edit job was sent for, or null once the
+   * record has expired
+   * @param {string} jobId - Job ID of the edit job
+   */
+  async getEditSource(jobId) {
+    if (!this.isConnected || !this.client) {
+      return null;
+    }
+    return this.client.get(this.key(`image:edit:${jobId}`));
+  }
+
+  /**
+   * Claim registering an edited version. Every server instance receives
+   * the job.completed event; only the first to claim the path registers it.
+   * @param {string} editedPath - Path of the new version
+   * @returns {Promise<boolean>} whether this instance should register it
+   */
+  async claimEditedVersion(editedPath) {
+    if (!this.isConnected || !this.client) {
+      return false;
+    }
+    const reply = await this.client.set(
+      this.key(`image:edited:${editedPath}`),
+      "1",
+      { condition: "NX", expiration: { type: "EX", value: 86400 } },
+    );
+    return reply === "OK";
+  }
+
+  /**
+   * Release a claim taken with claimEditedVersion when registering the
+   * version failed, so a later reconcile pass can retry it
+   * @param {string} editedPath - Path of the new version
+   */
+  async releaseEditedVersion(editedPath) {
+    if (!this.isConnected || !this.client) {
+      return;
+    }
+    await this.client.del(this.key(`image:edited:${editedPath}`));
+  }
+
+  /**
+   * Get the job IDs of edit jobs whose source record is still kept
+   * @returns {Promise<string[]>}
+   */
+  async getPendingEdits() {
+    if (!this.isConnected || !this.client) {
+      return [];
+    }
+
+    const prefix = this.key("image:edit:");
+    const jobIds = [];
+    let cursor = "0";
+    do {
+      const result = await this.client.scan(cursor, {
+        MATCH: `${prefix}*`,
+        COUNT: 100,
+      });
+      cursor = result.cursor.toString();
+      for (const key of result.keys) {
+        jobIds.push(key.slice(prefix.length));
+      }
+    } while (cursor !== "0");
+
+    return jobIds;
+  }
+
+  /**
+   * Find the done records of completed edit jobs among jobIds on
+   * image:done, newest first. Records older than the source records, which
+   * last a day, are not read. Only records the worker's retention still
+   * keeps are found.
+   * @param {Set<string>} jobIds - Job IDs of the edit jobs to look for
+   * @returns {Promise<Object[]>} the done records found
+   */
+  async findCompletedEdits(jobIds) {
+    if (!this.isConnected || !this.client || jobIds.size === 0) {
+      return [];
+    }
+
+    const pageSize = 500;
+    const cutoff = Date.now() - 86400000;
+    // Edits of one file share its job ID, so versions are told apart by path
+    const found = new Map();
+    for (let start = 0; ; start += pageSize) {
+      const page = await this.client.lRange(
+        this.key("image:done"),
+        start,
+        start + pageSize - 1,
+      );
+      for (const raw of page) {
+        let job;
+        try {
+          job = JSON.parse(raw);
+        } catch {
+          continue;
+        }
+        if ((job.finishedAt || job.timestamp || 0) < cutoff) {
+          return [...found.values()];
+        }
+        if (job.type === "edit" && job.outputPath && jobIds.has(job.jobId)) {
+          found.set(job.outputPath, job);
+        }
+      }
+      if (page.length < pageSize) {
+        return [...found.values()];
+      }
+    }
+  }
+
+  /**
+   * Call handler with every event the image worker publishes on
+   * image:events. The subscription needs a connection of its own, as a
+   * subscribed client cannot run other commands.
+   * @param {function(Object): Promise<void>} handler - Called per event
+   */
+  async subscribeImageEvents(handler) {
+    if (!this.isConnected || !this.client) {
+      logger.warn("Redis not connected - not subscribing to image events");
+      return;
+    }
+
+    try {
+      this.subscriber = this.client.duplicate();
+      this.subscriber.on("error", (err) => {
+        logger.error("Redis subscriber error", { error: err.message });
+      });
+      await this.subscriber.connect();
+      await this.subscriber.subscribe(this.key("image:events"), (message) => {
+        let event;
+        try {
+          event = JSON.parse(message);
+        } catch (error) {
+          logger.warn("Invalid image event", { error: error.message });
+          return;
+        }
+        handler(event).catch((error) => {
+          logger.error("Failed to handle image event", {
+            type: event.type,
+            jobId: event.jobId,
+            error: error.message,
+          });
+        });
+      });
+      logger.info("Subscribed to image events");
+    } catch (error) {
+      logger.error("Failed to subscribe to image events", {
+        error: error.message,
+      });
+    }
+  }
+
   /**
    * Send a zip creation job to the Redis queue
    * @param {Object} jobData - The job data
    * @param {string} jobData.jobId - Unique Job ID
    * @param {Array<Object>} jobData.items - List of files/folders to zip
    * @param {string} jobData.userId - User ID requesting the zip
+   * @param {string} [jobData.traceparent] - W3C trace context to continue in the worker
    */
   async sendZipJob(jobData) {
     if (!this.isConnected || !this.client) {
@@ -185,28 +551,42 @@ class RedisQueue {
 
     try {
       const job = {
+        version: ZIP_JOB_VERSION,
         jobId: jobData.jobId,
         items: jobData.items,
-        userId: jobData.userId,
+        userId: String(jobData.userId),
         outputDir: path.join(getBaseDir(), "temp"),
         timestamp: Date.now(),
       };
+      if (jobData.traceparent) {
+        job.traceparent = jobData.traceparent;
+      }
+
+      const problems = validateZipJob(job);
+      if (problems.length > 0) {
+        logger.error("Invalid zip job, not queued", {
+          jobId: job.jobId,
+          problems,
+        });
+        return false;
+      }
 
       // Set initial status
-      await this.client.hSet(`zip:job:${job.jobId}`, {
+      await this.client.hSet(this.key(`zip:job:${job.jobId}`), {
         status: "PENDING",
         progress: "0",
         message: "Queued",
       });
       // Set expiry for status key (e.g., 24 hours) to prevent clutter
-      await this.client.expire(`zip:job:${job.jobId}`, 86400);
+      await this.client.expire(this.key(`zip:job:${job.jobId}`), 86400);
 
       // Push job to Redis queue
-      await this.client.rPush("zip:jobs", JSON.stringify(job));
+      await this.enqueue("zip:jobs", job);
 
       logger.info("Zip job sent to queue", {
         jobId: job.jobId,
         itemCount: job.items.length,
+        traceparent: job.traceparent,
       });
 
       return true;
@@ -219,6 +599,107 @@ class RedisQueue {
     }
   }
 
+  /**
+   * Send a format conversion job for a "download as" export. The worker
+   * writes <BaseDir>/temp/<jobId>.<ext> and reports progress in
+   * image:convert:<jobId>, polled like a zip job.
+   * @param {Object} jobData - The job data
+   * @param {string} jobData.jobId - Unique Job ID
+   * @param {string} jobData.filePath - Absolute path to the image to convert
+   * @param {string} jobData.userId - User ID requesting the download
+   * @param {string} jobData.fileName - Name to download the result as
+   * @param {Object} jobData.convert - e.g. {format: "jpeg", quality: 85, maxWidth: 2048, stripMetadata: true}
+   * @param {string} [jobData.traceparent] - W3C trace context to continue in the worker
+   */
+  async sendConvertJob(jobData) {
+    if (!this.isConnected || !this.client) {
+      logger.warn("Redis not connected - skipping convert job", {
+        jobId: jobData.jobId,
+      });
+      return false;
+    }
+
+    try {
+      const job = {
+        version: IMAGE_JOB_VERSION,
+        type: "convert",
+        jobId: jobData.jobId,
+        userId: String(jobData.userId),
+        inputPath: path.resolve(jobData.filePath),
+        outputDir: path.join(getBaseDir(), "temp"),
+        convert: jobData.convert,
+        timestamp: Date.now(),
+        retryCount: 0,
+        // The user is waiting on the download
+        priority: "high",
+      };
+      if (jobData.traceparent) {
+        job.traceparent = jobData.traceparent;
+      }
+
+      const problems = validateImageJob(job);
+      if (problems.length > 0) {
+        logger.error("Invalid convert job, not queued", {
+          jobId: job.jobId,
+          problems,
+        });
+        return false;
+      }
+
+      // Set initial status; the worker refreshes the same 24 hour expiry.
+      // The owner and name are only read by the download route
+      await this.client.hSet(this.key(`image:convert:${job.jobId}`), {
+        status: "PENDING",
+        progress: "0",
+        message: "Queued",
+        userId: job.userId,
+        fileName: jobData.fileName,
+      });
+      await this.client.expire(this.key(`image:convert:${job.jobId}`), 86400);
+
+      await this.enqueue(IMAGE_QUEUES[job.priority], job);
+
+      logger.info("Convert job sent to queue", {
+        jobId: job.jobId,
+        userId: jobData.userId,
+        format: job.convert.format,
+        traceparent: job.traceparent,
+      });
+
+      return true;
+    } catch (error) {
+      logger.error("Failed to send convert job to queue", {
+        error: error.message,
+        jobId: jobData.jobId,
+      });
+      return false;
+    }
+  }
+
+  /**
+   * Get convert job status, in the shape of getZipJob
+   * @param {string} jobId
+   */
+  async getConvertJob(jobId) {
+    if (!this.isConnected || !this.client) {
+      return null;
+    }
+
+    try {
+      const job = await this.client.hGetAll(this.key(`image:convert:${jobId}`));
+      if (!job || Object.keys(job).length === 0) {
+        return null;
+      }
+      return job;
+    } catch (error) {
+      logger.error("Failed to get convert job status", {
+        error: error.message,
+        jobId,
+      });
+      return null;
+    }
+  }
+
   /**
    * Get zip job status
    * @param {string} jobId
@@ -229,7 +710,7 @@ class RedisQueue {
     }
 
     try {
-      const job = await this.client.hGetAll(`zip:job:${jobId}`);
+      const job = await this.client.hGetAll(this.key(`zip:job:${jobId}`));
       if (!job || Object.keys(job).length === 0) {
         return null;
       }
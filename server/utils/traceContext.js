@@ -0,0 +1,23 @@
+// W3C trace context: version-traceid-parentid-flags
+const TRACEPARENT_RE = /^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$/;
+
+/**
+ * Get the traceparent to carry in a job payload.
+ * The server does not record spans of its own, so the only real parent is
+ * the span of whoever called it: the incoming request's traceparent header
+ * (from an ingress or browser) is passed through unchanged. Without a valid
+ * header no trace context is sent and the worker's job span is the root of
+ * its trace.
+ * @param {Object} req - Express request
+ * @returns {string|undefined}
+ */
+const traceparentFor = (req) => {
+  const header = req && req.get ? req.get("traceparent") : undefined;
+  const match = header && TRACEPARENT_RE.exec(header.trim().toLowerCase());
+  if (!match || /^0+$/.test(match[1]) || /^0+$/.test(match[2])) {
+    return undefined;
+  }
+  return match[0];
+};
+
+module.exports = { traceparentFor };
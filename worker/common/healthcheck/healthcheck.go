@@ -0,0 +1,40 @@
+// Package healthcheck renders the workers' /healthz and /readyz responses.
+package healthcheck
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// Write responds 200 when every check passed and 503 otherwise, with each
+// check's result in the body.
+func Write(w http.ResponseWriter, checks map[string]error) {
+	status := http.StatusOK
+	results := make(map[string]string, len(checks))
+	for name, err := range checks {
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			results[name] = err.Error()
+			continue
+		}
+		results[name] = "ok"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": http.StatusText(status),
+		"checks": results,
+	})
+}
+
+// Writable creates and removes a scratch file in dir.
+func Writable(dir string) error {
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,36 @@
+// Package jobjson finds the payload keys a job struct does not know, which
+// encoding/json silently ignores, so the workers can fail such jobs with the
+// misspelled field named.
+package jobjson
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Fields returns the JSON names of t's serialized fields.
+func Fields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// Unknown returns the sorted keys of fields not in known, each prefixed
+// with prefix.
+func Unknown(fields map[string]json.RawMessage, known map[string]bool, prefix string) []string {
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, prefix+name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,29 @@
+package jobjson
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUnknown(t *testing.T) {
+	type job struct {
+		ID      string   `json:"jobId"`
+		Items   []string `json:"items,omitempty"`
+		Skipped string   `json:"-"`
+		secret  string
+	}
+	known := Fields(reflect.TypeOf(job{}))
+
+	var fields map[string]json.RawMessage
+	data := `{"jobId":"a","items":[],"operation":"x","Skipped":"y","secret":"z"}`
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	got := Unknown(fields, known, "job.")
+	want := []string{"job.Skipped", "job.operation", "job.secret"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unknown() = %v, want %v", got, want)
+	}
+}
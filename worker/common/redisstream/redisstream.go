@@ -0,0 +1,114 @@
+// Package redisstream holds the consumer group handling the image-worker and
+// the zipping-worker share when jobs arrive on Redis streams: creating the
+// groups, reclaiming entries a crashed consumer left pending, and removing
+// finished entries.
+package redisstream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ClaimInterval is how often a Claimer scans the pending entries while it
+// finds none to reclaim.
+const ClaimInterval = 30 * time.Second
+
+// CreateGroups creates group on each stream, and the streams themselves if
+// needed. Groups that already exist are left as they are.
+func CreateGroups(ctx context.Context, client *redis.Client, group string, streams ...string) error {
+	for _, stream := range streams {
+		err := client.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create consumer group %s on %s: %v", group, stream, err)
+		}
+	}
+	return nil
+}
+
+// Remove acknowledges an entry and deletes it, so a stream only holds jobs
+// not yet finished. Streams are read by a single consumer group, so no other
+// reader still needs the entry.
+func Remove(ctx context.Context, client *redis.Client, group, stream, id string) error {
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, stream, group, id)
+		pipe.XDel(ctx, stream, id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to ack %s on %s: %v", id, stream, err)
+	}
+	return nil
+}
+
+// Claimer takes over entries that another consumer of Group left pending
+// for longer than MinIdle, e.g. because it crashed mid-job. XAUTOCLAIM scans
+// the pending list, so a Claimer runs it at most every Interval, or
+// ClaimInterval when zero, until it finds something.
+type Claimer struct {
+	Client   *redis.Client
+	Group    string
+	Consumer string
+	MinIdle  time.Duration
+	Interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// due reports whether a scan is due at now and, if so, records it.
+func (c *Claimer) due(now time.Time) bool {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = ClaimInterval
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.last) < interval {
+		return false
+	}
+	c.last = now
+	return true
+}
+
+// rescan makes the next Claim scan again.
+func (c *Claimer) rescan() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = time.Time{}
+}
+
+// Claim takes over at most one stuck entry from the first of streams that
+// has one, and returns it with its stream. It returns a nil entry when none
+// is stuck or no scan is due.
+func (c *Claimer) Claim(ctx context.Context, streams ...string) (string, *redis.XMessage, error) {
+	if !c.due(time.Now()) {
+		return "", nil, nil
+	}
+
+	for _, stream := range streams {
+		claimed, _, err := c.Client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    c.Group,
+			Consumer: c.Consumer,
+			MinIdle:  c.MinIdle,
+			Start:    "0-0",
+			Count:    1,
+		}).Result()
+		if err != nil {
+			return "", nil, fmt.Errorf("xautoclaim on %s failed: %v", stream, err)
+		}
+		if len(claimed) > 0 {
+			// More may be waiting; scan again on the next call
+			c.rescan()
+			return stream, &claimed[0], nil
+		}
+	}
+
+	return "", nil, nil
+}
@@ -0,0 +1,48 @@
+package redisstream
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClaimerDue(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		calls    []time.Duration // Offsets from start
+		want     []bool
+	}{
+		{"first call scans", time.Minute, []time.Duration{0}, []bool{true}},
+		{"throttled within interval", time.Minute, []time.Duration{0, time.Second, 59 * time.Second}, []bool{true, false, false}},
+		{"scans again after interval", time.Minute, []time.Duration{0, time.Minute, 90 * time.Second, 2 * time.Minute}, []bool{true, true, false, true}},
+		{"zero interval uses default", 0, []time.Duration{0, ClaimInterval - time.Second, ClaimInterval}, []bool{true, false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Claimer{Interval: tt.interval}
+			for i, offset := range tt.calls {
+				if got := c.due(start.Add(offset)); got != tt.want[i] {
+					t.Errorf("call %d at +%v: due = %v, want %v", i, offset, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClaimerRescan(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := &Claimer{Interval: time.Minute}
+	if !c.due(now) {
+		t.Fatal("first call not due")
+	}
+	c.rescan()
+	if !c.due(now.Add(time.Second)) {
+		t.Error("not due right after rescan")
+	}
+	if c.due(now.Add(2 * time.Second)) {
+		t.Error("due again within interval after scanning")
+	}
+}
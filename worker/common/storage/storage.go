@@ -0,0 +1,377 @@
+// Package storage reads and writes the workers' inputs and outputs by URI:
+// s3://bucket/key on an S3-compatible endpoint, anything else on the local
+// filesystem.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"worker-common/workercfg"
+)
+
+const s3Scheme = "s3://"
+
+// Storage opens, creates and removes objects by URI. CreateNew is Create
+// for an object that must not exist yet: its Close fails with an error
+// matching fs.ErrExist, storing nothing, when another writer got there first.
+type Storage interface {
+	Open(ctx context.Context, uri string) (io.ReadCloser, error)
+	Create(ctx context.Context, uri string) (Upload, error)
+	CreateNew(ctx context.Context, uri string) (Upload, error)
+	Remove(ctx context.Context, uri string) error
+}
+
+// Upload is an object being written. Close stores it; Abort discards it and
+// is a no-op after Close.
+type Upload interface {
+	io.Writer
+	Close() error
+	Abort()
+}
+
+// IsS3URI reports whether uri names an S3 object.
+func IsS3URI(uri string) bool {
+	return strings.HasPrefix(uri, s3Scheme)
+}
+
+// JoinURI joins a directory and a file name, keeping s3:// URIs intact.
+func JoinURI(dir, name string) string {
+	if IsS3URI(dir) {
+		return strings.TrimSuffix(dir, "/") + "/" + name
+	}
+	return filepath.Join(dir, name)
+}
+
+// ReadAll reads the whole object at uri.
+func ReadAll(ctx context.Context, st Storage, uri string) ([]byte, error) {
+	r, err := st.Open(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// WriteAll stores data at uri, replacing any existing object.
+func WriteAll(ctx context.Context, st Storage, uri string, data []byte) error {
+	u, err := st.Create(ctx, uri)
+	if err != nil {
+		return err
+	}
+	if _, err := u.Write(data); err != nil {
+		u.Abort()
+		return err
+	}
+	return u.Close()
+}
+
+// WriteNew stores data at uri unless an object is already there, in which
+// case the error matches fs.ErrExist.
+func WriteNew(ctx context.Context, st Storage, uri string, data []byte) error {
+	u, err := st.CreateNew(ctx, uri)
+	if err != nil {
+		return err
+	}
+	if _, err := u.Write(data); err != nil {
+		u.Abort()
+		return err
+	}
+	return u.Close()
+}
+
+// New returns storage for local paths and, when an endpoint is configured,
+// s3:// URIs.
+func New(cfg workercfg.S3Config) (Storage, error) {
+	st := &routed{}
+	if cfg.Endpoint == "" {
+		return st, nil
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.TLS,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client for %s: %v", cfg.Endpoint, err)
+	}
+	st.s3 = &s3Storage{client: client, partSize: cfg.PartSize}
+	return st, nil
+}
+
+// routed dispatches on the URI scheme.
+type routed struct {
+	local Local
+	s3    *s3Storage
+}
+
+func (st *routed) pick(uri string) (Storage, error) {
+	if !IsS3URI(uri) {
+		return st.local, nil
+	}
+	if st.s3 == nil {
+		return nil, fmt.Errorf("%s: S3 storage is not configured (set -s3-endpoint)", uri)
+	}
+	return st.s3, nil
+}
+
+func (st *routed) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	s, err := st.pick(uri)
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(ctx, uri)
+}
+
+func (st *routed) Create(ctx context.Context, uri string) (Upload, error) {
+	s, err := st.pick(uri)
+	if err != nil {
+		return nil, err
+	}
+	return s.Create(ctx, uri)
+}
+
+func (st *routed) CreateNew(ctx context.Context, uri string) (Upload, error) {
+	s, err := st.pick(uri)
+	if err != nil {
+		return nil, err
+	}
+	return s.CreateNew(ctx, uri)
+}
+
+func (st *routed) Remove(ctx context.Context, uri string) error {
+	s, err := st.pick(uri)
+	if err != nil {
+		return err
+	}
+	return s.Remove(ctx, uri)
+}
+
+// Local is the filesystem. Files are written to <path>.tmp and renamed into
+// place on Close, so a partial file is never seen and a file hardlinked
+// into other directories is replaced, not truncated.
+type Local struct{}
+
+func (Local) Open(_ context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (Local) Create(_ context.Context, path string) (Upload, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &localUpload{File: f, path: path}, nil
+}
+
+// CreateNew writes to a temp file of its own, as concurrent writers of the
+// same path would clobber <path>.tmp, and hardlinks it into place, which
+// unlike a rename fails when the path exists.
+func (Local) CreateNew(_ context.Context, path string) (Upload, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &localUpload{File: f, path: path, exclusive: true}, nil
+}
+
+func (Local) Remove(_ context.Context, path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+type localUpload struct {
+	*os.File
+	path      string
+	exclusive bool
+	done      bool
+}
+
+func (u *localUpload) Close() error {
+	u.done = true
+	if err := u.File.Close(); err != nil {
+		os.Remove(u.File.Name())
+		return err
+	}
+	if u.exclusive {
+		// The link error is an *os.LinkError, which matches fs.ErrExist
+		err := os.Link(u.File.Name(), u.path)
+		os.Remove(u.File.Name())
+		return err
+	}
+	if err := os.Rename(u.File.Name(), u.path); err != nil {
+		os.Remove(u.File.Name())
+		return err
+	}
+	return nil
+}
+
+func (u *localUpload) Abort() {
+	if u.done {
+		return
+	}
+	u.done = true
+	u.File.Close()
+	os.Remove(u.File.Name())
+}
+
+// s3Storage is an S3-compatible object store. Reads stream the object;
+// writes stream into a multipart upload of partSize parts.
+type s3Storage struct {
+	client   *minio.Client
+	partSize uint64
+}
+
+// parseS3URI splits s3://bucket/key.
+func parseS3URI(uri string) (bucket, key string, err error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(uri, s3Scheme), "/")
+	if !ok || bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid S3 URI %q (want s3://bucket/key)", uri)
+	}
+	return bucket, key, nil
+}
+
+func (s *s3Storage) Open(ctx context.Context, uri string) (io.ReadCloser, error) {
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; stat it so a missing object fails here, like os.Open
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, &fs.PathError{Op: "open", Path: uri, Err: fs.ErrNotExist}
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *s3Storage) Create(ctx context.Context, uri string) (Upload, error) {
+	return s.create(ctx, uri, false)
+}
+
+// CreateNew sends If-None-Match: *, which S3 also checks when completing a
+// multipart upload.
+func (s *s3Storage) CreateNew(ctx context.Context, uri string) (Upload, error) {
+	return s.create(ctx, uri, true)
+}
+
+func (s *s3Storage) create(ctx context.Context, uri string, exclusive bool) (Upload, error) {
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := minio.PutObjectOptions{
+		PartSize:    s.partSize,
+		ContentType: contentType(key),
+	}
+	if exclusive {
+		opts.SetMatchETagExcept("*")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+	u := &s3Upload{pw: pw, cancel: cancel, done: make(chan error, 1)}
+	go func() {
+		// An unknown size makes minio-go upload parts of PartSize as they
+		// fill, holding one part in memory instead of the whole object
+		_, err := s.client.PutObject(ctx, bucket, key, pr, -1, opts)
+		switch minio.ToErrorResponse(err).Code {
+		case minio.PreconditionFailed, "ConditionalRequestConflict":
+			// Taken, or being written by a concurrent conditional upload
+			err = &fs.PathError{Op: "create", Path: uri, Err: fs.ErrExist}
+		}
+		pr.CloseWithError(err)
+		u.done <- err
+	}()
+	return u, nil
+}
+
+func (s *s3Storage) Remove(ctx context.Context, uri string) error {
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+}
+
+var errUploadAborted = errors.New("upload aborted")
+
+type s3Upload struct {
+	pw       *io.PipeWriter
+	cancel   context.CancelFunc
+	done     chan error
+	finished bool
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	return u.pw.Write(p)
+}
+
+func (u *s3Upload) Close() error {
+	u.finished = true
+	u.pw.Close()
+	err := <-u.done
+	u.cancel()
+	return err
+}
+
+// Abort fails the upload, which makes minio-go abort the multipart upload
+// instead of completing it.
+func (u *s3Upload) Abort() {
+	if u.finished {
+		return
+	}
+	u.finished = true
+	u.pw.CloseWithError(errUploadAborted)
+	u.cancel()
+	<-u.done
+}
+
+// contentTypes are the Content-Type of the outputs the workers write.
+var contentTypes = map[string]string{
+	".webp": "image/webp",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".json": "application/json",
+	".zip":  "application/zip",
+}
+
+func contentType(key string) string {
+	if ct, ok := contentTypes[strings.ToLower(path.Ext(key))]; ok {
+		return ct
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"worker-common/workercfg"
+)
+
+// testS3 connects to the MinIO (or other S3-compatible) endpoint named by
+// MINIO_ENDPOINT and creates a scratch bucket removed after the test. The
+// test is skipped when MINIO_ENDPOINT is unset, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	MINIO_ENDPOINT=localhost:9000 go test ./storage
+func testS3(t *testing.T) (*s3Storage, string) {
+	t.Helper()
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_ENDPOINT not set")
+	}
+	cfg := workercfg.S3Config{
+		Endpoint:  endpoint,
+		AccessKey: envOr("MINIO_ACCESS_KEY", "minioadmin"),
+		SecretKey: envOr("MINIO_SECRET_KEY", "minioadmin"),
+		TLS:       os.Getenv("MINIO_TLS") == "true",
+		PartSize:  5 << 20,
+	}
+	st, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := st.(*routed).s3
+
+	ctx := context.Background()
+	bucket := fmt.Sprintf("storage-test-%d", time.Now().UnixNano())
+	if err := s3.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	t.Cleanup(func() {
+		for obj := range s3.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true}) {
+			s3.client.RemoveObject(ctx, bucket, obj.Key, minio.RemoveObjectOptions{})
+		}
+		for upload := range s3.client.ListIncompleteUploads(ctx, bucket, "", true) {
+			s3.client.RemoveIncompleteUpload(ctx, bucket, upload.Key)
+		}
+		s3.client.RemoveBucket(ctx, bucket)
+	})
+	return s3, bucket
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestS3OpenStreams(t *testing.T) {
+	s3, bucket := testS3(t)
+	ctx := context.Background()
+	uri := "s3://" + bucket + "/in/photo.jpg"
+	data := randomBytes(t, 3<<20)
+	if err := WriteAll(ctx, s3, uri, data); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s3.Open(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, ok := r.(*minio.Object); !ok {
+		t.Fatalf("Open returned %T, want a streaming *minio.Object", r)
+	}
+
+	// Read in small chunks, as the zipping-worker's io.Copy does
+	var got bytes.Buffer
+	buf := make([]byte, 32<<10)
+	if _, err := io.CopyBuffer(&got, r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("read %d bytes that differ from the %d written", got.Len(), len(data))
+	}
+}
+
+func TestS3OpenMissing(t *testing.T) {
+	s3, bucket := testS3(t)
+
+	_, err := s3.Open(context.Background(), "s3://"+bucket+"/missing.jpg")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open of a missing key returned %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestS3CreateMultipart(t *testing.T) {
+	s3, bucket := testS3(t)
+	ctx := context.Background()
+	uri := "s3://" + bucket + "/out/archive.zip"
+	// More than two parts of PartSize, written in uneven chunks
+	data := randomBytes(t, 12<<20+123)
+
+	u, err := s3.Create(ctx, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 1<<20+7)
+		if _, err := u.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := u.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s3.client.StatObject(ctx, bucket, "out/archive.zip", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("stored %d bytes, want %d", info.Size, len(data))
+	}
+	if info.ContentType != "application/zip" {
+		t.Errorf("content type %q, want application/zip", info.ContentType)
+	}
+	got, err := ReadAll(ctx, s3, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stored object differs from the data written")
+	}
+}
+
+func TestS3AbortLeavesNoObject(t *testing.T) {
+	s3, bucket := testS3(t)
+	ctx := context.Background()
+
+	u, err := s3.Create(ctx, "s3://"+bucket+"/out/partial.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough for a part to be uploaded before the abort
+	if _, err := u.Write(randomBytes(t, 6<<20)); err != nil {
+		t.Fatal(err)
+	}
+	u.Abort()
+	u.Abort() // no-op
+
+	_, err = s3.client.StatObject(ctx, bucket, "out/partial.zip", minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		t.Fatalf("StatObject after Abort returned %v, want NoSuchKey", err)
+	}
+	for upload := range s3.client.ListIncompleteUploads(ctx, bucket, "out/", true) {
+		if upload.Err != nil {
+			t.Fatal(upload.Err)
+		}
+		t.Errorf("multipart upload %s of %s left behind", upload.UploadID, upload.Key)
+	}
+}
+
+func TestLocalCreateAndAbort(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "processed", "job_thumbnail.webp")
+
+	if err := WriteAll(ctx, Local{}, path, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := Local{}.Create(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	u.Abort()
+
+	got, err := ReadAll(ctx, Local{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first" {
+		t.Errorf("aborted upload replaced the file with %q", got)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("aborted upload left its temp file: %v", err)
+	}
+
+	if _, err := (Local{}).Open(ctx, filepath.Join(dir, "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open of a missing file returned %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestS3CreateNew(t *testing.T) {
+	s3, bucket := testS3(t)
+	ctx := context.Background()
+	uri := "s3://" + bucket + "/in/photo.v2.jpg"
+
+	if err := WriteNew(ctx, s3, uri, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	// Larger than PartSize, so the condition is checked on completion
+	err := WriteNew(ctx, s3, uri, randomBytes(t, 6<<20))
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("second WriteNew returned %v, want fs.ErrExist", err)
+	}
+
+	got, err := ReadAll(ctx, s3, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first" {
+		t.Errorf("WriteNew replaced the object with %d bytes", len(got))
+	}
+}
+
+func TestLocalCreateNew(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photo.v2.jpg")
+
+	if err := WriteNew(ctx, Local{}, path, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteNew(ctx, Local{}, path, []byte("second")); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("second WriteNew returned %v, want fs.ErrExist", err)
+	}
+
+	got, err := ReadAll(ctx, Local{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first" {
+		t.Errorf("WriteNew replaced the file with %q", got)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("WriteNew left %d files in the directory, want 1", len(entries))
+	}
+}
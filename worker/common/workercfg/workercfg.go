@@ -0,0 +1,227 @@
+// Package workercfg holds the configuration the image-worker, the
+// zipping-worker and worker-admin share: the Redis and S3 blocks, their
+// flags and environment variables, and the layered loader that resolves
+// each setting from, in increasing precedence, the flag default, the YAML
+// config file, the environment, and an explicitly passed flag.
+package workercfg
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// RedisConfig is the connection block of the workers' config files.
+type RedisConfig struct {
+	Addr          string `yaml:"addr"`
+	Password      string `yaml:"password"`
+	DB            int    `yaml:"db"`
+	TLS           bool   `yaml:"tls"`
+	TLSSkipVerify bool   `yaml:"tls_skip_verify"`
+	KeyPrefix     string `yaml:"key_prefix"`
+}
+
+// S3Config is the object storage block of the workers' config files.
+// Paths given as s3://bucket/key are read from and written to this
+// endpoint; plain paths stay on the local filesystem.
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	TLS       bool   `yaml:"tls"`
+	PartSize  uint64 `yaml:"part_size"`
+}
+
+// RedisEnv maps each Redis flag to the environment variable overriding it.
+var RedisEnv = map[string]string{
+	"redis":                 "REDIS_ADDR",
+	"redis-password":        "REDIS_PASSWORD",
+	"db":                    "REDIS_DB",
+	"redis-tls":             "REDIS_TLS",
+	"redis-tls-skip-verify": "REDIS_TLS_SKIP_VERIFY",
+	"key-prefix":            "REDIS_KEY_PREFIX",
+}
+
+// S3Env maps each S3 flag to the environment variable overriding it.
+var S3Env = map[string]string{
+	"s3-endpoint":   "S3_ENDPOINT",
+	"s3-region":     "S3_REGION",
+	"s3-access-key": "S3_ACCESS_KEY",
+	"s3-secret-key": "S3_SECRET_KEY",
+	"s3-tls":        "S3_TLS",
+	"s3-part-size":  "S3_PART_SIZE",
+}
+
+// RegisterFlags binds the Redis settings to flags on fs.
+func (c *RedisConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "redis", "localhost:6379", "Redis address")
+	fs.StringVar(&c.Password, "redis-password", "", "Redis password")
+	fs.IntVar(&c.DB, "db", 0, "Redis database")
+	fs.BoolVar(&c.TLS, "redis-tls", false, "Connect to Redis over TLS")
+	fs.BoolVar(&c.TLSSkipVerify, "redis-tls-skip-verify", false, "Skip Redis TLS certificate verification")
+	fs.StringVar(&c.KeyPrefix, "key-prefix", "", "Prefix for every Redis key and channel, e.g. \"staging:\"")
+}
+
+// RegisterFlags binds the S3 settings to flags on fs.
+func (c *S3Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Endpoint, "s3-endpoint", "", "S3-compatible endpoint (host:port) for s3:// inputs and outputs (empty to disable)")
+	fs.StringVar(&c.Region, "s3-region", "", "S3 region")
+	fs.StringVar(&c.AccessKey, "s3-access-key", "", "S3 access key")
+	fs.StringVar(&c.SecretKey, "s3-secret-key", "", "S3 secret key")
+	fs.BoolVar(&c.TLS, "s3-tls", true, "Connect to the S3 endpoint over HTTPS")
+	fs.Uint64Var(&c.PartSize, "s3-part-size", 16<<20, "Multipart upload part size in bytes, buffered in memory per upload")
+}
+
+// Load layers the YAML config file at path, decoded into cfg, and the
+// environment variables in env under the flags explicitly set on the
+// already parsed fs. An empty path skips the file.
+func Load(fs *flag.FlagSet, path string, cfg any, env ...map[string]string) error {
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+	fs.VisitAll(func(f *flag.Flag) { f.Value.Set(f.DefValue) })
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %v", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+	}
+
+	// REDIS_HOST/REDIS_PORT are what the server reads; honour them when no
+	// address is given more specifically.
+	if host := os.Getenv("REDIS_HOST"); host != "" && os.Getenv("REDIS_ADDR") == "" && fs.Lookup("redis") != nil {
+		port := os.Getenv("REDIS_PORT")
+		if port == "" {
+			port = "6379"
+		}
+		fs.Set("redis", net.JoinHostPort(host, port))
+	}
+	for _, vars := range env {
+		for name, key := range vars {
+			value := os.Getenv(key)
+			if value == "" {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid %s: %v", key, err)
+			}
+		}
+	}
+
+	for name, value := range explicit {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid -%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid Redis setting.
+func (c RedisConfig) Validate() []error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("redis address is empty"))
+	}
+	if c.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis db must not be negative, got %d", c.DB))
+	}
+	if c.TLSSkipVerify && !c.TLS {
+		errs = append(errs, errors.New("redis tls_skip_verify requires tls"))
+	}
+	return errs
+}
+
+// Validate reports every invalid S3 setting.
+func (c S3Config) Validate() []error {
+	var errs []error
+	if c.Endpoint != "" && c.PartSize < 5<<20 {
+		errs = append(errs, fmt.Errorf("s3 part_size must be at least 5 MiB, got %d", c.PartSize))
+	}
+	return errs
+}
+
+// ValidateLogging reports an invalid log_level or log_format.
+func ValidateLogging(level, format string) []error {
+	var errs []error
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid log_level %q", level))
+	}
+	if f := strings.ToLower(format); f != "json" && f != "text" {
+		errs = append(errs, fmt.Errorf("invalid log_format %q (want json or text)", format))
+	}
+	return errs
+}
+
+// Redacted returns a copy safe to log or print.
+func (c RedisConfig) Redacted() RedisConfig {
+	if c.Password != "" {
+		c.Password = "REDACTED"
+	}
+	return c
+}
+
+// Redacted returns a copy safe to log or print.
+func (c S3Config) Redacted() S3Config {
+	if c.SecretKey != "" {
+		c.SecretKey = "REDACTED"
+	}
+	return c
+}
+
+// YAML renders cfg in config file format.
+func YAML(cfg any) string {
+	out, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Sprintf("# failed to render config: %v\n", err)
+	}
+	return string(out)
+}
+
+// LogValue logs cfg under its config file keys. Callers pass a redacted
+// copy.
+func LogValue(cfg any) slog.Value {
+	var fields map[string]any
+	if err := yaml.Unmarshal([]byte(YAML(cfg)), &fields); err != nil {
+		return slog.StringValue(err.Error())
+	}
+	return slog.AnyValue(fields)
+}
+
+// Options returns client options with the configured credentials and TLS
+// settings, for callers that tune the pool before connecting.
+func (c RedisConfig) Options() *redis.Options {
+	opts := &redis.Options{
+		Addr:     c.Addr,
+		Password: c.Password,
+		DB:       c.DB,
+	}
+	if c.TLS {
+		opts.TLSConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: c.TLSSkipVerify,
+		}
+	}
+	return opts
+}
+
+// NewRedisClient connects with the configured credentials and TLS settings.
+func NewRedisClient(c RedisConfig) *redis.Client {
+	return redis.NewClient(c.Options())
+}
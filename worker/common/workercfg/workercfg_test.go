@@ -0,0 +1,171 @@
+package workercfg
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	Redis RedisConfig `yaml:"redis"`
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string // "" for no config file
+		env     map[string]string
+		args    []string
+		want    RedisConfig
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			want: RedisConfig{Addr: "localhost:6379"},
+		},
+		{
+			name: "file over defaults",
+			yaml: "redis:\n  addr: file:6379\n  db: 2\n",
+			want: RedisConfig{Addr: "file:6379", DB: 2},
+		},
+		{
+			name: "env over file",
+			yaml: "redis:\n  addr: file:6379\n  db: 2\n",
+			env:  map[string]string{"REDIS_ADDR": "env:6379"},
+			want: RedisConfig{Addr: "env:6379", DB: 2},
+		},
+		{
+			name: "flag over env",
+			yaml: "redis:\n  addr: file:6379\n",
+			env:  map[string]string{"REDIS_ADDR": "env:6379", "REDIS_DB": "3"},
+			args: []string{"-redis", "flag:6379"},
+			want: RedisConfig{Addr: "flag:6379", DB: 3},
+		},
+		{
+			name: "flag set to its default still wins",
+			yaml: "redis:\n  addr: file:6379\n",
+			args: []string{"-redis", "localhost:6379"},
+			want: RedisConfig{Addr: "localhost:6379"},
+		},
+		{
+			name: "server host and port",
+			env:  map[string]string{"REDIS_HOST": "redis", "REDIS_PORT": "6380"},
+			want: RedisConfig{Addr: "redis:6380"},
+		},
+		{
+			name: "server host with the default port",
+			yaml: "redis:\n  addr: file:6379\n",
+			env:  map[string]string{"REDIS_HOST": "redis"},
+			want: RedisConfig{Addr: "redis:6379"},
+		},
+		{
+			name: "REDIS_ADDR over server host",
+			env:  map[string]string{"REDIS_HOST": "redis", "REDIS_ADDR": "env:6379"},
+			want: RedisConfig{Addr: "env:6379"},
+		},
+		{
+			name: "empty file",
+			yaml: "# nothing here\n",
+			want: RedisConfig{Addr: "localhost:6379"},
+		},
+		{
+			name:    "unknown file key",
+			yaml:    "redis:\n  adress: file:6379\n",
+			wantErr: "field adress not found",
+		},
+		{
+			name:    "invalid env value",
+			env:     map[string]string{"REDIS_DB": "two"},
+			wantErr: "invalid REDIS_DB",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range RedisEnv {
+				t.Setenv(key, "")
+			}
+			t.Setenv("REDIS_HOST", "")
+			t.Setenv("REDIS_PORT", "")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			path := ""
+			if tt.yaml != "" {
+				path = filepath.Join(t.TempDir(), "worker.yaml")
+				if err := os.WriteFile(path, []byte(tt.yaml), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var cfg testConfig
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg.Redis.RegisterFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Load(fs, path, &cfg, RedisEnv)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if cfg.Redis != tt.want {
+				t.Errorf("Load = %+v, want %+v", cfg.Redis, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		redis RedisConfig
+		s3    S3Config
+		want  []string
+	}{
+		{"valid", RedisConfig{Addr: "localhost:6379"}, S3Config{}, nil},
+		{"no address", RedisConfig{}, S3Config{}, []string{"redis address is empty"}},
+		{
+			"every redis error",
+			RedisConfig{DB: -1, TLSSkipVerify: true},
+			S3Config{},
+			[]string{"redis address is empty", "redis db must not be negative, got -1", "redis tls_skip_verify requires tls"},
+		},
+		{"s3 disabled ignores part size", RedisConfig{Addr: "r:1"}, S3Config{PartSize: 1}, nil},
+		{"s3 part too small", RedisConfig{Addr: "r:1"}, S3Config{Endpoint: "minio:9000", PartSize: 1 << 20}, []string{"s3 part_size must be at least 5 MiB, got 1048576"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, err := range append(tt.redis.Validate(), tt.s3.Validate()...) {
+				got = append(got, err.Error())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Validate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	redis := RedisConfig{Addr: "r:1", Password: "secret"}.Redacted()
+	s3 := S3Config{AccessKey: "key", SecretKey: "secret"}.Redacted()
+	if redis.Password != "REDACTED" || s3.SecretKey != "REDACTED" || s3.AccessKey != "key" {
+		t.Errorf("Redacted = %+v, %+v", redis, s3)
+	}
+	if got := (RedisConfig{}).Redacted(); got.Password != "" {
+		t.Errorf("Redacted set an unset password to %q", got.Password)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// DefaultBackground is the color transparent images are flattened onto when
+// the output format has no alpha channel.
+const DefaultBackground = "#ffffff"
+
+// ParseBackground parses a background color written as #rgb or #rrggbb.
+func ParseBackground(s string) (color.NRGBA, error) {
+	hex, ok := strings.CutPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if !ok || len(hex) != 6 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q (want #rgb or #rrggbb)", s)
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
+
+// formatHasAlpha reports whether an output format keeps transparency.
+func formatHasAlpha(format string) bool {
+	return format != "jpeg"
+}
+
+// isOpaque reports whether every pixel of img is fully opaque. Decoders
+// return types that answer this cheaply, e.g. always true for JPEGs.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// flatten composites img onto background. Opaque images are returned as is.
+func flatten(img image.Image, background color.NRGBA) image.Image {
+	if isOpaque(img) {
+		return img
+	}
+	b := img.Bounds()
+	return imaging.Overlay(imaging.New(b.Dx(), b.Dy(), background), img, image.Point{}, 1)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// BackfillOptions controls how Backfill enqueues jobs.
+type BackfillOptions struct {
+	Rate      float64 // Jobs enqueued per second, 0 for unlimited
+	DryRun    bool    // Log what would be enqueued without touching Redis
+	StatePath string  // Progress file for resuming, "" to disable
+}
+
+// backfillState is the last original Backfill handled. Originals are walked in
+// name order, so everything up to and including it is skipped on resume.
+type backfillState struct {
+	UserID    string `json:"userId"`
+	File      string `json:"file"`
+	Enqueued  int    `json:"enqueued"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+func loadBackfillState(path string) (*backfillState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &backfillState{}, nil
+		}
+		return nil, err
+	}
+
+	state := &backfillState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid backfill state %s: %v", path, err)
+	}
+	return state, nil
+}
+
+func (s *backfillState) save(path string) error {
+	s.UpdatedAt = time.Now().UnixMilli()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// done reports whether original was handled by an earlier run.
+func (s *backfillState) done(original Original) bool {
+	if original.UserID != s.UserID {
+		return original.UserID < s.UserID
+	}
+	return filepath.Base(original.Path) <= s.File
+}
+
+// MissingOperations returns the default operations whose derivative of
+// original is absent or was built with an outdated profile.
+func MissingOperations(original Original) ([]string, error) {
+	stale, _, err := StaleOperations(original)
+	if err != nil {
+		return nil, err
+	}
+
+	needed := make(map[string]bool, len(stale))
+	for _, op := range stale {
+		needed[op] = true
+	}
+
+	var missing []string
+	for _, op := range DefaultOperations {
+		_, err := os.Stat(DerivativePath(original.ProcessedDir, original.JobID, Operation{Op: op}))
+		if needed[op] || os.IsNotExist(err) {
+			missing = append(missing, op)
+		}
+	}
+	return missing, nil
+}
+
+// Backfill enqueues a bulk priority job for every original under root that is
+// missing derivatives or has outdated ones, such as uploads made while Redis
+// was down. rc is not used in dry-run mode. It returns how many jobs were
+// enqueued, including those of earlier runs resumed from opts.StatePath, or
+// in dry-run mode how many would be.
+func Backfill(ctx context.Context, rc *RedisClient, root string, opts BackfillOptions) (int, error) {
+	logger := componentLogger("backfill")
+
+	state := &backfillState{}
+	if opts.StatePath != "" {
+		var err error
+		if state, err = loadBackfillState(opts.StatePath); err != nil {
+			return 0, err
+		}
+		if state.File != "" {
+			logger.Info("Resuming backfill", "after", filepath.Join(state.UserID, state.File), "enqueued", state.Enqueued)
+		}
+	}
+	if opts.DryRun {
+		state.Enqueued = 0
+	}
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	err := WalkOriginals(root, func(original Original) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if state.done(original) {
+			return nil
+		}
+
+		missing, err := MissingOperations(original)
+		if err != nil {
+			logger.Error("Failed to read manifest", "path", original.Path, logKeyError, err)
+			return nil
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+
+		if opts.DryRun {
+			logger.Info("Would enqueue job", logKeyJobID, original.JobID, logKeyUserID, original.UserID, "operations", missing)
+			state.Enqueued++
+			return nil
+		}
+
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick:
+			}
+		}
+
+		inputPath, _ := filepath.Abs(original.Path)
+		outputDir, _ := filepath.Abs(original.ProcessedDir)
+		job := &Job{
+			Version:    JobVersion,
+			JobID:      original.JobID,
+			UserID:     original.UserID,
+			InputPath:  inputPath,
+			OutputDir:  outputDir,
+			Operations: PresetOperations(missing),
+			Timestamp:  time.Now().UnixMilli(),
+			Priority:   PriorityBulk,
+		}
+		if err := rc.PushToQueue(ctx, job.Queue(), job); err != nil {
+			return err
+		}
+
+		state.UserID = original.UserID
+		state.File = filepath.Base(original.Path)
+		state.Enqueued++
+		logger.Debug("Enqueued job", logKeyJobID, job.JobID, logKeyUserID, job.UserID, "operations", missing)
+
+		if opts.StatePath != "" {
+			if err := state.save(opts.StatePath); err != nil {
+				return fmt.Errorf("failed to save backfill state: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return state.Enqueued, err
+	}
+
+	if opts.StatePath != "" && !opts.DryRun {
+		if err := os.Remove(opts.StatePath); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Failed to remove backfill state", "path", opts.StatePath, logKeyError, err)
+		}
+	}
+	return state.Enqueued, nil
+}
+
+// runBackfill implements the "backfill" subcommand. It takes the worker's
+// config file, environment and flags for Redis and the data dir.
+//
+//	image-worker backfill -data-dir ./server/uploads -rate 50
+//
+// Interrupting it keeps the progress file, and the next run resumes there.
+// It returns the process exit code.
+func runBackfill(args []string) int {
+	fset := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	var cfg Config
+	cfg.RegisterFlags(fset)
+	configPath := fset.String("config", os.Getenv("IMAGE_CONFIG"), "YAML config file (env IMAGE_CONFIG)")
+	rate := fset.Float64("rate", 20, "Jobs enqueued per second (0 = unlimited)")
+	dryRun := fset.Bool("dry-run", false, "Log the jobs that would be enqueued without connecting to Redis")
+	statePath := fset.String("state", "", "Progress file used to resume (default: .backfill-state.json in the data dir)")
+	restart := fset.Bool("restart", false, "Discard saved progress and start from the beginning")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := cfg.LoadConfig(fset, *configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 2
+	}
+	if err := SetupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		return 2
+	}
+	logger := componentLogger("backfill")
+
+	if *statePath == "" {
+		*statePath = filepath.Join(cfg.DataDir, ".backfill-state.json")
+	}
+	if *restart && *dryRun {
+		*statePath = ""
+	} else if *restart {
+		if err := os.Remove(*statePath); err != nil && !os.IsNotExist(err) {
+			logger.Error("Failed to remove backfill state", "path", *statePath, logKeyError, err)
+			return 1
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var rc *RedisClient
+	if !*dryRun {
+		rc = NewRedisClient(cfg.Redis)
+		defer rc.Close()
+
+		if cfg.QueueTransport == QueueTransportStreams {
+			if err := rc.EnableStreams(ctx, cfg.StreamGroup, "backfill", cfg.StreamClaimIdle, QueueNameJobsBulk); err != nil {
+				logger.Error("Failed to enable stream transport", logKeyError, err)
+				return 1
+			}
+		}
+	}
+
+	root := UploadsRoot(cfg.DataDir)
+	logger.Info("Backfilling derivatives", "root", root, "rate", *rate, "dry_run", *dryRun)
+
+	enqueued, err := Backfill(ctx, rc, root, BackfillOptions{
+		Rate:      *rate,
+		DryRun:    *dryRun,
+		StatePath: *statePath,
+	})
+	if err != nil {
+		logger.Error("Backfill stopped, rerun to resume", "enqueued", enqueued, "state", *statePath, logKeyError, err)
+		return 1
+	}
+
+	logger.Info("Backfill complete", "enqueued", enqueued, "dry_run", *dryRun)
+	return 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"worker-common/storage"
+)
+
+func TestBackfillStateDone(t *testing.T) {
+	state := &backfillState{UserID: "user2", File: "b.jpg"}
+
+	tests := []struct {
+		userID string
+		file   string
+		want   bool
+	}{
+		{"user1", "z.jpg", true}, // Earlier user
+		{"user2", "a.jpg", true},
+		{"user2", "b.jpg", true}, // The last one handled
+		{"user2", "c.jpg", false},
+		{"user3", "a.jpg", false},
+	}
+	for _, tt := range tests {
+		original := Original{UserID: tt.userID, Path: filepath.Join("uploads", tt.userID, tt.file)}
+		if got := state.done(original); got != tt.want {
+			t.Errorf("done(%s/%s) = %v, want %v", tt.userID, tt.file, got, tt.want)
+		}
+	}
+
+	if (&backfillState{}).done(Original{UserID: "user1", Path: "uploads/user1/a.jpg"}) {
+		t.Error("a fresh state reports originals as done")
+	}
+}
+
+func TestLoadBackfillState(t *testing.T) {
+	dir := t.TempDir()
+
+	state, err := loadBackfillState(filepath.Join(dir, "missing.json"))
+	if err != nil || *state != (backfillState{}) {
+		t.Errorf("loadBackfillState(missing) = %+v, %v, want an empty state", state, err)
+	}
+
+	path := filepath.Join(dir, "state.json")
+	saved := &backfillState{UserID: "user1", File: "a.jpg", Enqueued: 7}
+	if err := saved.save(path); err != nil {
+		t.Fatal(err)
+	}
+	state, err = loadBackfillState(path)
+	if err != nil || *state != *saved {
+		t.Errorf("loadBackfillState = %+v, %v, want %+v", state, err, saved)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBackfillState(path); err == nil {
+		t.Error("loadBackfillState accepted a truncated file")
+	}
+}
+
+func TestMissingOperations(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []string          // Derivatives present on disk
+		recorded map[string]string // Manifest entries, operation -> version; nil for no manifest
+		want     []string
+	}{
+		{
+			name: "nothing built",
+			want: DefaultOperations,
+		},
+		{
+			name:     "all current",
+			files:    []string{"thumbnail", "blur", "low-quality"},
+			recorded: map[string]string{"thumbnail": "", "blur": "", "low-quality": ""},
+		},
+		{
+			name:     "one missing",
+			files:    []string{"thumbnail", "blur"},
+			recorded: map[string]string{"thumbnail": "", "blur": ""},
+			want:     []string{"low-quality"},
+		},
+		{
+			name:     "outdated profile",
+			files:    []string{"thumbnail", "blur", "low-quality"},
+			recorded: map[string]string{"thumbnail": "", "blur": "0ld0ld00", "low-quality": ""},
+			want:     []string{"blur"},
+		},
+		{
+			name:     "recorded but deleted",
+			files:    []string{"thumbnail", "low-quality"},
+			recorded: map[string]string{"thumbnail": "", "blur": "", "low-quality": ""},
+			want:     []string{"blur"},
+		},
+		{
+			// Derivatives from before manifests have no version to trust
+			name:  "no manifest",
+			files: []string{"thumbnail", "blur", "low-quality"},
+			want:  DefaultOperations,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			original := Original{
+				UserID:       "user1",
+				JobID:        "photo",
+				Path:         filepath.Join(dir, "photo.jpg"),
+				ProcessedDir: filepath.Join(dir, "processed"),
+			}
+			if err := os.MkdirAll(original.ProcessedDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, op := range tt.files {
+				if err := os.WriteFile(DerivativePath(original.ProcessedDir, original.JobID, Operation{Op: op}), []byte("x"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.recorded != nil {
+				manifest := NewManifest(original.JobID, original.Path, "hash")
+				for op, version := range tt.recorded {
+					manifest.Record(op, DerivativePath(original.ProcessedDir, original.JobID, Operation{Op: op}), 1)
+					if version != "" {
+						record := manifest.Derivatives[op]
+						record.Version = version
+						manifest.Derivatives[op] = record
+					}
+				}
+				if err := manifest.Save(context.Background(), storage.Local{}, ManifestPath(original.ProcessedDir, original.JobID)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := MissingOperations(original)
+			if err != nil {
+				t.Fatalf("MissingOperations: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MissingOperations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackfillDryRunResumes(t *testing.T) {
+	root := t.TempDir()
+	for _, path := range []string{"user1/a.jpg", "user1/b.png", "user1/notes.txt", "user2/c.jpg", "temp/d.jpg"} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dry runs never touch Redis
+	n, err := Backfill(context.Background(), nil, root, BackfillOptions{DryRun: true})
+	if err != nil || n != 3 {
+		t.Errorf("Backfill = %d, %v, want 3", n, err)
+	}
+
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	if err := (&backfillState{UserID: "user1", File: "a.jpg", Enqueued: 1}).save(statePath); err != nil {
+		t.Fatal(err)
+	}
+	n, err = Backfill(context.Background(), nil, root, BackfillOptions{DryRun: true, StatePath: statePath})
+	if err != nil || n != 2 {
+		t.Errorf("resumed Backfill = %d, %v, want 2", n, err)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("dry run removed the state file: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	DerivativeCachePrefix = "image:derivatives"
+	DerivativeCacheTTL    = 30 * 24 * time.Hour
+)
+
+// HashContent returns the hex SHA-256 of an input image.
+func HashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func derivativeCacheKey(contentHash string) string {
+	return fmt.Sprintf("%s:%s", DerivativeCachePrefix, contentHash)
+}
+
+// derivativeCacheField keys cache entries by operation and profile version,
+// so derivatives built with outdated parameters are never reused.
+func derivativeCacheField(operation string) string {
+	return fmt.Sprintf("%s@%s", operation, ProfileVersion(operation))
+}
+
+// GetDerivatives returns derivative name -> output path for those of ops
+// already produced from content with this hash under the current profile
+// versions.
+func (rc *RedisClient) GetDerivatives(ctx context.Context, contentHash string, ops []Operation) (map[string]string, error) {
+	fields, err := rc.client.HGetAll(ctx, rc.keys.key(derivativeCacheKey(contentHash))).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read derivative cache: %v", err)
+	}
+
+	derivatives := make(map[string]string)
+	for _, op := range ops {
+		if path, ok := fields[derivativeCacheField(op.Name())]; ok {
+			derivatives[op.Name()] = path
+		}
+	}
+	return derivatives, nil
+}
+
+// RecordDerivative remembers where the derivative name was written.
+func (rc *RedisClient) RecordDerivative(ctx context.Context, contentHash, name, path string) error {
+	key := rc.keys.key(derivativeCacheKey(contentHash))
+
+	pipe := rc.client.TxPipeline()
+	pipe.HSet(ctx, key, derivativeCacheField(name), path)
+	pipe.Expire(ctx, key, DerivativeCacheTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record derivative: %v", err)
+	}
+	return nil
+}
+
+// reuseDerivative makes target hold the cached derivative without
+// re-encoding. It is a no-op when target already is the cached file, and
+// otherwise hardlinks, falling back to a copy across filesystems. It returns
+// the derivative size.
+func reuseDerivative(cached, target string) (int64, error) {
+	cachedInfo, err := os.Stat(cached)
+	if err != nil {
+		return 0, err
+	}
+
+	if targetInfo, err := os.Stat(target); err == nil && os.SameFile(cachedInfo, targetInfo) {
+		return cachedInfo.Size(), nil
+	}
+
+	tmp := target + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Link(cached, tmp); err != nil {
+		if err := copyFile(cached, tmp); err != nil {
+			_ = os.Remove(tmp)
+			return 0, err
+		}
+	}
+
+	if err := os.Rename(tmp, target); err != nil {
+		_ = os.Remove(tmp)
+		return 0, err
+	}
+
+	return cachedInfo.Size(), nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeFileAtomic writes through a temporary file and renames it into place,
+// so a derivative hardlinked into other users' directories is replaced
+// rather than truncated under them.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"worker-common/workercfg"
+)
+
+// Config is the worker's effective configuration, resolved by
+// workercfg.Load.
+type Config struct {
+	Redis workercfg.RedisConfig `yaml:"redis"`
+	S3    workercfg.S3Config    `yaml:"s3"`
+
+	Workers    int    `yaml:"workers"`
+	MaxRetries int    `yaml:"max_retries"`
+	DataDir    string `yaml:"data_dir"`
+
+	Backend          string        `yaml:"backend"`
+	DispatchLanes    int           `yaml:"dispatch_lanes"`
+	DispatchQueue    int           `yaml:"dispatch_queue"`
+	OperationTimeout time.Duration `yaml:"operation_timeout"`
+	Background       string        `yaml:"background"`
+
+	QueueTransport  string        `yaml:"queue_transport"`
+	StreamGroup     string        `yaml:"stream_group"`
+	StreamClaimIdle time.Duration `yaml:"stream_claim_idle"`
+	LaneWeights     string        `yaml:"lane_weights"`
+
+	FairScheduling bool `yaml:"fair_scheduling"`
+	UserBuffer     int  `yaml:"user_buffer"`
+	UserMaxActive  int  `yaml:"user_max_active"`
+
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+
+	DoneMaxLen     int64         `yaml:"done_max_len"`
+	DoneMaxAge     time.Duration `yaml:"done_max_age"`
+	FailedMaxLen   int64         `yaml:"failed_max_len"`
+	FailedMaxAge   time.Duration `yaml:"failed_max_age"`
+	DailyStatsDays int           `yaml:"daily_stats_days"`
+
+	MetricsAddr  string `yaml:"metrics_addr"`
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+	LogLevel     string `yaml:"log_level"`
+	LogFormat    string `yaml:"log_format"`
+}
+
+// configEnv maps each worker-specific flag to the environment variable
+// overriding it. The Redis and S3 variables are workercfg's.
+var configEnv = map[string]string{
+	"workers":     "IMAGE_WORKERS",
+	"max-retries": "IMAGE_MAX_RETRIES",
+	"data-dir":    "IMAGE_DATA_DIR",
+
+	"backend":           "IMAGE_BACKEND",
+	"dispatch-lanes":    "IMAGE_DISPATCH_LANES",
+	"dispatch-queue":    "IMAGE_DISPATCH_QUEUE",
+	"operation-timeout": "IMAGE_OPERATION_TIMEOUT",
+	"background":        "IMAGE_BACKGROUND",
+
+	"queue-transport":   "IMAGE_QUEUE_TRANSPORT",
+	"stream-group":      "IMAGE_STREAM_GROUP",
+	"stream-claim-idle": "IMAGE_STREAM_CLAIM_IDLE",
+	"lane-weights":      "IMAGE_LANE_WEIGHTS",
+
+	"fair-scheduling": "IMAGE_FAIR_SCHEDULING",
+	"user-buffer":     "IMAGE_USER_BUFFER",
+	"user-max-active": "IMAGE_USER_MAX_ACTIVE",
+
+	"shutdown-grace": "IMAGE_SHUTDOWN_GRACE",
+
+	"done-max-len":     "IMAGE_DONE_MAX_LEN",
+	"done-max-age":     "IMAGE_DONE_MAX_AGE",
+	"failed-max-len":   "IMAGE_FAILED_MAX_LEN",
+	"failed-max-age":   "IMAGE_FAILED_MAX_AGE",
+	"daily-stats-days": "IMAGE_DAILY_STATS_DAYS",
+
+	"metrics-addr":  "IMAGE_METRICS_ADDR",
+	"otlp-endpoint": "IMAGE_OTLP_ENDPOINT",
+	"log-level":     "IMAGE_LOG_LEVEL",
+	"log-format":    "IMAGE_LOG_FORMAT",
+}
+
+// RegisterFlags binds every config setting to a flag on fs.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	c.Redis.RegisterFlags(fs)
+	c.S3.RegisterFlags(fs)
+
+	fs.IntVar(&c.Workers, "workers", 5, "Number of CPU worker goroutines")
+	fs.IntVar(&c.MaxRetries, "max-retries", 3, "Maximum retry attempts per job")
+	fs.StringVar(&c.DataDir, "data-dir", "", "Data directory root (default: ../../data relative to executable)")
+
+	fs.StringVar(&c.Backend, "backend", BackendCUDA, "Processing backend: cpu or cuda")
+	fs.IntVar(&c.DispatchLanes, "dispatch-lanes", 0, "Operations the dispatcher executes in parallel (0 = GOMAXPROCS)")
+	fs.IntVar(&c.DispatchQueue, "dispatch-queue", 100, "Operations that may wait for a dispatcher lane")
+	fs.DurationVar(&c.OperationTimeout, "operation-timeout", 30*time.Second, "Maximum time for a single image operation")
+	fs.StringVar(&c.Background, "background", DefaultBackground, "Color transparent images are flattened onto for JPEG output, as #rrggbb")
+
+	fs.StringVar(&c.QueueTransport, "queue-transport", QueueTransportList, "Job intake transport: list or streams")
+	fs.StringVar(&c.StreamGroup, "stream-group", "image-workers", "Consumer group name when -queue-transport=streams")
+	fs.DurationVar(&c.StreamClaimIdle, "stream-claim-idle", 5*time.Minute, "Reclaim stream messages pending longer than this")
+	fs.StringVar(&c.LaneWeights, "lane-weights", DefaultLaneWeights, "Fetch weights per priority lane (high, normal, retry, bulk)")
+
+	fs.BoolVar(&c.FairScheduling, "fair-scheduling", false, "Serve users round-robin instead of in queue order")
+	fs.IntVar(&c.UserBuffer, "user-buffer", 2, "Jobs per user held in memory when -fair-scheduling is set")
+	fs.IntVar(&c.UserMaxActive, "user-max-active", 0, "Maximum concurrent jobs per user when -fair-scheduling is set (0 = unlimited)")
+
+	fs.DurationVar(&c.ShutdownGrace, "shutdown-grace", 30*time.Second, "How long in-flight jobs may run after SIGTERM before they are requeued")
+
+	fs.Int64Var(&c.DoneMaxLen, "done-max-len", 10000, "Completed jobs kept on image:done (0 = unlimited)")
+	fs.DurationVar(&c.DoneMaxAge, "done-max-age", 0, "Drop completed jobs from image:done after this long (0 = keep)")
+	fs.Int64Var(&c.FailedMaxLen, "failed-max-len", 0, "Failed jobs kept on image:failed (0 = unlimited)")
+	fs.DurationVar(&c.FailedMaxAge, "failed-max-age", 0, "Drop failed jobs from image:failed after this long (0 = keep)")
+	fs.IntVar(&c.DailyStatsDays, "daily-stats-days", 0, "Days to keep per-day completed/failed counters (0 = disabled)")
+
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", ":9101", "Address to serve /metrics, /healthz and /readyz on (empty to disable)")
+	fs.StringVar(&c.OTLPEndpoint, "otlp-endpoint", "", "OTLP/HTTP endpoint for traces, e.g. http://localhost:4318 (default: OTEL_EXPORTER_OTLP_ENDPOINT, disabled if unset)")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "Log level: debug, info, warn or error (changeable at runtime via PUT /loglevel)")
+	fs.StringVar(&c.LogFormat, "log-format", "json", "Log format: json or text")
+}
+
+// LoadConfig layers the config file at path and the environment under the
+// flags explicitly set on the already parsed fs, then validates the result.
+func (c *Config) LoadConfig(fs *flag.FlagSet, path string) error {
+	if err := workercfg.Load(fs, path, c, workercfg.RedisEnv, workercfg.S3Env, configEnv); err != nil {
+		return err
+	}
+
+	if c.DataDir == "" {
+		dir, err := defaultDataDir()
+		if err != nil {
+			return err
+		}
+		c.DataDir = dir
+	}
+
+	return c.Validate()
+}
+
+// defaultDataDir is ../../data relative to the executable.
+func defaultDataDir() (string, error) {
+	execPath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to get executable path: %v", err)
+	}
+	dir, err := filepath.Abs(filepath.Join(filepath.Dir(execPath), "..", "..", "data"))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve data directory: %v", err)
+	}
+	return dir, nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	errs := append(c.Redis.Validate(), c.S3.Validate()...)
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Errorf("workers must be at least 1, got %d", c.Workers))
+	}
+	if c.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("max_retries must not be negative, got %d", c.MaxRetries))
+	}
+	if c.Backend != BackendCPU && c.Backend != BackendCUDA {
+		errs = append(errs, fmt.Errorf("unknown backend %q (want %s or %s)", c.Backend, BackendCPU, BackendCUDA))
+	}
+	if c.DispatchLanes < 0 {
+		errs = append(errs, fmt.Errorf("dispatch_lanes must not be negative, got %d", c.DispatchLanes))
+	}
+	if c.DispatchQueue < 1 {
+		errs = append(errs, fmt.Errorf("dispatch_queue must be at least 1, got %d", c.DispatchQueue))
+	}
+	if c.OperationTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("operation_timeout must be positive, got %s", c.OperationTimeout))
+	}
+	if _, err := ParseBackground(c.Background); err != nil {
+		errs = append(errs, fmt.Errorf("background: %v", err))
+	}
+	if info, err := os.Stat(c.DataDir); err != nil {
+		errs = append(errs, fmt.Errorf("data_dir: %v", err))
+	} else if !info.IsDir() {
+		errs = append(errs, fmt.Errorf("data_dir %s is not a directory", c.DataDir))
+	}
+	if c.QueueTransport != QueueTransportList && c.QueueTransport != QueueTransportStreams {
+		errs = append(errs, fmt.Errorf("unknown queue_transport %q (want %s or %s)", c.QueueTransport, QueueTransportList, QueueTransportStreams))
+	}
+	if c.StreamGroup == "" {
+		errs = append(errs, errors.New("stream_group is empty"))
+	}
+	if c.StreamClaimIdle <= 0 {
+		errs = append(errs, fmt.Errorf("stream_claim_idle must be positive, got %s", c.StreamClaimIdle))
+	}
+	if _, err := ParseLanes(c.LaneWeights); err != nil {
+		errs = append(errs, fmt.Errorf("lane_weights: %v", err))
+	}
+	if c.UserBuffer < 1 {
+		errs = append(errs, fmt.Errorf("user_buffer must be at least 1, got %d", c.UserBuffer))
+	}
+	if c.UserMaxActive < 0 {
+		errs = append(errs, fmt.Errorf("user_max_active must not be negative, got %d", c.UserMaxActive))
+	}
+	if c.ShutdownGrace < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_grace must not be negative, got %s", c.ShutdownGrace))
+	}
+	if c.DoneMaxLen < 0 {
+		errs = append(errs, fmt.Errorf("done_max_len must not be negative, got %d", c.DoneMaxLen))
+	}
+	if c.DoneMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("done_max_age must not be negative, got %s", c.DoneMaxAge))
+	}
+	if c.FailedMaxLen < 0 {
+		errs = append(errs, fmt.Errorf("failed_max_len must not be negative, got %d", c.FailedMaxLen))
+	}
+	if c.FailedMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("failed_max_age must not be negative, got %s", c.FailedMaxAge))
+	}
+	if c.DailyStatsDays < 0 {
+		errs = append(errs, fmt.Errorf("daily_stats_days must not be negative, got %d", c.DailyStatsDays))
+	}
+	errs = append(errs, workercfg.ValidateLogging(c.LogLevel, c.LogFormat)...)
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy safe to log or print.
+func (c Config) Redacted() Config {
+	c.Redis = c.Redis.Redacted()
+	c.S3 = c.S3.Redacted()
+	return c
+}
+
+// YAML renders the config in config file format.
+func (c Config) YAML() string {
+	return workercfg.YAML(c)
+}
+
+// LogValue logs the redacted config under its config file keys.
+func (c Config) LogValue() slog.Value {
+	return workercfg.LogValue(c.Redacted())
+}
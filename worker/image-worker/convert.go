@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"worker-common/storage"
+)
+
+// OpConvert labels conversions in the dispatcher's logs and metrics. It is
+// not an operation jobs can request.
+const OpConvert = "convert"
+
+// ConvertStatusTTL bounds how long a conversion's status hash, and with it
+// the download, outlives the job.
+const ConvertStatusTTL = 24 * time.Hour
+
+// convertDefaultQuality encodes lossy conversions without a quality.
+const convertDefaultQuality = 90
+
+// ConvertOptions describe the file a convert job produces:
+//
+//	{"format":"jpeg","quality":85,"maxWidth":2048,"stripMetadata":true}
+type ConvertOptions struct {
+	Format        string `json:"format"`             // jpeg, png or webp
+	Lossless      bool   `json:"lossless,omitempty"` // webp only
+	Quality       int    `json:"quality,omitempty"`  // lossy formats, default 90
+	MaxWidth      int    `json:"maxWidth,omitempty"` // bounds, 0 for unbounded
+	MaxHeight     int    `json:"maxHeight,omitempty"`
+	StripMetadata bool   `json:"stripMetadata,omitempty"`
+
+	// Why the options could not be decoded, reported by Validate.
+	decodeErr error
+}
+
+func (o *ConvertOptions) UnmarshalJSON(data []byte) error {
+	// As for Operation, problems are kept for Validate so the job still decodes
+	type plain ConvertOptions
+	var p plain
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		*o = ConvertOptions{decodeErr: fmt.Errorf("invalid convert options %s: %v", data, err)}
+		return nil
+	}
+	*o = ConvertOptions(p)
+	return nil
+}
+
+func (o ConvertOptions) Validate() error {
+	if o.decodeErr != nil {
+		return o.decodeErr
+	}
+
+	var errs []error
+	if _, ok := outputExtensions[o.Format]; !ok {
+		errs = append(errs, fmt.Errorf("unknown convert format %q (want jpeg, png or webp)", o.Format))
+	}
+	if o.Lossless && o.Format != "webp" {
+		errs = append(errs, errors.New("lossless is only valid for webp"))
+	}
+	if o.Quality != 0 && (o.Format == "png" || o.Lossless) {
+		errs = append(errs, errors.New("quality is only valid for lossy formats"))
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		errs = append(errs, fmt.Errorf("convert quality must be between 0 (default) and 100, got %d", o.Quality))
+	}
+	if o.MaxWidth < 0 || o.MaxWidth > ResizeMaxDimension {
+		errs = append(errs, fmt.Errorf("convert maxWidth must be between 0 (unbounded) and %d, got %d", ResizeMaxDimension, o.MaxWidth))
+	}
+	if o.MaxHeight < 0 || o.MaxHeight > ResizeMaxDimension {
+		errs = append(errs, fmt.Errorf("convert maxHeight must be between 0 (unbounded) and %d, got %d", ResizeMaxDimension, o.MaxHeight))
+	}
+	return errors.Join(errs...)
+}
+
+// ConvertOutputPath is where a convert job writes its file, named like zip
+// archives after the job.
+func ConvertOutputPath(outputDir, jobID, format string) string {
+	return storage.JoinURI(outputDir, jobID+"."+outputExtensions[format])
+}
+
+func convertStatusKey(jobID string) string {
+	return "image:convert:" + jobID
+}
+
+// SetConvertStatus updates the hash a convert job is polled through. It has
+// the fields of zip:job:<jobId>: status (PENDING, PROCESSING, READY or
+// FAILED), progress, message and filePath.
+func (rc *RedisClient) SetConvertStatus(ctx context.Context, jobID string, values ...any) error {
+	key := rc.keys.key(convertStatusKey(jobID))
+	_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, values...)
+		pipe.Expire(ctx, key, ConvertStatusTTL)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %v", key, err)
+	}
+	return nil
+}
+
+// setConvertStatus updates the status hash of a convert job and does nothing
+// for other jobs. A failed update is logged; the queues stay authoritative.
+func (wp *WorkerPool) setConvertStatus(ctx context.Context, job *Job, values ...any) {
+	if job.Type != JobTypeConvert {
+		return
+	}
+	if err := wp.redisClient.SetConvertStatus(ctx, job.JobID, values...); err != nil {
+		componentLogger("convert").Warn("Failed to update status", logKeyJobID, job.JobID, logKeyError, err)
+	}
+}
+
+// processConvert decodes an image upright, fits it into the bounds and
+// encodes it as opts.Format, flattening transparency only for JPEG. Unless stripped, EXIF and ICC metadata of JPEG
+// sources are carried over to JPEG and PNG output.
+func (gd *GPUDispatcher) processConvert(ctx context.Context, imageData []byte, opts ConvertOptions) (*ProcessResult, error) {
+	// Decode image
+	_, decodeSpan := tracer.Start(ctx, "image.decode")
+	img, err := imaging.Decode(bytes.NewReader(imageData), imaging.AutoOrientation(true))
+	decodeSpan.End()
+	if err != nil {
+		return nil, fmt.Errorf("decode failed: %w", err)
+	}
+
+	if opts.MaxWidth > 0 || opts.MaxHeight > 0 {
+		width, height := opts.MaxWidth, opts.MaxHeight
+		if width == 0 {
+			width = img.Bounds().Dx()
+		}
+		if height == 0 {
+			height = img.Bounds().Dy()
+		}
+		img = imaging.Fit(img, width, height, imaging.Lanczos)
+	}
+
+	quality := opts.Quality
+	if quality == 0 {
+		quality = convertDefaultQuality
+	}
+
+	_, encodeSpan := tracer.Start(ctx, "image.encode")
+	var data []byte
+	if opts.Lossless {
+		data, err = encodeWebPLossless(img)
+	} else {
+		data, err = encodeImage(img, opts.Format, quality, gd.background)
+	}
+	if err == nil && !opts.StripMetadata {
+		data = copyMetadata(imageData, data, opts.Format)
+	}
+	encodeSpan.End()
+	if err != nil {
+		return nil, fmt.Errorf("%s encoding failed: %w", opts.Format, err)
+	}
+
+	return &ProcessResult{
+		Data:   data,
+		Format: opts.Format,
+	}, nil
+}
+
+// finishConvert runs the rest of a convert job once its input is read: one
+// conversion through the dispatcher, written to ConvertOutputPath and
+// reported in the status hash.
+func (wp *WorkerPool) finishConvert(ctx, rctx context.Context, logger *slog.Logger, job *Job, input []byte, startTime time.Time) {
+	opts := *job.Convert
+	outputPath := ConvertOutputPath(job.OutputDir, job.JobID, opts.Format)
+
+	result, err := wp.gpuDispatcher.ConvertImage(ctx, input, opts, job.JobID)
+	if err != nil && ctx.Err() != nil {
+		wp.requeueJob(rctx, logger, job)
+		return
+	}
+	if err != nil {
+		logger.Error("Conversion failed", logKeyError, err)
+		_ = wp.retryJob(rctx, job, err)
+		return
+	}
+
+	_, writeSpan := tracer.Start(ctx, "image.write", trace.WithAttributes(
+		attribute.String("file.path", outputPath),
+		attribute.Int("file.size", len(result.Data)),
+	))
+	err = storage.WriteAll(ctx, wp.storage, outputPath, result.Data)
+	writeSpan.End()
+	if err != nil && ctx.Err() != nil {
+		wp.requeueJob(rctx, logger, job)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to write converted file", "path", outputPath, logKeyError, err)
+		_ = wp.retryJob(rctx, job, err)
+		return
+	}
+
+	// The file can be downloaded from here on, whatever happens to the queues
+	wp.setConvertStatus(rctx, job, "status", "READY", "progress", "100", "filePath", outputPath)
+
+	if err := wp.redisClient.MoveToSuccess(rctx, job); err != nil {
+		logger.Error("Failed to mark job as done", logKeyError, err)
+		return
+	}
+
+	jobsTotal.WithLabelValues(job.Kind(), "completed").Inc()
+	logger.Info("Job completed",
+		"path", outputPath,
+		"format", opts.Format,
+		logKeyDurationMS, time.Since(startTime).Milliseconds(),
+		logKeyBytesIn, len(input),
+		logKeyBytesOut, len(result.Data))
+
+	wp.publishEvent(rctx, job, &JobEvent{
+		Type:     EventJobCompleted,
+		Progress: 100,
+		Outputs:  map[string]string{OpConvert: outputPath},
+	})
+}
@@ -182,11 +182,10 @@ void cuda_free(void* ptr) {
 // ============================================================================
 // THUMBNAIL PROCESSING
 // Smallest output: 64px max dimension
-// Returns raw RGB to be encoded as WebP quality 30 in Go
+// Returns raw pixels in the input layout to be encoded as WebP quality 30 in Go
 // ============================================================================
-uint8_t* cuda_process_thumbnail(const uint8_t* input, int input_width, int input_height,
+uint8_t* cuda_process_thumbnail(const uint8_t* input, int input_width, int input_height, int channels,
                                 uint32_t* output_size, int* out_width, int* out_height) {
-    const int channels = 3;
     calculate_dimensions(input_width, input_height, THUMBNAIL_SIZE, out_width, out_height);
 
     size_t input_bytes = input_width * input_height * channels;
@@ -220,11 +219,10 @@ uint8_t* cuda_process_thumbnail(const uint8_t* input, int input_width, int input
 // ============================================================================
 // BLUR PROCESSING
 // Medium-small output: 256px max dimension, Gaussian blur
-// Returns raw RGB to be encoded as WebP quality 50 in Go
+// Returns raw pixels in the input layout to be encoded as WebP quality 50 in Go
 // ============================================================================
-uint8_t* cuda_process_blur(const uint8_t* input, int input_width, int input_height,
+uint8_t* cuda_process_blur(const uint8_t* input, int input_width, int input_height, int channels,
                            uint32_t* output_size, int* out_width, int* out_height) {
-    const int channels = 3;
     calculate_dimensions(input_width, input_height, BLUR_SIZE, out_width, out_height);
 
     size_t input_bytes = input_width * input_height * channels;
@@ -268,11 +266,10 @@ uint8_t* cuda_process_blur(const uint8_t* input, int input_width, int input_heig
 // ============================================================================
 // LOW-QUALITY PROCESSING  
 // Medium output: 512px max dimension
-// Returns raw RGB to be encoded as WebP quality 70 in Go
+// Returns raw pixels in the input layout to be encoded as WebP quality 70 in Go
 // ============================================================================
-uint8_t* cuda_process_low_quality(const uint8_t* input, int input_width, int input_height,
+uint8_t* cuda_process_low_quality(const uint8_t* input, int input_width, int input_height, int channels,
                                   uint32_t* output_size, int* out_width, int* out_height) {
-    const int channels = 3;
     calculate_dimensions(input_width, input_height, LOW_QUALITY_SIZE, out_width, out_height);
 
     size_t input_bytes = input_width * input_height * channels;
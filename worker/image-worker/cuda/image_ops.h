@@ -24,23 +24,24 @@ void cuda_cleanup(void);
 void cuda_free(void* ptr);
 
 // Thumbnail operation: resize to 64px (smallest)
-// Returns raw RGB pixel data to be encoded as WebP with quality 30 in Go
-// input: pointer to decoded RGB pixels
+// Returns raw pixel data to be encoded as WebP with quality 30 in Go
+// input: pointer to decoded pixels
 // input_width, input_height: input dimensions
+// channels: 3 for RGB, 4 for premultiplied RGBA; the output has the same layout
 // output_size: pointer to store output size (set by function)
 // out_width, out_height: pointers to store output dimensions
-// Returns: pointer to RGB pixel data (must be freed with cuda_free)
-uint8_t* cuda_process_thumbnail(const uint8_t* input, int input_width, int input_height, 
+// Returns: pointer to pixel data (must be freed with cuda_free)
+uint8_t* cuda_process_thumbnail(const uint8_t* input, int input_width, int input_height, int channels,
                                 uint32_t* output_size, int* out_width, int* out_height);
 
 // Blur operation: resize to 256px and apply Gaussian blur
-// Returns raw RGB pixel data to be encoded as WebP with quality 50 in Go
-uint8_t* cuda_process_blur(const uint8_t* input, int input_width, int input_height,
+// Returns raw pixel data to be encoded as WebP with quality 50 in Go
+uint8_t* cuda_process_blur(const uint8_t* input, int input_width, int input_height, int channels,
                            uint32_t* output_size, int* out_width, int* out_height);
 
 // Low-quality operation: resize to 512px
-// Returns raw RGB pixel data to be encoded as WebP with quality 70 in Go
-uint8_t* cuda_process_low_quality(const uint8_t* input, int input_width, int input_height,
+// Returns raw pixel data to be encoded as WebP with quality 70 in Go
+uint8_t* cuda_process_low_quality(const uint8_t* input, int input_width, int input_height, int channels,
                                   uint32_t* output_size, int* out_width, int* out_height);
 
 #ifdef __cplusplus
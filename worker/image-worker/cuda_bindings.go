@@ -8,10 +8,18 @@ import "C"
 
 import (
 	"fmt"
+	"sync"
 	"unsafe"
 )
 
+// cudaMu serializes calls into the CUDA context, which is not reentrant.
+// Dispatcher lanes run in parallel and only contend here.
+var cudaMu sync.Mutex
+
 func CudaInit() error {
+	cudaMu.Lock()
+	defer cudaMu.Unlock()
+
 	ret := C.cuda_init()
 	if ret != 0 {
 		return fmt.Errorf("CUDA initialization failed with code %d", ret)
@@ -20,21 +28,29 @@ func CudaInit() error {
 }
 
 func CudaCleanup() {
+	cudaMu.Lock()
+	defer cudaMu.Unlock()
+
 	C.cuda_cleanup()
 }
 
 // CudaProcessThumbnail processes thumbnail with 64px max dimension
-// Returns raw RGB pixels to be encoded as WebP quality 30
-func CudaProcessThumbnail(rgbData []byte, width, height int) ([]byte, int, int, error) {
-	if len(rgbData) == 0 {
+// pixels are laid out as DecodeImage returns them: RGB (channels 3) or
+// premultiplied RGBA (channels 4). The output has the same layout and is
+// encoded with EncodeWebP
+func CudaProcessThumbnail(pixels []byte, width, height, channels int) ([]byte, int, int, error) {
+	if len(pixels) == 0 {
 		return nil, 0, 0, fmt.Errorf("empty input data")
 	}
 
-	inputPtr := (*C.uchar)(unsafe.Pointer(&rgbData[0]))
+	cudaMu.Lock()
+	defer cudaMu.Unlock()
+
+	inputPtr := (*C.uchar)(unsafe.Pointer(&pixels[0]))
 	var outputSize C.uint
 	var outWidth, outHeight C.int
 
-	outputPtr := C.cuda_process_thumbnail(inputPtr, C.int(width), C.int(height),
+	outputPtr := C.cuda_process_thumbnail(inputPtr, C.int(width), C.int(height), C.int(channels),
 		&outputSize, &outWidth, &outHeight)
 	if outputPtr == nil {
 		return nil, 0, 0, fmt.Errorf("CUDA thumbnail processing failed")
@@ -47,17 +63,20 @@ func CudaProcessThumbnail(rgbData []byte, width, height int) ([]byte, int, int,
 }
 
 // CudaProcessBlur processes blur with 256px max dimension
-// Returns raw RGB pixels to be encoded as WebP quality 50
-func CudaProcessBlur(rgbData []byte, width, height int) ([]byte, int, int, error) {
-	if len(rgbData) == 0 {
+// Input and output are laid out as for CudaProcessThumbnail
+func CudaProcessBlur(pixels []byte, width, height, channels int) ([]byte, int, int, error) {
+	if len(pixels) == 0 {
 		return nil, 0, 0, fmt.Errorf("empty input data")
 	}
 
-	inputPtr := (*C.uchar)(unsafe.Pointer(&rgbData[0]))
+	cudaMu.Lock()
+	defer cudaMu.Unlock()
+
+	inputPtr := (*C.uchar)(unsafe.Pointer(&pixels[0]))
 	var outputSize C.uint
 	var outWidth, outHeight C.int
 
-	outputPtr := C.cuda_process_blur(inputPtr, C.int(width), C.int(height),
+	outputPtr := C.cuda_process_blur(inputPtr, C.int(width), C.int(height), C.int(channels),
 		&outputSize, &outWidth, &outHeight)
 	if outputPtr == nil {
 		return nil, 0, 0, fmt.Errorf("CUDA blur processing failed")
@@ -70,17 +89,20 @@ func CudaProcessBlur(rgbData []byte, width, height int) ([]byte, int, int, error
 }
 
 // CudaProcessLowQuality processes low-quality with 512px max dimension
-// Returns raw RGB pixels to be encoded as WebP quality 70
-func CudaProcessLowQuality(rgbData []byte, width, height int) ([]byte, int, int, error) {
-	if len(rgbData) == 0 {
+// Input and output are laid out as for CudaProcessThumbnail
+func CudaProcessLowQuality(pixels []byte, width, height, channels int) ([]byte, int, int, error) {
+	if len(pixels) == 0 {
 		return nil, 0, 0, fmt.Errorf("empty input data")
 	}
 
-	inputPtr := (*C.uchar)(unsafe.Pointer(&rgbData[0]))
+	cudaMu.Lock()
+	defer cudaMu.Unlock()
+
+	inputPtr := (*C.uchar)(unsafe.Pointer(&pixels[0]))
 	var outputSize C.uint
 	var outWidth, outHeight C.int
 
-	outputPtr := C.cuda_process_low_quality(inputPtr, C.int(width), C.int(height),
+	outputPtr := C.cuda_process_low_quality(inputPtr, C.int(width), C.int(height), C.int(channels),
 		&outputSize, &outWidth, &outHeight)
 	if outputPtr == nil {
 		return nil, 0, 0, fmt.Errorf("CUDA low-quality processing failed")
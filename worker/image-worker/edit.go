@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"worker-common/storage"
+)
+
+// Edit is one transform of an edit job. Edits are applied in order to the
+// upright original, i.e. after its EXIF orientation:
+//
+//	{"op":"rotate","angle":90}
+//	{"op":"flip","direction":"horizontal"}
+//	{"op":"crop","x":10,"y":20,"width":640,"height":480}
+//	{"op":"adjust","brightness":10,"contrast":-5,"saturation":20}
+//	{"op":"resize","maxWidth":2048}
+type Edit struct {
+	Op         string  `json:"op"`
+	Angle      int     `json:"angle,omitempty"`     // rotate: 90, 180 or 270 degrees clockwise
+	Direction  string  `json:"direction,omitempty"` // flip: horizontal or vertical
+	X          int     `json:"x,omitempty"`         // crop rectangle in pixels
+	Y          int     `json:"y,omitempty"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	Brightness float64 `json:"brightness,omitempty"` // adjust: -100 to 100 percent
+	Contrast   float64 `json:"contrast,omitempty"`
+	Saturation float64 `json:"saturation,omitempty"`
+	MaxWidth   int     `json:"maxWidth,omitempty"` // resize bounds, as for Operation
+	MaxHeight  int     `json:"maxHeight,omitempty"`
+
+	// Why the edit could not be decoded, reported by Validate.
+	decodeErr error
+}
+
+const (
+	EditRotate = "rotate"
+	EditFlip   = "flip"
+	EditCrop   = "crop"
+	EditAdjust = "adjust"
+	EditResize = "resize"
+)
+
+// OpEdit labels edit jobs in the dispatcher's logs and metrics. It is not an
+// operation jobs can request.
+const OpEdit = "edit"
+
+// editDefaultQuality encodes edited WebP sources, and JPEG sources whose
+// quality cannot be read from their quantization tables.
+const editDefaultQuality = 90
+
+// errInvalidEdit marks edits that can never succeed on this image, such as a
+// crop outside it, so the job is failed instead of retried.
+var errInvalidEdit = errors.New("invalid edit")
+
+func (e *Edit) UnmarshalJSON(data []byte) error {
+	// As for Operation, problems are kept for Validate so the job still decodes
+	type plain Edit
+	var p plain
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		*e = Edit{decodeErr: fmt.Errorf("invalid edit %s: %v", data, err)}
+		return nil
+	}
+	*e = Edit(p)
+	return nil
+}
+
+// Validate checks an edit's parameters. Each edit only takes its own.
+func (e Edit) Validate() error {
+	if e.decodeErr != nil {
+		return e.decodeErr
+	}
+
+	var own Edit
+	var errs []error
+	switch e.Op {
+	case EditRotate:
+		own = Edit{Op: e.Op, Angle: e.Angle}
+		if e.Angle != 90 && e.Angle != 180 && e.Angle != 270 {
+			errs = append(errs, fmt.Errorf("rotate angle must be 90, 180 or 270, got %d", e.Angle))
+		}
+	case EditFlip:
+		own = Edit{Op: e.Op, Direction: e.Direction}
+		if e.Direction != "horizontal" && e.Direction != "vertical" {
+			errs = append(errs, fmt.Errorf("flip direction must be horizontal or vertical, got %q", e.Direction))
+		}
+	case EditCrop:
+		own = Edit{Op: e.Op, X: e.X, Y: e.Y, Width: e.Width, Height: e.Height}
+		if e.X < 0 || e.Y < 0 {
+			errs = append(errs, fmt.Errorf("crop origin must not be negative, got %d,%d", e.X, e.Y))
+		}
+		if e.Width < 1 || e.Height < 1 {
+			errs = append(errs, fmt.Errorf("crop needs a width and height of at least 1, got %dx%d", e.Width, e.Height))
+		}
+	case EditAdjust:
+		own = Edit{Op: e.Op, Brightness: e.Brightness, Contrast: e.Contrast, Saturation: e.Saturation}
+		if e.Brightness == 0 && e.Contrast == 0 && e.Saturation == 0 {
+			errs = append(errs, errors.New("adjust needs brightness, contrast or saturation"))
+		}
+		for _, p := range []struct {
+			name  string
+			value float64
+		}{{"brightness", e.Brightness}, {"contrast", e.Contrast}, {"saturation", e.Saturation}} {
+			if p.value < -100 || p.value > 100 {
+				errs = append(errs, fmt.Errorf("adjust %s must be between -100 and 100, got %g", p.name, p.value))
+			}
+		}
+	case EditResize:
+		own = Edit{Op: e.Op, MaxWidth: e.MaxWidth, MaxHeight: e.MaxHeight}
+		if e.MaxWidth == 0 && e.MaxHeight == 0 {
+			errs = append(errs, errors.New("resize needs maxWidth or maxHeight"))
+		}
+		if e.MaxWidth < 0 || e.MaxWidth > ResizeMaxDimension {
+			errs = append(errs, fmt.Errorf("resize maxWidth must be between 0 (unbounded) and %d, got %d", ResizeMaxDimension, e.MaxWidth))
+		}
+		if e.MaxHeight < 0 || e.MaxHeight > ResizeMaxDimension {
+			errs = append(errs, fmt.Errorf("resize maxHeight must be between 0 (unbounded) and %d, got %d", ResizeMaxDimension, e.MaxHeight))
+		}
+	default:
+		return fmt.Errorf("unknown edit %q (want rotate, flip, crop, adjust or resize)", e.Op)
+	}
+
+	if e != own {
+		errs = append(errs, fmt.Errorf("%s has parameters of another edit", e.Op))
+	}
+	return errors.Join(errs...)
+}
+
+// Apply transforms img. A crop is clipped to the image and fails with
+// errInvalidEdit if nothing of it is left.
+func (e Edit) Apply(img image.Image) (image.Image, error) {
+	switch e.Op {
+	case EditRotate:
+		// imaging rotates counter-clockwise
+		switch e.Angle {
+		case 90:
+			return imaging.Rotate270(img), nil
+		case 180:
+			return imaging.Rotate180(img), nil
+		case 270:
+			return imaging.Rotate90(img), nil
+		}
+	case EditFlip:
+		if e.Direction == "vertical" {
+			return imaging.FlipV(img), nil
+		}
+		return imaging.FlipH(img), nil
+	case EditCrop:
+		b := img.Bounds()
+		rect := image.Rect(e.X, e.Y, e.X+e.Width, e.Y+e.Height).Add(b.Min)
+		if rect.Intersect(b).Empty() {
+			return nil, fmt.Errorf("%w: crop %dx%d+%d+%d is outside the %dx%d image",
+				errInvalidEdit, e.Width, e.Height, e.X, e.Y, b.Dx(), b.Dy())
+		}
+		return imaging.Crop(img, rect), nil
+	case EditAdjust:
+		if e.Brightness != 0 {
+			img = imaging.AdjustBrightness(img, e.Brightness)
+		}
+		if e.Contrast != 0 {
+			img = imaging.AdjustContrast(img, e.Contrast)
+		}
+		if e.Saturation != 0 {
+			img = imaging.AdjustSaturation(img, e.Saturation)
+		}
+		return img, nil
+	case EditResize:
+		width, height := e.MaxWidth, e.MaxHeight
+		if width == 0 {
+			width = img.Bounds().Dx()
+		}
+		if height == 0 {
+			height = img.Bounds().Dy()
+		}
+		return imaging.Fit(img, width, height, imaging.Lanczos), nil
+	}
+	return nil, fmt.Errorf("%w: unknown edit %q", errInvalidEdit, e.Op)
+}
+
+// EditImage decodes an original, applies edits in order and encodes the
+// result in the original's format where possible: JPEG at the source's
+// quality, PNG, and WebP at editDefaultQuality. Other formats become PNG,
+// which keeps their transparency. It returns the encoded image and its
+// format. Workers run it through GPUDispatcher.EditImage.
+func EditImage(data []byte, edits []Edit, background color.NRGBA) ([]byte, string, error) {
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decode failed: %w", err)
+	}
+	// Browsers show photos upright, so edits refer to the oriented image
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, "", fmt.Errorf("decode failed: %w", err)
+	}
+
+	for i, edit := range edits {
+		if img, err = edit.Apply(img); err != nil {
+			return nil, "", fmt.Errorf("edits[%d]: %w", i, err)
+		}
+	}
+
+	quality := editDefaultQuality
+	switch format {
+	case "jpeg":
+		if q, ok := jpegQuality(data); ok {
+			quality = q
+		}
+	case "png", "webp":
+	default:
+		format = "png"
+	}
+
+	out, err := encodeImage(img, format, quality, background)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s encoding failed: %w", format, err)
+	}
+	return out, format, nil
+}
+
+// jpegLuminance is the IJG base luminance quantization table that encoders,
+// including image/jpeg, scale by quality.
+var jpegLuminance = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// jpegQuality estimates the quality a JPEG was encoded at by comparing its
+// luminance quantization table to the IJG base table, inverting the IJG
+// quality scaling. It reports false if the file has no such table.
+func jpegQuality(data []byte) (int, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, false
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 0, false
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // tables precede the scan
+			break
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if length < 2 || i+2+length > len(data) {
+			return 0, false
+		}
+
+		seg := data[i+4 : i+2+length]
+		for marker == 0xDB && len(seg) > 0 {
+			precision, id := seg[0]>>4, seg[0]&0x0F
+			size := 64
+			if precision == 1 {
+				size = 128
+			}
+			if len(seg) < 1+size {
+				return 0, false
+			}
+			if id == 0 {
+				sum, base := 0, 0
+				for k := 0; k < 64; k++ {
+					if precision == 1 {
+						sum += int(seg[1+2*k])<<8 | int(seg[2+2*k])
+					} else {
+						sum += int(seg[1+k])
+					}
+					base += jpegLuminance[k]
+				}
+				scale := float64(sum) * 100 / float64(base)
+				var q float64
+				if scale <= 100 {
+					q = (200 - scale) / 2
+				} else {
+					q = 5000 / scale
+				}
+				return min(max(int(math.Round(q)), 1), 100), true
+			}
+			seg = seg[1+size:]
+		}
+		i += 2 + length
+	}
+	return 0, false
+}
+
+// versionSuffix matches the .vN an edited version adds to its original's name.
+var versionSuffix = regexp.MustCompile(`\.v\d+$`)
+
+const maxVersions = 1000
+
+// writeNextVersion stores data as the first free <name>.vN<ext> next to the
+// original, counting from 2, the original being version 1, and returns its
+// path. Each candidate is created only if it does not exist, so concurrent
+// edits of one file never write the same version. Editing a version numbers
+// the result after the original too.
+func writeNextVersion(ctx context.Context, st storage.Storage, inputPath, ext string, data []byte) (string, error) {
+	dir, name := filepath.Dir(inputPath), filepath.Base(inputPath)
+	if storage.IsS3URI(inputPath) {
+		i := strings.LastIndex(inputPath, "/")
+		dir, name = inputPath[:i], inputPath[i+1:]
+	}
+	base := versionSuffix.ReplaceAllString(strings.TrimSuffix(name, filepath.Ext(name)), "")
+
+	for n := 2; n <= maxVersions; n++ {
+		candidate := storage.JoinURI(dir, fmt.Sprintf("%s.v%d%s", base, n, ext))
+		err := storage.WriteNew(ctx, st, candidate, data)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to write %s: %v", candidate, err)
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("%s already has %d versions", inputPath, maxVersions)
+}
+
+// versionJobID is the job ID derivatives of a version are named after, the
+// file name without extension like the server's job IDs.
+func versionJobID(path string) string {
+	name := path[strings.LastIndex(path, "/")+1:]
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// writeEditedVersion applies an edit job's edits to the original bytes and
+// stores the result as a new version, returning its contents. The path is
+// kept in job.OutputPath, so a retry overwrites the same version instead of
+// adding another.
+func (wp *WorkerPool) writeEditedVersion(ctx context.Context, job *Job, input []byte) ([]byte, error) {
+	editCtx, span := tracer.Start(ctx, "image.edit", trace.WithAttributes(attribute.Int("image.edits", len(job.Edits))))
+	defer span.End()
+
+	result, err := wp.gpuDispatcher.EditImage(editCtx, input, job.Edits, job.JobID)
+	if err == nil {
+		if job.OutputPath == "" {
+			job.OutputPath, err = writeNextVersion(ctx, wp.storage, job.InputPath, "."+outputExtensions[result.Format], result.Data)
+		} else if err = storage.WriteAll(ctx, wp.storage, job.OutputPath, result.Data); err != nil {
+			err = fmt.Errorf("failed to write %s: %v", job.OutputPath, err)
+		}
+	}
+	if err == nil {
+		span.SetAttributes(attribute.String("file.path", job.OutputPath), attribute.Int("file.size", len(result.Data)))
+	}
+	if err != nil {
+		failSpan(editCtx, err)
+		return nil, err
+	}
+	return result.Data, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"worker-common/storage"
+)
+
+func TestEditValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string // Substring of the Validate error, "" for valid
+	}{
+		{"rotate", `{"op":"rotate","angle":90}`, ""},
+		{"rotate 270", `{"op":"rotate","angle":270}`, ""},
+		{"rotate odd angle", `{"op":"rotate","angle":45}`, "angle must be 90, 180 or 270, got 45"},
+		{"flip", `{"op":"flip","direction":"vertical"}`, ""},
+		{"flip diagonal", `{"op":"flip","direction":"diagonal"}`, `direction must be horizontal or vertical, got "diagonal"`},
+		{"crop", `{"op":"crop","x":0,"y":120,"width":1080,"height":1080}`, ""},
+		{"crop negative origin", `{"op":"crop","x":-1,"y":0,"width":10,"height":10}`, "origin must not be negative"},
+		{"crop empty", `{"op":"crop","x":0,"y":0,"width":0,"height":10}`, "width and height of at least 1"},
+		{"adjust", `{"op":"adjust","brightness":-20,"saturation":35.5}`, ""},
+		{"adjust nothing", `{"op":"adjust"}`, "needs brightness, contrast or saturation"},
+		{"adjust out of range", `{"op":"adjust","contrast":101}`, "contrast must be between -100 and 100, got 101"},
+		{"resize", `{"op":"resize","maxWidth":800}`, ""},
+		{"resize without bounds", `{"op":"resize"}`, "needs maxWidth or maxHeight"},
+		{"resize too tall", `{"op":"resize","maxHeight":4097}`, "maxHeight must be between"},
+		{"foreign parameter", `{"op":"rotate","angle":90,"direction":"vertical"}`, "rotate has parameters of another edit"},
+		{"unknown op", `{"op":"sharpen"}`, `unknown edit "sharpen"`},
+		{"unknown field", `{"op":"rotate","angle":90,"degrees":90}`, "unknown field"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e Edit
+			if err := json.Unmarshal([]byte(tt.json), &e); err != nil {
+				t.Fatalf("Unmarshal(%s): %v", tt.json, err)
+			}
+
+			err := e.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// editSource is a 4x2 image whose top-left pixel is red and every other
+// pixel black, so rotations and flips can be told apart by where red ends up.
+func editSource() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	img.SetNRGBA(0, 0, color.NRGBA{R: 0xff, A: 0xff})
+	return img
+}
+
+func TestEditApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		edit   Edit
+		width  int
+		height int
+		red    image.Point // Where the red pixel ends up
+	}{
+		{"rotate 90 clockwise", Edit{Op: EditRotate, Angle: 90}, 2, 4, image.Pt(1, 0)},
+		{"rotate 180", Edit{Op: EditRotate, Angle: 180}, 4, 2, image.Pt(3, 1)},
+		{"rotate 270 clockwise", Edit{Op: EditRotate, Angle: 270}, 2, 4, image.Pt(0, 3)},
+		{"flip horizontal", Edit{Op: EditFlip, Direction: "horizontal"}, 4, 2, image.Pt(3, 0)},
+		{"flip vertical", Edit{Op: EditFlip, Direction: "vertical"}, 4, 2, image.Pt(0, 1)},
+		{"crop", Edit{Op: EditCrop, X: 0, Y: 0, Width: 2, Height: 1}, 2, 1, image.Pt(0, 0)},
+		{"crop clipped to the image", Edit{Op: EditCrop, X: 0, Y: 0, Width: 100, Height: 100}, 4, 2, image.Pt(0, 0)},
+		{"resize never upscales", Edit{Op: EditResize, MaxWidth: 400}, 4, 2, image.Pt(0, 0)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := tt.edit.Apply(editSource())
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			b := out.Bounds()
+			if b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("got %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			if r, _, _, _ := out.At(b.Min.X+tt.red.X, b.Min.Y+tt.red.Y).RGBA(); r>>8 != 0xff {
+				t.Errorf("red pixel not at %v", tt.red)
+			}
+		})
+	}
+}
+
+func TestEditApplyCropOutside(t *testing.T) {
+	_, err := Edit{Op: EditCrop, X: 10, Y: 0, Width: 5, Height: 5}.Apply(editSource())
+	if !errors.Is(err, errInvalidEdit) {
+		t.Errorf("Apply = %v, want errInvalidEdit", err)
+	}
+}
+
+func TestJPEGQuality(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	// Below 25 the scaled tables clip at 255 and the estimate comes out high
+	for _, quality := range []int{25, 50, 75, 90, 100} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := jpegQuality(buf.Bytes())
+		if !ok || got < quality-1 || got > quality+1 {
+			t.Errorf("jpegQuality of a q%d JPEG = %d, %v", quality, got, ok)
+		}
+	}
+
+	if _, ok := jpegQuality([]byte("not a jpeg")); ok {
+		t.Error("jpegQuality reported a quality for non-JPEG data")
+	}
+}
+
+func TestWriteNextVersion(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "abc-photo.jpg")
+	if err := os.WriteFile(original, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		input string
+		ext   string
+		want  string
+	}{
+		{original, ".jpg", "abc-photo.v2.jpg"},
+		{original, ".jpg", "abc-photo.v3.jpg"},
+		// Versions of a version are numbered after the original
+		{filepath.Join(dir, "abc-photo.v2.jpg"), ".jpg", "abc-photo.v4.jpg"},
+		// Other extensions number on their own
+		{original, ".png", "abc-photo.v2.png"},
+	}
+
+	for _, tt := range tests {
+		got, err := writeNextVersion(context.Background(), storage.Local{}, tt.input, tt.ext, []byte("edited"))
+		if err != nil {
+			t.Fatalf("writeNextVersion(%s): %v", tt.input, err)
+		}
+		if got != filepath.Join(dir, tt.want) {
+			t.Errorf("writeNextVersion(%s) = %s, want %s", tt.input, got, tt.want)
+		}
+		if versionJobID(got) != strings.TrimSuffix(tt.want, tt.ext) {
+			t.Errorf("versionJobID(%s) = %s", got, versionJobID(got))
+		}
+	}
+}
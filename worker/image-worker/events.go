@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	EventChannel = "image:events"
+
+	EventJobStarted   = "job.started"
+	EventJobProgress  = "job.progress"
+	EventJobCompleted = "job.completed"
+	EventJobRetrying  = "job.retrying" // An attempt failed; the job was requeued
+	EventJobFailed    = "job.failed"   // Terminal: the job is on image:failed
+)
+
+// JobEvent is published on EventChannel as a job moves through the worker so
+// the server can push live updates instead of polling for derivatives.
+type JobEvent struct {
+	Type      string            `json:"type"`
+	JobID     string            `json:"jobId"`
+	UserID    string            `json:"userId,omitempty"`
+	Operation string            `json:"operation,omitempty"`
+	Progress  int               `json:"progress"`
+	Outputs   map[string]string `json:"outputs,omitempty"`
+	Versions  map[string]string `json:"versions,omitempty"`
+	Edited    string            `json:"edited,omitempty"` // New version written by an edit job
+	Error     string            `json:"error,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+func (rc *RedisClient) PublishEvent(ctx context.Context, event *JobEvent) error {
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().UnixMilli()
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	channel := rc.keys.key(EventChannel)
+	if err := rc.client.Publish(ctx, channel, string(eventJSON)).Err(); err != nil {
+		return fmt.Errorf("failed to publish to %s: %v", channel, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// FairScheduler sits between Redis and the workers when per-user fairness is
+// enabled. A single fetch loop keeps a bounded number of jobs buffered in
+// memory, grouped by owner, and workers take them round-robin across users.
+// A user never holds more than perUserBuffer buffered jobs: further jobs of
+// that user are pushed to the back of their queue so other users' jobs can
+// surface. perUserCap optionally limits how many jobs of one user run at
+// once (0 means unlimited).
+type FairScheduler struct {
+	redisClient   *RedisClient
+	lanes         []Lane
+	capacity      int
+	perUserBuffer int
+	perUserCap    int
+	logger        *slog.Logger
+
+	mu        sync.Mutex
+	pending   map[string][]*Job
+	ring      []string
+	next      int
+	inFlight  map[string]int
+	buffered  int
+	completed uint64
+	changed   chan struct{}
+}
+
+func NewFairScheduler(rc *RedisClient, lanes []Lane, capacity, perUserBuffer, perUserCap int) *FairScheduler {
+	return &FairScheduler{
+		redisClient:   rc,
+		lanes:         lanes,
+		capacity:      capacity,
+		perUserBuffer: perUserBuffer,
+		perUserCap:    perUserCap,
+		pending:       make(map[string][]*Job),
+		inFlight:      make(map[string]int),
+		changed:       make(chan struct{}),
+		logger:        componentLogger("fair"),
+	}
+}
+
+// Run fetches jobs into the buffer until ctx is cancelled, then hands every
+// job still buffered back to Redis.
+func (fs *FairScheduler) Run(ctx context.Context) {
+	scheduler := newLaneScheduler(fs.lanes)
+	deferred := 0
+
+	for fs.waitFor(ctx, 0, fs.hasRoomLocked) {
+		job, err := fs.redisClient.FetchJob(ctx, scheduler.Next()...)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if !errors.Is(err, ErrFetchTimeout) {
+				fs.logger.Error("Error fetching job", logKeyError, err)
+				time.Sleep(1 * time.Second)
+			}
+			continue
+		}
+
+		if fs.add(job, false) {
+			deferred = 0
+			continue
+		}
+
+		if err := fs.redisClient.PushToQueue(ctx, job.Queue(), job); err != nil {
+			fs.logger.Warn("Failed to defer job, keeping it", logKeyJobID, job.JobID, logKeyUserID, job.Owner(), logKeyError, err)
+			fs.add(job, true)
+			continue
+		}
+
+		// A full buffer's worth of deferrals means only users over their share
+		// are waiting; stop cycling their jobs through Redis until a worker
+		// makes progress.
+		deferred++
+		if deferred >= fs.capacity {
+			fs.mu.Lock()
+			completed := fs.completed
+			fs.mu.Unlock()
+
+			fs.waitFor(ctx, time.Second, func() bool { return fs.completed != completed })
+			deferred = 0
+		}
+	}
+
+	fs.requeueBuffered()
+}
+
+// Next blocks until a buffered job is available for a user below the
+// concurrency cap. Callers must report completion with Done.
+func (fs *FairScheduler) Next(ctx context.Context) (*Job, error) {
+	var job *Job
+	ok := fs.waitFor(ctx, 0, func() bool {
+		job = fs.takeLocked()
+		return job != nil
+	})
+	if !ok {
+		return nil, ctx.Err()
+	}
+	return job, nil
+}
+
+func (fs *FairScheduler) Done(job *Job) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	owner := job.Owner()
+	fs.inFlight[owner]--
+	if fs.inFlight[owner] <= 0 {
+		delete(fs.inFlight, owner)
+	}
+	fs.completed++
+	fs.notifyLocked()
+}
+
+// add buffers job unless its owner already has perUserBuffer jobs waiting
+// and force is false.
+func (fs *FairScheduler) add(job *Job, force bool) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	owner := job.Owner()
+	queue, known := fs.pending[owner]
+	if !force && len(queue) >= fs.perUserBuffer {
+		return false
+	}
+
+	if !known {
+		fs.ring = append(fs.ring, owner)
+	}
+	fs.pending[owner] = append(queue, job)
+	fs.buffered++
+	fs.notifyLocked()
+	return true
+}
+
+// takeLocked pops the next job in round-robin order, skipping users at their
+// concurrency cap.
+func (fs *FairScheduler) takeLocked() *Job {
+	for i := 0; i < len(fs.ring); i++ {
+		idx := (fs.next + i) % len(fs.ring)
+		owner := fs.ring[idx]
+		if fs.perUserCap > 0 && fs.inFlight[owner] >= fs.perUserCap {
+			continue
+		}
+
+		queue := fs.pending[owner]
+		job := queue[0]
+		if len(queue) == 1 {
+			delete(fs.pending, owner)
+			fs.ring = append(fs.ring[:idx], fs.ring[idx+1:]...)
+			fs.next = idx
+		} else {
+			fs.pending[owner] = queue[1:]
+			fs.next = idx + 1
+		}
+		if len(fs.ring) > 0 {
+			fs.next %= len(fs.ring)
+		} else {
+			fs.next = 0
+		}
+
+		fs.inFlight[owner]++
+		fs.buffered--
+		fs.notifyLocked()
+		return job
+	}
+
+	return nil
+}
+
+func (fs *FairScheduler) hasRoomLocked() bool {
+	return fs.buffered < fs.capacity
+}
+
+// waitFor blocks until cond, evaluated under fs.mu, returns true. It gives up
+// when ctx is cancelled or, if timeout is non-zero, after timeout. It reports
+// whether cond was satisfied.
+func (fs *FairScheduler) waitFor(ctx context.Context, timeout time.Duration, cond func() bool) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		fs.mu.Lock()
+		if cond() {
+			fs.mu.Unlock()
+			return true
+		}
+		changed := fs.changed
+		fs.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-expired:
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// notifyLocked wakes every goroutine blocked in waitFor.
+func (fs *FairScheduler) notifyLocked() {
+	close(fs.changed)
+	fs.changed = make(chan struct{})
+}
+
+func (fs *FairScheduler) requeueBuffered() {
+	fs.mu.Lock()
+	pending := fs.pending
+	fs.pending = make(map[string][]*Job)
+	fs.ring = nil
+	fs.buffered = 0
+	fs.mu.Unlock()
+
+	// The fetch context is already cancelled at this point
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	requeued := 0
+	for _, jobs := range pending {
+		for _, job := range jobs {
+			if err := fs.redisClient.PushToQueue(ctx, job.Queue(), job); err != nil {
+				fs.logger.Error("Failed to requeue buffered job", logKeyJobID, job.JobID, logKeyError, err)
+				continue
+			}
+			requeued++
+		}
+	}
+
+	if requeued > 0 {
+		fs.logger.Info("Returned buffered jobs to Redis", "count", requeued)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func fairJob(owner, id string) *Job {
+	return &Job{JobID: id, UserID: owner}
+}
+
+// takeAll drains every job the scheduler will hand out right now.
+func takeAll(fs *FairScheduler) []string {
+	var ids []string
+	for {
+		fs.mu.Lock()
+		job := fs.takeLocked()
+		fs.mu.Unlock()
+		if job == nil {
+			return ids
+		}
+		ids = append(ids, job.JobID)
+	}
+}
+
+func TestFairSchedulerOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		perUserCap int
+		jobs       [][2]string // Owner and job ID, in arrival order
+		want       []string
+	}{
+		{
+			name: "round-robin across users",
+			jobs: [][2]string{{"alice", "a1"}, {"alice", "a2"}, {"alice", "a3"}, {"bob", "b1"}, {"carol", "c1"}, {"bob", "b2"}},
+			want: []string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+		{
+			name: "single user keeps arrival order",
+			jobs: [][2]string{{"alice", "a1"}, {"alice", "a2"}, {"alice", "a3"}},
+			want: []string{"a1", "a2", "a3"},
+		},
+		{
+			name:       "cap holds back a busy user",
+			perUserCap: 1,
+			jobs:       [][2]string{{"alice", "a1"}, {"alice", "a2"}, {"bob", "b1"}},
+			want:       []string{"a1", "b1"},
+		},
+		{
+			name: "ownerless jobs share one turn",
+			jobs: [][2]string{{"", "x1"}, {"", "x2"}, {"bob", "b1"}},
+			want: []string{"x1", "b1", "x2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := NewFairScheduler(nil, nil, 16, 16, tt.perUserCap)
+			for _, j := range tt.jobs {
+				if !fs.add(fairJob(j[0], j[1]), false) {
+					t.Fatalf("add(%s) refused", j[1])
+				}
+			}
+
+			if got := takeAll(fs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("took %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFairSchedulerPerUserBuffer(t *testing.T) {
+	fs := NewFairScheduler(nil, nil, 16, 2, 0)
+
+	tests := []struct {
+		job   *Job
+		force bool
+		want  bool
+	}{
+		{fairJob("alice", "a1"), false, true},
+		{fairJob("alice", "a2"), false, true},
+		{fairJob("alice", "a3"), false, false}, // Over alice's share
+		{fairJob("bob", "b1"), false, true},
+		{fairJob("alice", "a3"), true, true}, // Forced back after a failed defer
+	}
+	for _, tt := range tests {
+		if got := fs.add(tt.job, tt.force); got != tt.want {
+			t.Errorf("add(%s, force=%v) = %v, want %v", tt.job.JobID, tt.force, got, tt.want)
+		}
+	}
+
+	if fs.buffered != 4 {
+		t.Errorf("buffered = %d, want 4", fs.buffered)
+	}
+	if !fs.hasRoomLocked() {
+		t.Error("hasRoomLocked = false with 4 of 16 buffered")
+	}
+}
+
+func TestFairSchedulerCapReleasedByDone(t *testing.T) {
+	fs := NewFairScheduler(nil, nil, 16, 16, 1)
+	fs.add(fairJob("alice", "a1"), false)
+	fs.add(fairJob("alice", "a2"), false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	first, err := fs.Next(ctx)
+	if err != nil || first.JobID != "a1" {
+		t.Fatalf("Next = %v, %v, want a1", first, err)
+	}
+
+	// a2 waits for a1 to finish
+	done := make(chan *Job)
+	go func() {
+		job, _ := fs.Next(ctx)
+		done <- job
+	}()
+	select {
+	case job := <-done:
+		t.Fatalf("Next returned %v while alice was at the cap", job)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fs.Done(first)
+	if job := <-done; job == nil || job.JobID != "a2" {
+		t.Errorf("Next after Done = %v, want a2", job)
+	}
+}
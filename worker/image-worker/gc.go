@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// GCOptions controls what CollectGarbage removes.
+type GCOptions struct {
+	Grace   time.Duration // Only files last modified longer ago are removed
+	DryRun  bool          // Log what would be removed without deleting
+	LiveSet string        // Redis set of live job IDs, "" to check originals on disk
+}
+
+// GCResult counts what CollectGarbage removed, or would have in dry-run mode.
+type GCResult struct {
+	Files int
+	Bytes int64
+}
+
+// derivativeJobID returns the job a file in a processed/ folder belongs to.
+// tmp is set for leftovers of an interrupted writeFileAtomic.
+func derivativeJobID(name string) (jobID string, tmp, ok bool) {
+	if base, found := strings.CutSuffix(name, ".tmp"); found {
+		name, tmp = base, true
+	}
+	if jobID, found := strings.CutSuffix(name, "_manifest.json"); found {
+		return jobID, tmp, true
+	}
+	if jobID, _, found := parseDerivativeName(name); found {
+		return jobID, tmp, true
+	}
+	return "", false, false
+}
+
+// conversionJobID returns the convert job a file in the temp dir belongs to.
+// tmp is set for partial output a worker left behind before renaming it into
+// place.
+func conversionJobID(name string) (jobID string, tmp, ok bool) {
+	if base, found := strings.CutSuffix(name, ".tmp"); found {
+		name, tmp = base, true
+	}
+	ext := filepath.Ext(name)
+	if ext != ".jpg" && ext != ".png" && ext != ".webp" {
+		return "", false, false
+	}
+	if jobID = strings.TrimSuffix(name, ext); jobID == "" {
+		return "", false, false
+	}
+	return jobID, tmp, true
+}
+
+// userOriginals returns the job IDs of the files uploaded to userDir.
+func userOriginals(userDir string) (map[string]bool, error) {
+	entries, err := os.ReadDir(userDir)
+	if err != nil {
+		return nil, err
+	}
+
+	jobIDs := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			jobIDs[strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))] = true
+		}
+	}
+	return jobIDs, nil
+}
+
+// liveJobIDs loads the members of the Redis set listing live job IDs.
+func (rc *RedisClient) liveJobIDs(ctx context.Context, set string) (map[string]bool, error) {
+	members, err := rc.client.SMembers(ctx, rc.keys.key(set)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read live set %s: %v", set, err)
+	}
+
+	jobIDs := make(map[string]bool, len(members))
+	for _, member := range members {
+		jobIDs[member] = true
+	}
+	return jobIDs, nil
+}
+
+// CollectGarbage removes derivatives and manifests under root/<userId>/processed/
+// whose original is gone, e.g. after the file was deleted or the trash
+// emptied, along with leftover temporary files. Liveness comes from the
+// originals on disk, or from opts.LiveSet when given. rc is only used for the
+// live set.
+func CollectGarbage(ctx context.Context, rc *RedisClient, root string, opts GCOptions) (GCResult, error) {
+	logger := componentLogger("gc")
+	var result GCResult
+
+	var live map[string]bool
+	if opts.LiveSet != "" {
+		var err error
+		if live, err = rc.liveJobIDs(ctx, opts.LiveSet); err != nil {
+			return result, err
+		}
+		// An empty or missing set would make every derivative an orphan
+		if len(live) == 0 {
+			return result, fmt.Errorf("live set %s is empty", opts.LiveSet)
+		}
+	}
+
+	users, err := os.ReadDir(root)
+	if err != nil {
+		return result, err
+	}
+
+	cutoff := time.Now().Add(-opts.Grace)
+	for _, user := range users {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if !user.IsDir() || user.Name() == "temp" {
+			continue
+		}
+
+		userDir := filepath.Join(root, user.Name())
+		processedDir := filepath.Join(userDir, "processed")
+		entries, err := os.ReadDir(processedDir)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Warn("Skipping processed directory", "dir", processedDir, logKeyError, err)
+			}
+			continue
+		}
+
+		originals := live
+		if originals == nil {
+			if originals, err = userOriginals(userDir); err != nil {
+				logger.Warn("Skipping user directory", "dir", userDir, logKeyError, err)
+				continue
+			}
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			jobID, tmp, ok := derivativeJobID(entry.Name())
+			if !ok || (originals[jobID] && !tmp) {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+
+			path := filepath.Join(processedDir, entry.Name())
+			if !opts.DryRun {
+				if err := os.Remove(path); err != nil {
+					logger.Error("Failed to remove orphan", "path", path, logKeyError, err)
+					continue
+				}
+			}
+
+			result.Files++
+			result.Bytes += info.Size()
+			logger.Debug("Removed orphan", logKeyJobID, jobID, logKeyUserID, user.Name(), "path", path, "size", info.Size(), "dry_run", opts.DryRun)
+		}
+	}
+
+	return result, nil
+}
+
+// CollectConversions removes files convert jobs wrote to tempDir once they
+// can no longer be downloaded: their status hash has expired or the job
+// failed. Files of pending, running and ready jobs are kept, as is everything
+// else in tempDir, such as zip archives and upload chunks. Partial output is
+// removed once older than the grace period whatever its job's status.
+func CollectConversions(ctx context.Context, rc *RedisClient, tempDir string, opts GCOptions) (GCResult, error) {
+	logger := componentLogger("gc")
+	var result GCResult
+
+	entries, err := os.ReadDir(tempDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	cutoff := time.Now().Add(-opts.Grace)
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if entry.IsDir() {
+			continue
+		}
+		jobID, tmp, ok := conversionJobID(entry.Name())
+		if !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if !tmp {
+			status, err := rc.client.HGet(ctx, rc.keys.key(convertStatusKey(jobID)), "status").Result()
+			if err != nil && err != redis.Nil {
+				return result, fmt.Errorf("failed to read status of %s: %v", jobID, err)
+			}
+			if err == nil && status != "FAILED" {
+				continue
+			}
+		}
+
+		path := filepath.Join(tempDir, entry.Name())
+		if !opts.DryRun {
+			if err := os.Remove(path); err != nil {
+				logger.Error("Failed to remove expired conversion", "path", path, logKeyError, err)
+				continue
+			}
+		}
+
+		result.Files++
+		result.Bytes += info.Size()
+		logger.Debug("Removed expired conversion", logKeyJobID, jobID, "path", path, "size", info.Size(), "dry_run", opts.DryRun)
+	}
+
+	return result, nil
+}
+
+// runGC implements the "gc" subcommand. It takes the worker's config file,
+// environment and flags for Redis and the data dir. Besides orphaned
+// derivatives it removes expired convert job output from <data-dir>/temp,
+// which needs Redis.
+//
+//	image-worker gc -data-dir ./server/uploads -grace 24h -dry-run
+//
+// It returns the process exit code.
+func runGC(args []string) int {
+	fset := flag.NewFlagSet("gc", flag.ContinueOnError)
+	var cfg Config
+	cfg.RegisterFlags(fset)
+	configPath := fset.String("config", os.Getenv("IMAGE_CONFIG"), "YAML config file (env IMAGE_CONFIG)")
+	grace := fset.Duration("grace", 24*time.Hour, "Only remove orphans last modified longer ago than this")
+	dryRun := fset.Bool("dry-run", false, "Report what would be removed without deleting anything")
+	liveSet := fset.String("live-set", "", "Redis set of live job IDs to check derivatives against (default: the originals on disk)")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := cfg.LoadConfig(fset, *configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 2
+	}
+	if err := SetupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		return 2
+	}
+	logger := componentLogger("gc")
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	rc := NewRedisClient(cfg.Redis)
+	defer rc.Close()
+
+	root := UploadsRoot(cfg.DataDir)
+	logger.Info("Collecting orphaned derivatives", "root", root, "grace", grace.String(), "live_set", *liveSet, "dry_run", *dryRun)
+
+	result, err := CollectGarbage(ctx, rc, root, GCOptions{
+		Grace:   *grace,
+		DryRun:  *dryRun,
+		LiveSet: *liveSet,
+	})
+	if err != nil {
+		logger.Error("Garbage collection stopped", "files", result.Files, "bytes", result.Bytes, logKeyError, err)
+		return 1
+	}
+
+	tempDir := filepath.Join(root, "temp")
+	conversions, err := CollectConversions(ctx, rc, tempDir, GCOptions{Grace: *grace, DryRun: *dryRun})
+	if err != nil {
+		logger.Error("Conversion cleanup stopped", "dir", tempDir, "files", result.Files+conversions.Files, "bytes", result.Bytes+conversions.Bytes, logKeyError, err)
+		return 1
+	}
+
+	logger.Info("Garbage collection complete",
+		"files", result.Files,
+		"bytes", result.Bytes,
+		"conversion_files", conversions.Files,
+		"conversion_bytes", conversions.Bytes,
+		"dry_run", *dryRun)
+	return 0
+}
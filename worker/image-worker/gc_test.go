@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDerivativeJobID(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobID string
+		tmp   bool
+		ok    bool
+	}{
+		{"abc-photo_thumbnail.webp", "abc-photo", false, true},
+		{"abc-photo_low-quality.webp", "abc-photo", false, true},
+		{"abc-photo_resize-1024x0-webp-q80.webp", "abc-photo", false, true},
+		{"abc_photo_blur.webp", "abc_photo", false, true},
+		{"abc-photo_manifest.json", "abc-photo", false, true},
+		{"abc-photo_thumbnail.webp.tmp", "abc-photo", true, true},
+		{"abc-photo_manifest.json.tmp", "abc-photo", true, true},
+		{"abc-photo_thumbnail.png", "", false, false}, // Wrong extension for the operation
+		{"abc-photo_sharpen.webp", "", false, false},
+		{"_thumbnail.webp", "", false, false},
+		{"abc-photo.webp", "", false, false},
+		{"notes.txt.tmp", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobID, tmp, ok := derivativeJobID(tt.name)
+			if jobID != tt.jobID || tmp != tt.tmp || ok != tt.ok {
+				t.Errorf("derivativeJobID(%q) = %q, %v, %v, want %q, %v, %v", tt.name, jobID, tmp, ok, tt.jobID, tt.tmp, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCollectGarbageOrphans(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+
+	files := []struct {
+		path    string
+		stale   bool
+		removed bool
+	}{
+		{"user1/kept.jpg", true, false},
+		{"user1/processed/kept_thumbnail.webp", true, false},
+		{"user1/processed/kept_manifest.json", true, false},
+		{"user1/processed/kept_blur.webp.tmp", true, true}, // Interrupted write
+		{"user1/processed/kept_blur.webp", false, false},
+		{"user1/processed/gone_thumbnail.webp", true, true},
+		{"user1/processed/gone_manifest.json", true, true},
+		{"user1/processed/recent_thumbnail.webp", false, false}, // Within the grace period
+		{"user1/processed/notes.txt", true, false},
+		// Originals only count for their own user
+		{"user2/processed/kept_thumbnail.webp", true, true},
+		{"temp/processed/gone_thumbnail.webp", true, false},
+	}
+	for _, f := range files {
+		path := filepath.Join(root, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if f.stale {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Without a live set liveness comes from disk, so no Redis client
+	result, err := CollectGarbage(context.Background(), nil, root, GCOptions{Grace: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+
+	removed := 0
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(root, f.path))
+		gone := errors.Is(err, os.ErrNotExist)
+		if gone != f.removed {
+			t.Errorf("%s: removed = %v, want %v", f.path, gone, f.removed)
+		}
+		if f.removed {
+			removed++
+		}
+	}
+	if result.Files != removed || result.Bytes != int64(removed*len("data")) {
+		t.Errorf("CollectGarbage = %+v, want %d files, %d bytes", result, removed, removed*len("data"))
+	}
+}
+
+func TestCollectGarbageDryRun(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "user1", "processed", "gone_thumbnail.webp")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := CollectGarbage(context.Background(), nil, root, GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if result.Files != 1 {
+		t.Errorf("CollectGarbage reported %d files, want 1", result.Files)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("dry run removed %s: %v", path, err)
+	}
+}
+
+func TestConversionJobID(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobID string
+		tmp   bool
+		ok    bool
+	}{
+		{"conv-1.webp", "conv-1", false, true},
+		{"conv-1.jpg", "conv-1", false, true},
+		{"conv-1.png.tmp", "conv-1", true, true},
+		{"conv-1.webp.tmp", "conv-1", true, true},
+		{"zip_123.zip", "", false, false},
+		{"zip_123.zip.tmp", "", false, false},
+		{"upload.tmp", "", false, false},
+		{"chunk_0", "", false, false},
+		{".webp", "", false, false},
+		{"conv-1.gif", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobID, tmp, ok := conversionJobID(tt.name)
+			if jobID != tt.jobID || tmp != tt.tmp || ok != tt.ok {
+				t.Errorf("conversionJobID(%q) = %q, %v, %v, want %q, %v, %v", tt.name, jobID, tmp, ok, tt.jobID, tt.tmp, tt.ok)
+			}
+		})
+	}
+}
@@ -1,19 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	_ "image/jpeg"
 	_ "image/png"
-	"log"
+	"log/slog"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ProcessResult struct {
@@ -21,68 +24,160 @@ type ProcessResult struct {
 	Format string
 }
 
+const (
+	BackendCPU  = "cpu"
+	BackendCUDA = "cuda"
+)
+
+// DispatcherConfig sizes the dispatcher. Lanes is the number of operations
+// executed in parallel; zero means GOMAXPROCS. Background is the color
+// transparent images are flattened onto for formats without alpha.
+type DispatcherConfig struct {
+	Backend          string
+	Lanes            int
+	QueueSize        int
+	OperationTimeout time.Duration
+	Background       color.NRGBA
+}
+
 type GPUDispatcher struct {
-	mu               sync.Mutex
 	gpuInitialized   bool
+	backend          string
+	lanes            int
 	operationQueue   chan *gpuOperation
 	shutdownChan     chan struct{}
 	wg               sync.WaitGroup
 	maxQueueSize     int
 	operationTimeout time.Duration
+	background       color.NRGBA
+	logger           *slog.Logger
+
+	// running and lastDrain let health checks tell a live dispatcher from
+	// one whose lanes exited or are stuck on operations.
+	running   atomic.Int32
+	lastDrain atomic.Int64
 }
 
 type gpuOperation struct {
-	op        string
+	operation Operation
+	convert   *ConvertOptions // Set for conversions, which ignore operation
+	edits     []Edit          // Set for edits, which ignore operation
 	imageData []byte
 	jobID     string
 	result    chan *ProcessResult
 	err       chan error
 	ctx       context.Context
+	queuedAt  time.Time
 }
 
-func NewGPUDispatcher() *GPUDispatcher {
+func NewGPUDispatcher(cfg DispatcherConfig) *GPUDispatcher {
+	lanes := cfg.Lanes
+	if lanes <= 0 {
+		lanes = runtime.GOMAXPROCS(0)
+	}
+
 	gd := &GPUDispatcher{
-		operationQueue:   make(chan *gpuOperation, 100),
+		backend:          cfg.Backend,
+		lanes:            lanes,
+		operationQueue:   make(chan *gpuOperation, cfg.QueueSize),
 		shutdownChan:     make(chan struct{}),
-		maxQueueSize:     100,
-		operationTimeout: 30 * time.Second,
+		maxQueueSize:     cfg.QueueSize,
+		operationTimeout: cfg.OperationTimeout,
+		background:       cfg.Background,
+		logger:           componentLogger("dispatcher"),
 	}
 
-	if err := CudaInit(); err != nil {
-		log.Fatalf("[GPU] CUDA initialization failed: %v", err)
+	switch gd.backend {
+	case BackendCPU:
+	case BackendCUDA:
+		if err := CudaInit(); err != nil {
+			fatal("CUDA initialization failed", logKeyError, err)
+		}
+		gd.logger.Info("CUDA initialized")
+	default:
+		fatal(fmt.Sprintf("Unknown backend %q (want %s or %s)", gd.backend, BackendCPU, BackendCUDA))
 	}
-
 	gd.gpuInitialized = true
-	log.Println("[GPU] CUDA initialized successfully")
 
-	gd.wg.Add(1)
-	go gd.processOperations()
+	gd.lastDrain.Store(time.Now().UnixNano())
+	for lane := 0; lane < gd.lanes; lane++ {
+		gd.wg.Add(1)
+		go gd.processOperations()
+	}
+
+	gd.logger.Info("Dispatcher started",
+		"backend", gd.backend,
+		"lanes", gd.lanes,
+		"queue_size", gd.maxQueueSize,
+		"operation_timeout", gd.operationTimeout.String())
 
 	return gd
 }
 
-func (gd *GPUDispatcher) ProcessImage(ctx context.Context, imageData []byte, operation string, jobID string) (*ProcessResult, error) {
+// Backend names the initialized processing backend.
+func (gd *GPUDispatcher) Backend() string {
+	return gd.backend
+}
+
+// Background is the color transparent images are flattened onto for formats
+// without alpha.
+func (gd *GPUDispatcher) Background() color.NRGBA {
+	return gd.background
+}
+
+// Lanes is the number of operations the dispatcher executes in parallel.
+func (gd *GPUDispatcher) Lanes() int {
+	return gd.lanes
+}
+
+func (gd *GPUDispatcher) ProcessImage(ctx context.Context, imageData []byte, operation Operation, jobID string) (*ProcessResult, error) {
 	if !gd.gpuInitialized {
 		return nil, errors.New("GPU not initialized")
 	}
 
-	validOps := map[string]bool{"thumbnail": true, "blur": true, "low-quality": true}
-	if !validOps[operation] {
-		return nil, fmt.Errorf("invalid operation: %s", operation)
+	if err := operation.Validate(); err != nil {
+		return nil, err
 	}
 
-	resultChan := make(chan *ProcessResult, 1)
-	errChan := make(chan error, 1)
+	return gd.submit(ctx, &gpuOperation{operation: operation, imageData: imageData, jobID: jobID})
+}
+
+// ConvertImage runs a convert job's conversion on the dispatcher lanes, with
+// the same queueing and timeouts as ProcessImage.
+func (gd *GPUDispatcher) ConvertImage(ctx context.Context, imageData []byte, opts ConvertOptions, jobID string) (*ProcessResult, error) {
+	if !gd.gpuInitialized {
+		return nil, errors.New("GPU not initialized")
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	return gd.submit(ctx, &gpuOperation{convert: &opts, imageData: imageData, jobID: jobID})
+}
+
+// EditImage applies an edit job's edits on the dispatcher lanes, with the
+// same queueing and timeouts as ProcessImage. The result's Format is the
+// format EditImage chose for the new version.
+func (gd *GPUDispatcher) EditImage(ctx context.Context, imageData []byte, edits []Edit, jobID string) (*ProcessResult, error) {
+	if !gd.gpuInitialized {
+		return nil, errors.New("GPU not initialized")
+	}
 
-	op := &gpuOperation{
-		op:        operation,
-		imageData: imageData,
-		jobID:     jobID,
-		result:    resultChan,
-		err:       errChan,
-		ctx:       ctx,
+	if len(edits) == 0 {
+		return nil, errors.New("edits list is empty")
 	}
 
+	return gd.submit(ctx, &gpuOperation{edits: edits, imageData: imageData, jobID: jobID})
+}
+
+// submit queues op and waits for its result.
+func (gd *GPUDispatcher) submit(ctx context.Context, op *gpuOperation) (*ProcessResult, error) {
+	resultChan := make(chan *ProcessResult, 1)
+	errChan := make(chan error, 1)
+	op.result, op.err = resultChan, errChan
+	op.ctx, op.queuedAt = ctx, time.Now()
+
 	select {
 	case gd.operationQueue <- op:
 	case <-ctx.Done():
@@ -99,46 +194,111 @@ func (gd *GPUDispatcher) ProcessImage(ctx context.Context, imageData []byte, ope
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case <-time.After(gd.operationTimeout):
-		return nil, fmt.Errorf("GPU operation timeout for job %s operation %s", jobID, operation)
+		return nil, fmt.Errorf("GPU operation timeout for job %s operation %s", op.jobID, op.name())
+	}
+}
+
+// name identifies the operation in logs and traces; kind labels metrics.
+func (op *gpuOperation) name() string {
+	if op.convert != nil {
+		return OpConvert
+	}
+	if op.edits != nil {
+		return OpEdit
+	}
+	return op.operation.Name()
+}
+
+func (op *gpuOperation) kind() string {
+	if op.convert != nil {
+		return OpConvert
 	}
+	if op.edits != nil {
+		return OpEdit
+	}
+	return op.operation.Op
 }
 
+// processOperations is one execution lane. Lanes share the queue, and the
+// decode/resize/encode path is safe to run concurrently; only calls into the
+// CUDA context are serialized (see cuda_bindings.go).
 func (gd *GPUDispatcher) processOperations() {
 	defer gd.wg.Done()
 
+	gd.running.Add(1)
+	defer gd.running.Add(-1)
+
 	for {
 		select {
 		case <-gd.shutdownChan:
-			log.Println("[GPU-PROC] Shutdown signal received")
+			gd.logger.Info("Shutdown signal received")
 			return
 		case op := <-gd.operationQueue:
 			gd.executeOperation(op)
+			gd.lastDrain.Store(time.Now().UnixNano())
 		}
 	}
 }
 
+// Healthy reports whether every dispatcher lane is running and the queue is
+// draining. Queued work that has not moved for longer than the operation
+// timeout means the lanes are stuck.
+func (gd *GPUDispatcher) Healthy() error {
+	if !gd.gpuInitialized {
+		return errors.New("backend not initialized")
+	}
+	if running := int(gd.running.Load()); running != gd.lanes {
+		return fmt.Errorf("%d of %d dispatcher lanes running", running, gd.lanes)
+	}
+
+	idle := time.Since(time.Unix(0, gd.lastDrain.Load()))
+	if len(gd.operationQueue) > 0 && idle > gd.operationTimeout {
+		return fmt.Errorf("dispatcher has not drained its queue (%d waiting) for %v", len(gd.operationQueue), idle.Round(time.Second))
+	}
+	return nil
+}
+
 func (gd *GPUDispatcher) executeOperation(op *gpuOperation) {
-	gd.mu.Lock()
-	defer gd.mu.Unlock()
+	name, kind := op.name(), op.kind()
+	logger := gd.logger.With(logKeyJobID, op.jobID, logKeyOp, name)
+	logger.Debug("Operation starting", logKeyBytesIn, len(op.imageData))
 
-	log.Printf("[GPU-EXEC] Job %s operation %s starting (input size: %d bytes)", op.jobID, op.op, len(op.imageData))
+	ctx, span := tracer.Start(op.ctx, "dispatcher.execute", trace.WithAttributes(
+		attribute.String("image.operation", name),
+		attribute.String("image.backend", gd.backend),
+		attribute.Int64("dispatcher.queue_wait_ms", time.Since(op.queuedAt).Milliseconds()),
+	))
+	defer span.End()
 
 	var result *ProcessResult
 	var err error
 
-	switch op.op {
+	start := time.Now()
+	switch kind {
 	case "thumbnail":
-		result, err = gd.processThumbnail(op.imageData)
+		result, err = gd.processThumbnail(ctx, op.imageData)
 	case "blur":
-		result, err = gd.processBlur(op.imageData)
+		result, err = gd.processBlur(ctx, op.imageData)
 	case "low-quality":
-		result, err = gd.processLowQuality(op.imageData)
+		result, err = gd.processLowQuality(ctx, op.imageData)
+	case OpResize:
+		result, err = gd.processResize(ctx, op.imageData, op.operation.Profile())
+	case OpConvert:
+		result, err = gd.processConvert(ctx, op.imageData, *op.convert)
+	case OpEdit:
+		result, err = gd.processEdit(op.imageData, op.edits)
 	default:
-		err = fmt.Errorf("unknown operation: %s", op.op)
+		err = fmt.Errorf("unknown operation: %s", kind)
 	}
+	elapsed := time.Since(start)
+	// Metrics are labelled by kind; per-parameter names would be unbounded
+	operationDuration.WithLabelValues(kind).Observe(elapsed.Seconds())
+	bytesInTotal.WithLabelValues(kind).Add(float64(len(op.imageData)))
 
 	if err != nil {
-		log.Printf("[GPU-EXEC] Job %s operation %s failed: %v", op.jobID, op.op, err)
+		operationsTotal.WithLabelValues(kind, "failed").Inc()
+		failSpan(ctx, err)
+		logger.Error("Operation failed", logKeyError, err)
 		select {
 		case op.err <- err:
 		case <-op.ctx.Done():
@@ -147,15 +307,21 @@ func (gd *GPUDispatcher) executeOperation(op *gpuOperation) {
 		// Log size comparison to verify quality ordering
 		inputSize := len(op.imageData)
 		outputSize := len(result.Data)
+		operationsTotal.WithLabelValues(kind, "processed").Inc()
+		bytesOutTotal.WithLabelValues(kind).Add(float64(outputSize))
 		sizeReduction := float64(inputSize-outputSize) / float64(inputSize) * 100
 
-		log.Printf("[GPU-EXEC] Job %s operation %s complete (input: %d bytes -> output: %d bytes, reduction: %.1f%%)",
-			op.jobID, op.op, inputSize, outputSize, sizeReduction)
-
-		// Validate that processed output is smaller than original
-		if outputSize >= inputSize && inputSize > 0 {
-			log.Printf("[GPU-WARN] Job %s operation %s: output size (%d) >= input size (%d) - quality ordering may not be guaranteed",
-				op.jobID, op.op, outputSize, inputSize)
+		logger.Info("Operation complete",
+			logKeyBytesIn, inputSize,
+			logKeyBytesOut, outputSize,
+			logKeyDurationMS, elapsed.Milliseconds(),
+			"reduction_pct", fmt.Sprintf("%.1f", sizeReduction))
+
+		// Validate that processed output is smaller than original. Conversions
+		// and edits may legitimately grow, e.g. JPEG to PNG
+		if outputSize >= inputSize && inputSize > 0 && kind != OpConvert && kind != OpEdit {
+			logger.Warn("Output not smaller than input, quality ordering may not be guaranteed",
+				logKeyBytesIn, inputSize, logKeyBytesOut, outputSize)
 		}
 
 		select {
@@ -165,111 +331,207 @@ func (gd *GPUDispatcher) executeOperation(op *gpuOperation) {
 	}
 }
 
-func (gd *GPUDispatcher) processThumbnail(imageData []byte) (*ProcessResult, error) {
-	// Decode image
-	img, _, err := image.Decode(bytes.NewReader(imageData))
+// decodeSpanned decodes imageData for imaging under an image.decode span.
+func decodeSpanned(ctx context.Context, imageData []byte) (*image.NRGBA, error) {
+	_, span := tracer.Start(ctx, "image.decode")
+	defer span.End()
+
+	img, err := decodeNRGBA(imageData)
 	if err != nil {
 		return nil, fmt.Errorf("decode failed: %w", err)
 	}
+	return img, nil
+}
+
+// processCUDA runs a preset on its CUDA kernel, which takes and returns
+// pixels as DecodeImage and EncodeWebP lay them out.
+func processCUDA(ctx context.Context, imageData []byte, kernel func(pixels []byte, width, height, channels int) ([]byte, int, int, error), quality int) (*ProcessResult, error) {
+	_, decodeSpan := tracer.Start(ctx, "image.decode")
+	pix, width, height, channels, err := DecodeImage(imageData)
+	decodeSpan.End()
+	if err != nil {
+		return nil, fmt.Errorf("decode failed: %w", err)
+	}
+
+	out, width, height, err := kernel(pix, width, height, channels)
+	ReleasePixels(pix)
+	if err != nil {
+		return nil, err
+	}
+
+	_, encodeSpan := tracer.Start(ctx, "image.encode")
+	data, err := EncodeWebP(out, width, height, channels, quality)
+	encodeSpan.End()
+	if err != nil {
+		return nil, fmt.Errorf("WebP encoding failed: %w", err)
+	}
+
+	return &ProcessResult{
+		Data:   data,
+		Format: "webp",
+	}, nil
+}
+
+func (gd *GPUDispatcher) processThumbnail(ctx context.Context, imageData []byte) (*ProcessResult, error) {
+	profile := operationProfiles["thumbnail"]
+	if gd.backend == BackendCUDA {
+		return processCUDA(ctx, imageData, CudaProcessThumbnail, profile.Quality)
+	}
+
+	img, err := decodeSpanned(ctx, imageData)
+	if err != nil {
+		return nil, err
+	}
+	defer ReleasePixels(img.Pix)
 
 	// Resize to 48px max dimension using high-quality Lanczos resampling
-	resized := imaging.Fit(img, 48, 48, imaging.Lanczos)
+	resized := imaging.Fit(img, profile.MaxSize, profile.MaxSize, imaging.Lanczos)
 
 	// Encode to WebP with quality 20 (aggressive compression)
-	var buf bytes.Buffer
-	opts := &webp.Options{
-		Lossless: false,
-		Quality:  20,
-	}
-	if err := webp.Encode(&buf, resized, opts); err != nil {
+	_, encodeSpan := tracer.Start(ctx, "image.encode")
+	data, err := encodeWebPImage(resized, profile.Quality)
+	encodeSpan.End()
+	if err != nil {
 		return nil, fmt.Errorf("WebP encoding failed: %w", err)
 	}
 
 	return &ProcessResult{
-		Data:   buf.Bytes(),
+		Data:   data,
 		Format: "webp",
 	}, nil
 }
 
-func (gd *GPUDispatcher) processBlur(imageData []byte) (*ProcessResult, error) {
-	// Decode image
-	img, _, err := image.Decode(bytes.NewReader(imageData))
+func (gd *GPUDispatcher) processBlur(ctx context.Context, imageData []byte) (*ProcessResult, error) {
+	profile := operationProfiles["blur"]
+	if gd.backend == BackendCUDA {
+		return processCUDA(ctx, imageData, CudaProcessBlur, profile.Quality)
+	}
+
+	img, err := decodeSpanned(ctx, imageData)
 	if err != nil {
-		return nil, fmt.Errorf("decode failed: %w", err)
+		return nil, err
 	}
+	defer ReleasePixels(img.Pix)
 
 	// Resize to 192px max dimension
-	resized := imaging.Fit(img, 192, 192, imaging.Lanczos)
+	resized := imaging.Fit(img, profile.MaxSize, profile.MaxSize, imaging.Lanczos)
 
 	// Apply Gaussian blur
-	blurred := imaging.Blur(resized, 3.0)
+	blurred := imaging.Blur(resized, profile.Blur)
 
 	// Encode to WebP with quality 40
-	var buf bytes.Buffer
-	opts := &webp.Options{
-		Lossless: false,
-		Quality:  40,
-	}
-	if err := webp.Encode(&buf, blurred, opts); err != nil {
+	_, encodeSpan := tracer.Start(ctx, "image.encode")
+	data, err := encodeWebPImage(blurred, profile.Quality)
+	encodeSpan.End()
+	if err != nil {
 		return nil, fmt.Errorf("WebP encoding failed: %w", err)
 	}
 
 	return &ProcessResult{
-		Data:   buf.Bytes(),
+		Data:   data,
 		Format: "webp",
 	}, nil
 }
 
-func (gd *GPUDispatcher) processLowQuality(imageData []byte) (*ProcessResult, error) {
-	// Decode image
-	img, _, err := image.Decode(bytes.NewReader(imageData))
+func (gd *GPUDispatcher) processLowQuality(ctx context.Context, imageData []byte) (*ProcessResult, error) {
+	profile := operationProfiles["low-quality"]
+	if gd.backend == BackendCUDA {
+		return processCUDA(ctx, imageData, CudaProcessLowQuality, profile.Quality)
+	}
+
+	img, err := decodeSpanned(ctx, imageData)
 	if err != nil {
-		return nil, fmt.Errorf("decode failed: %w", err)
+		return nil, err
 	}
+	defer ReleasePixels(img.Pix)
 
 	// Resize to 384px max dimension
-	resized := imaging.Fit(img, 384, 384, imaging.Lanczos)
+	resized := imaging.Fit(img, profile.MaxSize, profile.MaxSize, imaging.Lanczos)
 
 	// Encode to WebP with quality 60
-	var buf bytes.Buffer
-	opts := &webp.Options{
-		Lossless: false,
-		Quality:  60,
-	}
-	if err := webp.Encode(&buf, resized, opts); err != nil {
+	_, encodeSpan := tracer.Start(ctx, "image.encode")
+	data, err := encodeWebPImage(resized, profile.Quality)
+	encodeSpan.End()
+	if err != nil {
 		return nil, fmt.Errorf("WebP encoding failed: %w", err)
 	}
 
 	return &ProcessResult{
-		Data:   buf.Bytes(),
+		Data:   data,
 		Format: "webp",
 	}, nil
 }
 
+func (gd *GPUDispatcher) processResize(ctx context.Context, imageData []byte, profile OperationProfile) (*ProcessResult, error) {
+	img, err := decodeSpanned(ctx, imageData)
+	if err != nil {
+		return nil, err
+	}
+	defer ReleasePixels(img.Pix)
+
+	// An unbounded side is capped at the source size, so Fit only shrinks
+	width, height := profile.MaxWidth, profile.MaxHeight
+	if width == 0 {
+		width = img.Bounds().Dx()
+	}
+	if height == 0 {
+		height = img.Bounds().Dy()
+	}
+	resized := imaging.Fit(img, width, height, imaging.Lanczos)
+
+	_, encodeSpan := tracer.Start(ctx, "image.encode")
+	data, err := encodeImage(resized, profile.Format, profile.Quality, gd.background)
+	encodeSpan.End()
+	if err != nil {
+		return nil, fmt.Errorf("%s encoding failed: %w", profile.Format, err)
+	}
+
+	return &ProcessResult{
+		Data:   data,
+		Format: profile.Format,
+	}, nil
+}
+
+func (gd *GPUDispatcher) processEdit(imageData []byte, edits []Edit) (*ProcessResult, error) {
+	data, format, err := EditImage(imageData, edits, gd.background)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProcessResult{
+		Data:   data,
+		Format: format,
+	}, nil
+}
+
 // ValidateQualityOrder checks if processed files follow the expected size ordering:
 // thumbnail < blur < low-quality < original
 // Returns true if ordering is correct, false otherwise with detailed logging
 func ValidateQualityOrder(thumbnailSize, blurSize, lowQualitySize, originalSize int) bool {
 	isValid := true
+	logger := componentLogger("quality")
 
 	if thumbnailSize >= blurSize {
-		log.Printf("[QUALITY-WARN] thumbnail (%d bytes) >= blur (%d bytes)", thumbnailSize, blurSize)
+		logger.Warn("thumbnail not smaller than blur", "thumbnail_bytes", thumbnailSize, "blur_bytes", blurSize)
 		isValid = false
 	}
 
 	if blurSize >= lowQualitySize {
-		log.Printf("[QUALITY-WARN] blur (%d bytes) >= low-quality (%d bytes)", blurSize, lowQualitySize)
+		logger.Warn("blur not smaller than low-quality", "blur_bytes", blurSize, "low_quality_bytes", lowQualitySize)
 		isValid = false
 	}
 
 	if lowQualitySize >= originalSize {
-		log.Printf("[QUALITY-WARN] low-quality (%d bytes) >= original (%d bytes)", lowQualitySize, originalSize)
+		logger.Warn("low-quality not smaller than original", "low_quality_bytes", lowQualitySize, "original_bytes", originalSize)
 		isValid = false
 	}
 
 	if isValid {
-		log.Printf("[QUALITY-OK] Size ordering verified: thumbnail (%d) < blur (%d) < low-quality (%d) < original (%d)",
-			thumbnailSize, blurSize, lowQualitySize, originalSize)
+		logger.Debug("Size ordering verified",
+			"thumbnail_bytes", thumbnailSize,
+			"blur_bytes", blurSize,
+			"low_quality_bytes", lowQualitySize,
+			"original_bytes", originalSize)
 	}
 
 	return isValid
@@ -295,10 +557,12 @@ func GetExpectedQualityRatios() QualityRatios {
 }
 
 func (gd *GPUDispatcher) Close() {
-	log.Println("[GPU] Shutting down dispatcher")
+	gd.logger.Info("Shutting down dispatcher")
 	close(gd.shutdownChan)
 	gd.wg.Wait()
 
-	CudaCleanup()
-	log.Println("[GPU] Cleanup complete")
+	if gd.backend == BackendCUDA {
+		CudaCleanup()
+	}
+	gd.logger.Info("Cleanup complete")
 }
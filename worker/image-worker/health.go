@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"worker-common/healthcheck"
+)
+
+// HealthChecker backs the /healthz and /readyz endpoints. Liveness only
+// covers the dispatcher, so a Redis outage makes the worker unready without
+// getting it restarted.
+type HealthChecker struct {
+	redisClient   *RedisClient
+	gpuDispatcher *GPUDispatcher
+	dataDir       string
+}
+
+func NewHealthChecker(rc *RedisClient, gd *GPUDispatcher, dataDir string) *HealthChecker {
+	return &HealthChecker{redisClient: rc, gpuDispatcher: gd, dataDir: dataDir}
+}
+
+func (hc *HealthChecker) live() map[string]error {
+	return map[string]error{
+		"dispatcher": hc.gpuDispatcher.Healthy(),
+	}
+}
+
+func (hc *HealthChecker) ready(ctx context.Context) map[string]error {
+	checks := hc.live()
+	checks["redis"] = hc.redisClient.Ping(ctx)
+	checks["data_dir"] = healthcheck.Writable(hc.dataDir)
+	return checks
+}
+
+func (hc *HealthChecker) handleLive(w http.ResponseWriter, r *http.Request) {
+	healthcheck.Write(w, hc.live())
+}
+
+func (hc *HealthChecker) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	healthcheck.Write(w, hc.ready(ctx))
+}
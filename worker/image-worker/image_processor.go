@@ -5,98 +5,355 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	_ "image/jpeg"
-	_ "image/png"
+	"image/jpeg"
+	"image/png"
+	"sync"
 
 	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
 )
 
-// QualitySettings defines WebP encoding quality for each operation
-type QualitySettings struct {
-	Thumbnail  int // Smallest file - very aggressive compression
-	Blur       int // Medium-small file
-	LowQuality int // Medium file
+// pixelPool recycles the packed pixel buffers handed between decode, the
+// operations and encode. nrgbaPool does the same for the 4-channel images
+// built for the encoder, and bufPool for encoder output.
+var (
+	pixelPool sync.Pool
+	nrgbaPool sync.Pool
+	bufPool   = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+)
+
+// getPixels returns a pooled buffer of length n.
+func getPixels(pool *sync.Pool, n int) []byte {
+	if p, ok := pool.Get().(*[]byte); ok && cap(*p) >= n {
+		return (*p)[:n]
+	}
+	return make([]byte, n)
+}
+
+func putPixels(pool *sync.Pool, pix []byte) {
+	pool.Put(&pix)
 }
 
-var qualitySettings = QualitySettings{
-	Thumbnail:  20, // Very low quality - smallest files
-	Blur:       40, // Low-medium quality
-	LowQuality: 60, // Medium quality
+// ReleasePixels returns a buffer obtained from DecodeImage, or the Pix of an
+// image from decodeNRGBA, to the pool. The buffer must not be used
+// afterwards.
+func ReleasePixels(pix []byte) {
+	putPixels(&pixelPool, pix)
+}
+
+// DecodeImage decodes JPEG/PNG/WebP to packed pixels: RGB (3 channels) for
+// opaque images and premultiplied RGBA (4 channels) for ones with
+// transparency, which the CUDA kernels resample and blur like any other
+// channel. The buffer comes from a pool; callers may hand it back with
+// ReleasePixels once done. It is the input of the CUDA kernels.
+func DecodeImage(imageData []byte) (pix []byte, width, height, channels int, err error) {
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, 0, 0, 0, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	width, height = bounds.Dx(), bounds.Dy()
+
+	if isOpaque(img) {
+		pix = getPixels(&pixelPool, width*height*3)
+		toRGB(pix, img, 3)
+		return pix, width, height, 3, nil
+	}
+	pix = getPixels(&pixelPool, width*height*4)
+	toRGBA(pix, img)
+	return pix, width, height, 4, nil
 }
 
-// DecodeImage decodes JPEG/PNG/WebP to raw RGB pixels
-func DecodeImage(imageData []byte) ([]byte, int, int, error) {
+// decodeNRGBA decodes JPEG/PNG/WebP to an *image.NRGBA for the operations
+// that run through imaging, using the same conversions and pool as
+// DecodeImage. Callers may hand img.Pix back with ReleasePixels once done.
+func decodeNRGBA(imageData []byte) (*image.NRGBA, error) {
 	img, _, err := image.Decode(bytes.NewReader(imageData))
 	if err != nil {
-		return nil, 0, 0, fmt.Errorf("failed to decode image: %w", err)
+		return nil, fmt.Errorf("failed to decode image: %w", err)
 	}
 
-	// Convert to RGBA then extract RGB
 	bounds := img.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 
-	// Convert to NRGBA for consistent pixel access
-	nrgba := imaging.Clone(img)
-
-	// Extract RGB bytes (drop alpha channel)
-	rgb := make([]byte, width*height*3)
-	idx := 0
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, _ := nrgba.At(x, y).RGBA()
-			rgb[idx] = byte(r >> 8)
-			rgb[idx+1] = byte(g >> 8)
-			rgb[idx+2] = byte(b >> 8)
-			idx += 3
+	pix := getPixels(&pixelPool, width*height*4)
+	if isOpaque(img) {
+		toRGB(pix, img, 4)
+	} else {
+		toNRGBA(pix, img)
+	}
+	return &image.NRGBA{Pix: pix, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}, nil
+}
+
+// toRGB writes an opaque img into dst as packed pixels of channels bytes,
+// RGB or RGBA with opaque alpha, working directly on the Pix slices of the
+// concrete types decoders return.
+func toRGB(dst []byte, img image.Image, channels int) {
+	b := img.Bounds()
+	width := b.Dx()
+	i := 0
+
+	switch src := img.(type) {
+	case *image.YCbCr:
+		// Chroma is shared by 1, 2 or 4 horizontally adjacent pixels
+		shift := 0
+		switch src.SubsampleRatio {
+		case image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio420:
+			shift = 1
+		case image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410:
+			shift = 2
 		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			yrow := src.Y[src.YOffset(b.Min.X, y):][:width]
+			ci := src.COffset(b.Min.X, y)
+			out := dst[i : i+width*channels]
+			for x, v := range yrow {
+				if x > 0 && (b.Min.X+x)>>shift != (b.Min.X+x-1)>>shift {
+					ci++
+				}
+				// color.YCbCrToRGB, inlined: the call dominates otherwise
+				yy := int32(v) * 0x10101
+				cb := int32(src.Cb[ci]) - 128
+				cr := int32(src.Cr[ci]) - 128
+				o := out[x*channels : x*channels+channels : x*channels+channels]
+				o[0] = clampFix(yy + 91881*cr)
+				o[1] = clampFix(yy - 22554*cb - 46802*cr)
+				o[2] = clampFix(yy + 116130*cb)
+				if channels == 4 {
+					o[3] = 0xff
+				}
+			}
+			i += width * channels
+		}
+
+	case *image.NRGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):][:width*4]
+			if channels == 4 {
+				// Opaque, so straight and premultiplied alpha are the same
+				i += copy(dst[i:], row)
+				continue
+			}
+			for j := 0; j < len(row); j += 4 {
+				dst[i], dst[i+1], dst[i+2] = row[j], row[j+1], row[j+2]
+				i += 3
+			}
+		}
+
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):][:width*4]
+			if channels == 4 {
+				i += copy(dst[i:], row)
+				continue
+			}
+			for j := 0; j < len(row); j += 4 {
+				dst[i], dst[i+1], dst[i+2] = row[j], row[j+1], row[j+2]
+				i += 3
+			}
+		}
+
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):][:width]
+			for _, v := range row {
+				dst[i], dst[i+1], dst[i+2] = v, v, v
+				if channels == 4 {
+					dst[i+3] = 0xff
+				}
+				i += channels
+			}
+		}
+
+	default:
+		// Paletted, 16-bit and CMYK images are rare enough to go through
+		// imaging's generic conversion
+		toRGB(dst, imaging.Clone(img), channels)
 	}
+}
 
-	return rgb, width, height, nil
+// toRGBA writes img into dst as packed premultiplied RGBA.
+func toRGBA(dst []byte, img image.Image) {
+	b := img.Bounds()
+	width := b.Dx()
+	i := 0
+
+	switch src := img.(type) {
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i += copy(dst[i:], src.Pix[src.PixOffset(b.Min.X, y):][:width*4])
+		}
+
+	case *image.NRGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):][:width*4]
+			for j := 0; j < len(row); j += 4 {
+				a := row[j+3]
+				dst[i], dst[i+1], dst[i+2], dst[i+3] = premultiply(row[j], a), premultiply(row[j+1], a), premultiply(row[j+2], a), a
+				i += 4
+			}
+		}
+
+	default:
+		toRGBA(dst, imaging.Clone(img))
+	}
 }
 
-// EncodeWebP encodes RGB pixels to WebP with specified quality
+// toNRGBA writes img into dst as packed straight RGBA.
+func toNRGBA(dst []byte, img image.Image) {
+	b := img.Bounds()
+	width := b.Dx()
+	i := 0
+
+	switch src := img.(type) {
+	case *image.NRGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i += copy(dst[i:], src.Pix[src.PixOffset(b.Min.X, y):][:width*4])
+		}
+
+	case *image.RGBA:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := src.Pix[src.PixOffset(b.Min.X, y):][:width*4]
+			for j := 0; j < len(row); j += 4 {
+				a := row[j+3]
+				dst[i], dst[i+1], dst[i+2], dst[i+3] = unpremultiply(row[j], a), unpremultiply(row[j+1], a), unpremultiply(row[j+2], a), a
+				i += 4
+			}
+		}
+
+	default:
+		toNRGBA(dst, imaging.Clone(img))
+	}
+}
+
+// clampFix converts a 16.16 fixed-point channel value to a byte, clamping to
+// [0, 255].
+func clampFix(v int32) byte {
+	if uint32(v)&0xff000000 == 0 {
+		return byte(v >> 16)
+	}
+	return byte(^(v >> 31))
+}
+
+// premultiply matches color.NRGBA.RGBA scaled back to 8 bits.
+func premultiply(v, a byte) byte {
+	x := uint32(v)
+	x |= x << 8
+	x *= uint32(a)
+	x /= 0xff
+	return byte(x >> 8)
+}
+
+// unpremultiply reverses premultiply: it returns the smallest value that
+// premultiplies to v.
+func unpremultiply(v, a byte) byte {
+	if a == 0 {
+		return 0
+	}
+	x := (uint32(v) << 8) * 0xff
+	d := uint32(a) * 0x101
+	return byte(min((x+d-1)/d, 0xff))
+}
+
+// EncodeWebP encodes pixels in the layout DecodeImage returns to WebP with
+// specified quality, keeping transparency.
 // Uses lossy compression to ensure file sizes scale with image complexity
-func EncodeWebP(rgb []byte, width, height, quality int) ([]byte, error) {
-	// Create NRGBA image from RGB data
-	img := image.NewNRGBA(image.Rect(0, 0, width, height))
-	idx := 0
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			img.SetNRGBA(x, y, color.NRGBA{
-				R: rgb[idx],
-				G: rgb[idx+1],
-				B: rgb[idx+2],
-				A: 255,
-			})
-			idx += 3
+func EncodeWebP(pix []byte, width, height, channels, quality int) ([]byte, error) {
+	// Expand to straight NRGBA in a pooled buffer
+	nrgba := getPixels(&nrgbaPool, width*height*4)
+	defer putPixels(&nrgbaPool, nrgba)
+	if channels == 4 {
+		for i := 0; i+3 < len(pix) && i+3 < len(nrgba); i += 4 {
+			a := pix[i+3]
+			nrgba[i], nrgba[i+1], nrgba[i+2], nrgba[i+3] = unpremultiply(pix[i], a), unpremultiply(pix[i+1], a), unpremultiply(pix[i+2], a), a
+		}
+	} else {
+		for i, j := 0, 0; i+2 < len(pix) && j+3 < len(nrgba); i, j = i+3, j+4 {
+			nrgba[j], nrgba[j+1], nrgba[j+2], nrgba[j+3] = pix[i], pix[i+1], pix[i+2], 0xff
 		}
 	}
+	img := &image.NRGBA{Pix: nrgba, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+
+	data, err := encodeWebPImage(img, quality)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode WebP: %w", err)
+	}
+	return data, nil
+}
 
-	// Encode to WebP with lossy compression
-	// Quality: 0-100 where lower = smaller file, higher = better quality
-	var buf bytes.Buffer
-	opts := &webp.Options{
+// encodeWebPImage encodes img lossily at quality (0-100, lower means smaller
+// files) through a pooled buffer. The returned slice is owned by the caller.
+func encodeWebPImage(img image.Image, quality int) ([]byte, error) {
+	return encodeWebP(img, &webp.Options{
 		Lossless: false, // Force lossy compression
 		Quality:  float32(quality),
-	}
-	if err := webp.Encode(&buf, img, opts); err != nil {
-		return nil, fmt.Errorf("failed to encode WebP: %w", err)
+	})
+}
+
+// encodeWebPLossless encodes img as lossless WebP.
+func encodeWebPLossless(img image.Image) ([]byte, error) {
+	return encodeWebP(img, &webp.Options{Lossless: true})
+}
+
+func encodeWebP(img image.Image, opts *webp.Options) ([]byte, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+
+	if err := webp.Encode(buf, webpImage(img), opts); err != nil {
+		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	return bytes.Clone(buf.Bytes()), nil
 }
 
-// GetQuality returns the appropriate WebP quality for an operation
-func GetQuality(operation string) int {
-	switch operation {
-	case "thumbnail":
-		return qualitySettings.Thumbnail
-	case "blur":
-		return qualitySettings.Blur
-	case "low-quality":
-		return qualitySettings.LowQuality
+// webpImage prepares img for the WebP encoder, which hands the Pix of an
+// *image.RGBA to libwebp as is and converts anything else through the
+// premultiplied color.Color values, darkening translucent pixels. Straight
+// NRGBA pixels are therefore passed under an RGBA header.
+func webpImage(img image.Image) image.Image {
+	switch src := img.(type) {
+	case *image.Gray:
+		return src
+	case *image.NRGBA:
+		return &image.RGBA{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect}
+	}
+	if isOpaque(img) {
+		if rgba, ok := img.(*image.RGBA); ok {
+			return rgba
+		}
+	}
+	return webpImage(imaging.Clone(img))
+}
+
+// encodeImage encodes img as format. quality is ignored for png. Formats
+// without alpha get transparent images flattened onto background; the others
+// keep transparency.
+func encodeImage(img image.Image, format string, quality int, background color.NRGBA) ([]byte, error) {
+	if !formatHasAlpha(format) {
+		img = flatten(img, background)
+	}
+	if format == "webp" {
+		return encodeWebPImage(img, quality)
+	}
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	case "png":
+		err = png.Encode(buf, img)
 	default:
-		return 75
+		err = fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, err
 	}
+
+	return bytes.Clone(buf.Bytes()), nil
 }
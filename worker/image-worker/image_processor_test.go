@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+)
+
+// decodeImageGeneric is DecodeImage as it was before the fast path: every
+// pixel goes through imaging.Clone and color.Color, and alpha is dropped.
+// It is the baseline the benchmarks compare against.
+func decodeImageGeneric(imageData []byte) ([]byte, int, int, error) {
+	img, _, err := image.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	nrgba := imaging.Clone(img)
+
+	rgb := make([]byte, width*height*3)
+	idx := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := nrgba.At(x, y).RGBA()
+			rgb[idx] = byte(r >> 8)
+			rgb[idx+1] = byte(g >> 8)
+			rgb[idx+2] = byte(b >> 8)
+			idx += 3
+		}
+	}
+	return rgb, width, height, nil
+}
+
+// encodeWebPGeneric is EncodeWebP as it was before the fast path.
+func encodeWebPGeneric(rgb []byte, width, height, quality int) ([]byte, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	idx := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: rgb[idx], G: rgb[idx+1], B: rgb[idx+2], A: 255})
+			idx += 3
+		}
+	}
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, &webp.Options{Quality: float32(quality)}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// benchSources encodes a noisy photo-sized image so that each decodes to
+// one of the concrete types DecodeImage has a fast path for.
+func benchSources(tb testing.TB, width, height int) map[string][]byte {
+	tb.Helper()
+	rng := rand.New(rand.NewSource(1))
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rng.Read(nrgba.Pix)
+	opaque := image.NewRGBA(nrgba.Rect)
+	gray := image.NewGray(nrgba.Rect)
+	for i := 0; i < len(nrgba.Pix); i += 4 {
+		copy(opaque.Pix[i:i+3], nrgba.Pix[i:i+3])
+		opaque.Pix[i+3] = 0xff
+		gray.Pix[i/4] = nrgba.Pix[i]
+	}
+
+	sources := make(map[string][]byte)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, opaque, &jpeg.Options{Quality: 90}); err != nil {
+		tb.Fatal(err)
+	}
+	sources["YCbCr"] = bytes.Clone(buf.Bytes())
+	for name, img := range map[string]image.Image{"NRGBA": nrgba, "RGBA": opaque, "Gray": gray} {
+		buf.Reset()
+		if err := png.Encode(&buf, img); err != nil {
+			tb.Fatal(err)
+		}
+		sources[name] = bytes.Clone(buf.Bytes())
+	}
+
+	// Make sure each source exercises the path it is named after
+	for name, data := range sources {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if got := typeName(img); got != name {
+			tb.Fatalf("%s source decodes to %s", name, got)
+		}
+	}
+	return sources
+}
+
+func typeName(img image.Image) string {
+	switch img.(type) {
+	case *image.YCbCr:
+		return "YCbCr"
+	case *image.NRGBA:
+		return "NRGBA"
+	case *image.RGBA:
+		return "RGBA"
+	case *image.Gray:
+		return "Gray"
+	}
+	return "other"
+}
+
+var benchTypes = []string{"YCbCr", "NRGBA", "RGBA", "Gray"}
+
+func TestDecodeImageMatchesGeneric(t *testing.T) {
+	for name, data := range benchSources(t, 61, 37) {
+		want, _, _, err := decodeImageGeneric(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pix, width, height, channels, err := DecodeImage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "NRGBA" {
+			// Translucent: premultiplied RGBA instead of the old dropped alpha
+			if channels != 4 || len(pix) != width*height*4 {
+				t.Errorf("%s: got %d channels, want 4", name, channels)
+			}
+			continue
+		}
+		if channels != 3 || !bytes.Equal(pix, want) {
+			t.Errorf("%s: fast path differs from the generic conversion", name)
+		}
+		ReleasePixels(pix)
+	}
+}
+
+func TestDecodeNRGBAMatchesImaging(t *testing.T) {
+	for name, data := range benchSources(t, 61, 37) {
+		src, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := imaging.Clone(src)
+
+		img, err := decodeNRGBA(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Rect != want.Rect || !bytes.Equal(img.Pix, want.Pix) {
+			t.Errorf("%s: fast path differs from imaging.Clone", name)
+		}
+		ReleasePixels(img.Pix)
+	}
+}
+
+func TestUnpremultiplyInvertsPremultiply(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for v := 0; v < 256; v++ {
+			p := premultiply(byte(v), byte(a))
+			if got := premultiply(unpremultiply(p, byte(a)), byte(a)); got != p {
+				t.Fatalf("premultiply(unpremultiply(%d, %d)) = %d", p, a, got)
+			}
+		}
+	}
+}
+
+func BenchmarkDecodeImage(b *testing.B) {
+	sources := benchSources(b, 1920, 1080)
+	for _, name := range benchTypes {
+		data := sources[name]
+		b.Run(name+"/generic", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, _, err := decodeImageGeneric(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/fast", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pix, _, _, _, err := DecodeImage(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ReleasePixels(pix)
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeWebP(b *testing.B) {
+	sources := benchSources(b, 1920, 1080)
+	for _, name := range benchTypes {
+		rgb, width, height, err := decodeImageGeneric(sources[name])
+		if err != nil {
+			b.Fatal(err)
+		}
+		pix, _, _, channels, err := DecodeImage(sources[name])
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name+"/generic", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := encodeWebPGeneric(rgb, width, height, 60); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/fast", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := EncodeWebP(pix, width, height, channels, 60); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -5,18 +5,175 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"worker-common/jobjson"
+	"worker-common/storage"
+)
+
+// JobVersion is the payload version this worker understands and produces.
+// Payloads without a version predate versioning and are upgraded on decode;
+// see schemas/image-job.schema.json for the published format.
+const JobVersion = 1
+
+// Job types. A derivatives job builds Operations from InputPath; an edit job
+// first applies Edits to InputPath, writes the result as a new version of the
+// file at OutputPath and then builds the new version's derivatives. A convert
+// job writes InputPath in another format to OutputDir for download.
+const (
+	JobTypeDerivatives = "derivatives"
+	JobTypeEdit        = "edit"
+	JobTypeConvert     = "convert"
 )
 
 type Job struct {
-	JobID      string   `json:"jobId"`
-	InputPath  string   `json:"inputPath"`
-	OutputDir  string   `json:"outputDir"`
-	Operations []string `json:"operations"`
-	Timestamp  int64    `json:"timestamp"`
-	RetryCount int      `json:"retryCount"`
+	Version    int         `json:"version"`
+	Type       string      `json:"type,omitempty"` // JobTypeDerivatives when empty
+	JobID      string      `json:"jobId"`
+	UserID     string      `json:"userId,omitempty"`
+	InputPath  string      `json:"inputPath"`
+	OutputDir  string      `json:"outputDir"`
+	Operations []Operation `json:"operations"`
+	Timestamp  int64       `json:"timestamp"`
+	RetryCount int         `json:"retryCount"`
+	Priority   string      `json:"priority,omitempty"`
+
+	// Edit jobs only. OutputPath is the version to write, chosen by the
+	// worker next to the original when empty.
+	Edits      []Edit `json:"edits,omitempty"`
+	OutputPath string `json:"outputPath,omitempty"`
+
+	// Convert jobs only.
+	Convert *ConvertOptions `json:"convert,omitempty"`
+
+	// Errors of earlier failed attempts, oldest first.
+	Errors []JobError `json:"errors,omitempty"`
+	// Unix milliseconds the job reached image:done or image:failed.
+	FinishedAt int64 `json:"finishedAt,omitempty"`
+
+	// W3C trace context of the producer, see TraceContext.
+	Traceparent string `json:"traceparent,omitempty"`
+	Tracestate  string `json:"tracestate,omitempty"`
+
+	// Queue and stream delivery this job was read from. Not serialized.
+	sourceQueue string
+	streamKey   string
+	streamID    string
+
+	// Why the payload was rejected on decode, reported by Validate.
+	decodeErr error
+}
+
+// jobFields are the payload keys Job accepts.
+var jobFields = jobjson.Fields(reflect.TypeOf(Job{}))
+
+// DecodeJob parses a queued payload and upgrades it to JobVersion. Malformed
+// JSON is an error. Mistyped and unknown fields, such as a misspelled
+// "operation", and versions newer than JobVersion are recorded on the
+// returned job instead, so Validate fails it into image:failed with the
+// reason rather than the job disappearing.
+func DecodeJob(data []byte) (*Job, error) {
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return nil, err
+		}
+		// The other fields are still decoded, so the job can be failed
+		job.decodeErr = fmt.Errorf("invalid %s: got %s, want %s", typeErr.Field, typeErr.Value, typeErr.Type)
+		return job, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if unknown := jobjson.Unknown(fields, jobFields, ""); len(unknown) > 0 {
+		job.decodeErr = fmt.Errorf("unknown job fields: %s", strings.Join(unknown, ", "))
+		return job, nil
+	}
+
+	job.upgrade()
+	return job, nil
+}
+
+// upgrade migrates a payload from an older version in place.
+func (j *Job) upgrade() {
+	switch {
+	case j.Version > JobVersion:
+		j.decodeErr = fmt.Errorf("unsupported job version %d (this worker handles up to %d)", j.Version, JobVersion)
+		return
+	case j.Version < 0:
+		j.decodeErr = fmt.Errorf("invalid job version %d", j.Version)
+		return
+	}
+
+	// Version 0 is every payload produced before versioning: the owner may
+	// only be known from the <userId>/processed output layout
+	if j.Version == 0 {
+		j.UserID = j.Owner()
+		j.Version = 1
+	}
+}
+
+// JobError records one failed attempt so jobs in the retry and failed queues
+// carry their history.
+type JobError struct {
+	Attempt   int    `json:"attempt"`
+	Error     string `json:"error"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// RecordError appends err to the job's history for the current attempt.
+func (j *Job) RecordError(err error) {
+	j.Errors = append(j.Errors, JobError{
+		Attempt:   j.RetryCount,
+		Error:     err.Error(),
+		Timestamp: time.Now().UnixMilli(),
+	})
+}
+
+// Kind returns the job type for metric labels: the type, JobTypeDerivatives
+// when unset, or "unknown" for a type no worker handles.
+func (j *Job) Kind() string {
+	switch j.Type {
+	case "":
+		return JobTypeDerivatives
+	case JobTypeDerivatives, JobTypeEdit, JobTypeConvert:
+		return j.Type
+	}
+	return "unknown"
+}
+
+// Owner returns the user the job belongs to. Producers that predate the
+// userId field are handled through the <userId>/processed output layout.
+func (j *Job) Owner() string {
+	if j.UserID != "" {
+		return j.UserID
+	}
+	if filepath.Base(j.OutputDir) == "processed" {
+		return filepath.Base(filepath.Dir(j.OutputDir))
+	}
+	return ""
+}
+
+// Queue returns the queue the job was fetched from, falling back to the
+// queue for its priority.
+func (j *Job) Queue() string {
+	if j.sourceQueue != "" {
+		return j.sourceQueue
+	}
+	return QueueForPriority(j.Priority)
 }
 
 func (j *Job) Validate() error {
+	if j.decodeErr != nil {
+		return j.decodeErr
+	}
+
 	if j.JobID == "" {
 		return errors.New("jobId is required")
 	}
@@ -25,44 +182,60 @@ func (j *Job) Validate() error {
 		return errors.New("inputPath is required")
 	}
 
-	if _, err := os.Stat(j.InputPath); os.IsNotExist(err) {
-		return fmt.Errorf("input file not found: %s", j.InputPath)
+	// Remote inputs are checked when they are read
+	if !storage.IsS3URI(j.InputPath) {
+		if _, err := os.Stat(j.InputPath); os.IsNotExist(err) {
+			return fmt.Errorf("input file not found: %s", j.InputPath)
+		}
 	}
 
-	if len(j.Operations) == 0 {
-		return errors.New("operations list is empty")
+	if j.Priority != "" && QueueForPriority(j.Priority) == "" {
+		return fmt.Errorf("invalid priority: %s", j.Priority)
+	}
+
+	for i, op := range j.Operations {
+		if err := op.Validate(); err != nil {
+			return fmt.Errorf("operations[%d]: %v", i, err)
+		}
 	}
 
-	validOps := map[string]bool{
-		"thumbnail":   true,
-		"blur":        true,
-		"low-quality": true,
+	if j.Type != JobTypeConvert && len(j.Operations) == 0 {
+		return errors.New("operations list is empty")
+	}
+	if j.Type != JobTypeEdit && (len(j.Edits) > 0 || j.OutputPath != "") {
+		return errors.New("edits and outputPath are only valid for edit jobs")
+	}
+	if j.Type != JobTypeConvert && j.Convert != nil {
+		return errors.New("convert is only valid for convert jobs")
 	}
 
-	for _, op := range j.Operations {
-		if !validOps[op] {
-			return fmt.Errorf("invalid operation: %s", op)
+	switch j.Type {
+	case "", JobTypeDerivatives:
+	case JobTypeEdit:
+		if len(j.Edits) == 0 {
+			return errors.New("edits list is empty")
+		}
+		for i, edit := range j.Edits {
+			if err := edit.Validate(); err != nil {
+				return fmt.Errorf("edits[%d]: %v", i, err)
+			}
+		}
+		if j.OutputPath == j.InputPath {
+			return errors.New("outputPath must not overwrite the original")
+		}
+	case JobTypeConvert:
+		if len(j.Operations) > 0 {
+			return errors.New("operations are not valid for convert jobs")
+		}
+		if j.Convert == nil {
+			return errors.New("convert options are required")
 		}
+		if err := j.Convert.Validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid job type: %s", j.Type)
 	}
 
 	return nil
 }
-
-func (j *Job) MarshalJSON() ([]byte, error) {
-	type Alias Job
-	return json.Marshal(&struct {
-		*Alias
-	}{
-		Alias: (*Alias)(j),
-	})
-}
-
-func (j *Job) UnmarshalJSON(data []byte) error {
-	type Alias Job
-	aux := &struct {
-		*Alias
-	}{
-		Alias: (*Alias)(j),
-	}
-	return json.Unmarshal(data, &aux)
-}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Log field names shared with the zipping-worker and the server's JSON logs.
+const (
+	logKeyJobID      = "job_id"
+	logKeyOp         = "op"
+	logKeyWorkerID   = "worker_id"
+	logKeyUserID     = "user_id"
+	logKeyDurationMS = "duration_ms"
+	logKeyBytesIn    = "bytes_in"
+	logKeyBytesOut   = "bytes_out"
+	logKeyError      = "error"
+)
+
+// logLevel can be changed while the worker runs (see /loglevel).
+var logLevel = new(slog.LevelVar)
+
+// SetupLogging installs a slog handler writing format ("json" or "text") to
+// stdout as the default logger. Output from the standard log package is
+// routed through it as well.
+func SetupLogging(level, format string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want json or text)", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// componentLogger tags records with the subsystem that produced them.
+func componentLogger(component string) *slog.Logger {
+	return slog.Default().With("component", component)
+}
+
+// handleLogLevel reports the current level on GET and changes it on PUT with
+// a body such as "debug".
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := logLevel.UnmarshalText([]byte(strings.TrimSpace(string(body)))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Info("Log level changed", "level", logLevel.Level().String())
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprintln(w, logLevel.Level().String())
+}
+
+// fatal logs at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
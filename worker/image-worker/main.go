@@ -3,78 +3,161 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"sync"
 	"syscall"
+	"time"
+
+	"worker-common/storage"
 )
 
 var (
-	workerCount = flag.Int("workers", 5, "Number of CPU worker goroutines")
-	redisAddr   = flag.String("redis", "localhost:6379", "Redis address")
-	redisDB     = flag.Int("db", 0, "Redis database")
-	maxRetries  = flag.Int("max-retries", 3, "Maximum retry attempts per job")
-	dataDir     = flag.String("data-dir", "", "Data directory root (default: ../../data relative to executable)")
+	configPath     = flag.String("config", os.Getenv("IMAGE_CONFIG"), "YAML config file (env IMAGE_CONFIG)")
+	printConfig    = flag.Bool("print-config", false, "Print the effective configuration as YAML and exit")
+	reprocessStale = flag.Bool("reprocess-stale", false, "Regenerate derivatives built with outdated profiles under the data dir, then exit")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "process":
+			os.Exit(runProcess(os.Args[2:]))
+		case "backfill":
+			os.Exit(runBackfill(os.Args[2:]))
+		case "gc":
+			os.Exit(runGC(os.Args[2:]))
+		}
+	}
+
+	var cfg Config
+	cfg.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	// If data directory not specified, use default relative path
-	effectiveDataDir := *dataDir
-	if effectiveDataDir == "" {
-		execPath, err := os.Executable()
-		if err != nil {
-			log.Fatalf("Failed to get executable path: %v", err)
-		}
-		// Get the directory containing the executable
-		execDir := filepath.Dir(execPath)
-		// Go up two levels and into data folder
-		effectiveDataDir = filepath.Join(execDir, "..", "..", "data")
-		// Convert to absolute path
-		effectiveDataDir, err = filepath.Abs(effectiveDataDir)
-		if err != nil {
-			log.Fatalf("Failed to resolve data directory: %v", err)
-		}
+	if err := cfg.LoadConfig(flag.CommandLine, *configPath); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *printConfig {
+		fmt.Print(cfg.Redacted().YAML())
+		return
 	}
 
-	log.Printf("[MAIN] Starting Image Worker with %d CPU workers", *workerCount)
-	log.Printf("[MAIN] Redis: %s, DB: %d", *redisAddr, *redisDB)
-	log.Printf("[MAIN] Data Dir: %s, Max Retries: %d", effectiveDataDir, *maxRetries)
+	if err := SetupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	logger := componentLogger("main")
 
-	gpuDispatcher := NewGPUDispatcher()
-	defer gpuDispatcher.Close()
+	shutdownTracing, err := SetupTracing(context.Background(), "image-worker", cfg.OTLPEndpoint)
+	if err != nil {
+		fatal("Failed to set up tracing", logKeyError, err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Warn("Failed to flush traces", logKeyError, err)
+		}
+	}()
 
-	log.Println("[MAIN] GPU dispatcher initialized")
+	logger.Info("Starting Image Worker", "config", cfg)
 
-	redisClient := NewRedisClient(*redisAddr, *redisDB)
-	defer redisClient.Close()
+	lanes, _ := ParseLanes(cfg.LaneWeights)
+	logger.Info("Priority lanes", "lanes", fmt.Sprint(lanes))
+	background, _ := ParseBackground(cfg.Background)
 
-	log.Println("[MAIN] Redis client initialized")
+	gpuDispatcher := NewGPUDispatcher(DispatcherConfig{
+		Backend:          cfg.Backend,
+		Lanes:            cfg.DispatchLanes,
+		QueueSize:        cfg.DispatchQueue,
+		OperationTimeout: cfg.OperationTimeout,
+		Background:       background,
+	})
+	defer gpuDispatcher.Close()
 
-	pool := NewWorkerPool(*workerCount, redisClient, gpuDispatcher, *maxRetries, effectiveDataDir)
+	if *reprocessStale {
+		root := UploadsRoot(cfg.DataDir)
+		logger.Info("Reprocessing stale derivatives", "root", root)
+		regenerated, failed := ReprocessStale(context.Background(), gpuDispatcher, root)
+		logger.Info("Reprocessing complete", "regenerated", regenerated, "failed", failed)
+		return
+	}
 
+	redisClient := NewRedisClient(cfg.Redis)
+	defer redisClient.Close()
+	redisClient.SetRetention(Retention{
+		DoneMaxLen:     cfg.DoneMaxLen,
+		DoneMaxAge:     cfg.DoneMaxAge,
+		FailedMaxLen:   cfg.FailedMaxLen,
+		FailedMaxAge:   cfg.FailedMaxAge,
+		DailyStatsDays: cfg.DailyStatsDays,
+	})
+
+	logger.Info("Redis client initialized")
+
+	// Shutdown happens in two phases: cancel stops fetching, cancelJobs
+	// aborts whatever is still running once the grace period is over
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+
+	switch cfg.QueueTransport {
+	case QueueTransportList:
+	case QueueTransportStreams:
+		hostname, _ := os.Hostname()
+		consumer := fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		if err := redisClient.EnableStreams(ctx, cfg.StreamGroup, consumer, cfg.StreamClaimIdle, LaneQueues(lanes)...); err != nil {
+			fatal("Failed to enable stream transport", logKeyError, err)
+		}
+		logger.Info("Stream transport enabled", "group", cfg.StreamGroup, "consumer", consumer)
+		go redisClient.MonitorStreams(ctx, time.Minute, LaneQueues(lanes)...)
+	}
+
+	if cfg.MetricsAddr != "" {
+		RegisterDispatcherMetrics(gpuDispatcher)
+		RegisterQueueMetrics(redisClient, append(LaneQueues(lanes), QueueNameFailed, QueueNameDone)...)
+		go ServeStatus(cfg.MetricsAddr, NewHealthChecker(redisClient, gpuDispatcher, cfg.DataDir))
+	}
+
+	pool := NewWorkerPool(cfg.Workers, redisClient, gpuDispatcher, cfg.MaxRetries, cfg.DataDir, lanes)
+	if cfg.FairScheduling {
+		pool.EnableFairScheduling(cfg.UserBuffer, cfg.UserMaxActive)
+		logger.Info("Fair scheduling enabled", "user_buffer", cfg.UserBuffer, "user_max_active", cfg.UserMaxActive)
+	}
+	if cfg.S3.Endpoint != "" {
+		st, err := storage.New(cfg.S3)
+		if err != nil {
+			fatal("Failed to set up S3 storage", logKeyError, err)
+		}
+		pool.SetStorage(st)
+		logger.Info("S3 storage enabled", "endpoint", cfg.S3.Endpoint, "part_size", cfg.S3.PartSize)
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	var wg sync.WaitGroup
-
-	wg.Add(1)
+	stopped := make(chan struct{})
 	go func() {
-		defer wg.Done()
-		pool.Start(ctx)
+		defer close(stopped)
+		pool.Start(ctx, jobCtx)
 	}()
 
 	<-sigChan
-	log.Println("[MAIN] Shutdown signal received")
-
+	logger.Info("Shutdown signal received, draining in-flight jobs", "grace", cfg.ShutdownGrace.String())
 	cancel()
-	wg.Wait()
 
-	log.Println("[MAIN] Worker shutdown complete")
+	select {
+	case <-stopped:
+	case <-time.After(cfg.ShutdownGrace):
+		logger.Warn("Shutdown grace period expired, requeueing unfinished jobs")
+		cancelJobs()
+		<-stopped
+	case <-sigChan:
+		logger.Warn("Second signal received, requeueing unfinished jobs")
+		cancelJobs()
+		<-stopped
+	}
+
+	logger.Info("Worker shutdown complete")
 }
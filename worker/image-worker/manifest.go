@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"worker-common/storage"
+)
+
+// DerivativeManifest is written next to the derivatives as
+// <jobId>_manifest.json. It records which profile version built each file so
+// stale derivatives can be regenerated and the server can version its URLs.
+type DerivativeManifest struct {
+	JobID       string                      `json:"jobId"`
+	InputPath   string                      `json:"inputPath"`
+	SourceHash  string                      `json:"sourceHash"`
+	Derivatives map[string]DerivativeRecord `json:"derivatives"`
+	UpdatedAt   int64                       `json:"updatedAt"`
+}
+
+type DerivativeRecord struct {
+	File      string `json:"file"`
+	Version   string `json:"version"`
+	Size      int    `json:"size"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+func ManifestPath(outputDir, jobID string) string {
+	return storage.JoinURI(outputDir, fmt.Sprintf("%s_manifest.json", jobID))
+}
+
+// DerivativePath follows the server naming convention, jobId_name.ext:
+// job1_thumbnail.webp, job1_resize-1024x0-jpeg-q80.jpg.
+func DerivativePath(outputDir, jobID string, op Operation) string {
+	return storage.JoinURI(outputDir, fmt.Sprintf("%s_%s.%s", jobID, op.Name(), op.Ext()))
+}
+
+// parseDerivativeName reverses DerivativePath for a file name.
+func parseDerivativeName(name string) (jobID string, op Operation, ok bool) {
+	i := strings.LastIndex(name, "_")
+	if i <= 0 {
+		return "", Operation{}, false
+	}
+	opName, ext, found := strings.Cut(name[i+1:], ".")
+	if !found {
+		return "", Operation{}, false
+	}
+	op, ok = OperationByName(opName)
+	if !ok || op.Ext() != ext {
+		return "", Operation{}, false
+	}
+	return name[:i], op, true
+}
+
+// LoadManifest reads a manifest, returning nil without error if none exists.
+func LoadManifest(ctx context.Context, st storage.Storage, path string) (*DerivativeManifest, error) {
+	data, err := storage.ReadAll(ctx, st, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	manifest := &DerivativeManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", path, err)
+	}
+	if manifest.Derivatives == nil {
+		manifest.Derivatives = make(map[string]DerivativeRecord)
+	}
+	return manifest, nil
+}
+
+func NewManifest(jobID, inputPath, sourceHash string) *DerivativeManifest {
+	return &DerivativeManifest{
+		JobID:       jobID,
+		InputPath:   inputPath,
+		SourceHash:  sourceHash,
+		Derivatives: make(map[string]DerivativeRecord),
+	}
+}
+
+// Record stamps operation's derivative with the current profile version.
+func (m *DerivativeManifest) Record(operation, path string, size int) {
+	m.Derivatives[operation] = DerivativeRecord{
+		File:      filepath.Base(path),
+		Version:   ProfileVersion(operation),
+		Size:      size,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+}
+
+// Versions returns operation -> profile version, for cache-busting URLs.
+func (m *DerivativeManifest) Versions() map[string]string {
+	versions := make(map[string]string, len(m.Derivatives))
+	for op, record := range m.Derivatives {
+		versions[op] = record.Version
+	}
+	return versions
+}
+
+// StaleOperations lists recorded derivatives whose profile has since changed.
+func (m *DerivativeManifest) StaleOperations() []string {
+	var stale []string
+	for op, record := range m.Derivatives {
+		if record.Version != ProfileVersion(op) {
+			stale = append(stale, op)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+func (m *DerivativeManifest) Save(ctx context.Context, st storage.Storage, path string) error {
+	m.UpdatedAt = time.Now().UnixMilli()
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	return storage.WriteAll(ctx, st, path, data)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// jpegMetadata returns the EXIF data (a TIFF structure) and ICC profile of a
+// JPEG, or nil for what it lacks. An ICC profile split over several APP2
+// segments is joined.
+func jpegMetadata(data []byte) (exif, icc []byte) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // fill byte
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // metadata precedes the scan
+			break
+		}
+		length := int(data[i+2])<<8 | int(data[i+3])
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+
+		seg := data[i+4 : i+2+length]
+		switch {
+		case marker == 0xE1 && exif == nil && bytes.HasPrefix(seg, exifHeader):
+			exif = bytes.Clone(seg[len(exifHeader):])
+		case marker == 0xE2 && bytes.HasPrefix(seg, iccHeader) && len(seg) > len(iccHeader)+2:
+			// Chunks are numbered and, in practice, stored in order
+			icc = append(icc, seg[len(iccHeader)+2:]...)
+		}
+		i += 2 + length
+	}
+	return exif, icc
+}
+
+// resetOrientation marks EXIF data as upright (orientation 1), since images
+// are rotated according to it on decode.
+func resetOrientation(tiff []byte) {
+	if len(tiff) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return
+	}
+	for n, i := int(order.Uint16(tiff[ifd:])), 0; i < n; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			order.PutUint16(tiff[entry+8:], 1)
+			return
+		}
+	}
+}
+
+// copyMetadata carries the EXIF data and ICC profile of a JPEG source over
+// to an encoded JPEG or PNG. Other sources and formats are returned as is.
+func copyMetadata(src, encoded []byte, format string) []byte {
+	exif, icc := jpegMetadata(src)
+	if exif == nil && icc == nil {
+		return encoded
+	}
+	resetOrientation(exif)
+
+	switch format {
+	case "jpeg":
+		return insertJPEGMetadata(encoded, exif, icc)
+	case "png":
+		return insertPNGMetadata(encoded, exif, icc)
+	}
+	return encoded
+}
+
+// insertJPEGMetadata adds APP1 and APP2 segments after the SOI marker.
+func insertJPEGMetadata(jpeg, exif, icc []byte) []byte {
+	if len(jpeg) < 2 {
+		return jpeg
+	}
+
+	var out bytes.Buffer
+	out.Write(jpeg[:2])
+	if exif != nil && len(exifHeader)+len(exif) <= 0xFFFF-2 {
+		writeJPEGSegment(&out, 0xE1, exifHeader, exif)
+	}
+
+	// APP2 holds up to 65519 bytes of profile after its header and numbering
+	const chunk = 0xFFFF - 2 - 14
+	count := (len(icc) + chunk - 1) / chunk
+	for n := 0; n < count && count <= 255; n++ {
+		part := icc[n*chunk : min((n+1)*chunk, len(icc))]
+		writeJPEGSegment(&out, 0xE2, append(bytes.Clone(iccHeader), byte(n+1), byte(count)), part)
+	}
+
+	out.Write(jpeg[2:])
+	return out.Bytes()
+}
+
+func writeJPEGSegment(out *bytes.Buffer, marker byte, header, payload []byte) {
+	length := 2 + len(header) + len(payload)
+	out.Write([]byte{0xFF, marker, byte(length >> 8), byte(length)})
+	out.Write(header)
+	out.Write(payload)
+}
+
+// insertPNGMetadata adds eXIf and iCCP chunks after IHDR, which both must
+// precede the image data.
+func insertPNGMetadata(png, exif, icc []byte) []byte {
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4 // signature, IHDR length, type, data, CRC
+	if len(png) < ihdrEnd || string(png[12:16]) != "IHDR" {
+		return png
+	}
+
+	var out bytes.Buffer
+	out.Write(png[:ihdrEnd])
+	if exif != nil {
+		writePNGChunk(&out, "eXIf", exif)
+	}
+	if icc != nil {
+		var profile bytes.Buffer
+		profile.WriteString("ICC Profile\x00\x00") // name, compression method 0
+		zw := zlib.NewWriter(&profile)
+		zw.Write(icc)
+		zw.Close()
+		writePNGChunk(&out, "iCCP", profile.Bytes())
+	}
+	out.Write(png[ihdrEnd:])
+	return out.Bytes()
+}
+
+func writePNGChunk(out *bytes.Buffer, typ string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	out.Write(n[:])
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	out.WriteString(typ)
+	out.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	out.Write(n[:])
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	jobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_worker_jobs_total",
+		Help: "Jobs handled, by type (derivatives, edit, convert) and result (completed, retried, failed, requeued).",
+	}, []string{"type", "result"})
+
+	operationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_worker_operations_total",
+		Help: "Image operations, by operation and result (processed, failed, reused).",
+	}, []string{"operation", "result"})
+
+	operationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_worker_operation_duration_seconds",
+		Help:    "Time spent executing an image operation in the dispatcher.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"operation"})
+
+	bytesInTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_worker_bytes_in_total",
+		Help: "Input image bytes fed to operations.",
+	}, []string{"operation"})
+
+	bytesOutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_worker_bytes_out_total",
+		Help: "Derivative bytes produced by operations.",
+	}, []string{"operation"})
+
+	backendInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_worker_backend_info",
+		Help: "Active image processing backend (value is always 1).",
+	}, []string{"backend"})
+)
+
+// RegisterDispatcherMetrics exposes the dispatcher's queue depth and
+// active backend.
+func RegisterDispatcherMetrics(gd *GPUDispatcher) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "image_worker_dispatcher_queue_depth",
+		Help: "Operations waiting in the dispatcher queue.",
+	}, func() float64 {
+		return float64(len(gd.operationQueue))
+	})
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "image_worker_dispatcher_lanes",
+		Help: "Dispatcher lanes executing operations in parallel.",
+	}, func() float64 {
+		return float64(gd.Lanes())
+	})
+
+	backendInfo.WithLabelValues(gd.Backend()).Set(1)
+}
+
+// queueCollector reports Redis queue lengths at scrape time.
+type queueCollector struct {
+	redisClient *RedisClient
+	queueNames  []string
+	length      *prometheus.Desc
+	pending     *prometheus.Desc
+}
+
+// RegisterQueueMetrics exposes the lengths of queueNames and, when the
+// streams transport is enabled, their pending-entry counts.
+func RegisterQueueMetrics(rc *RedisClient, queueNames ...string) {
+	prometheus.MustRegister(&queueCollector{
+		redisClient: rc,
+		queueNames:  queueNames,
+		length: prometheus.NewDesc("image_worker_queue_length",
+			"Jobs waiting in a Redis queue (list plus the stream group's lag and pending entries when streams are enabled).", []string{"queue"}, nil),
+		pending: prometheus.NewDesc("image_worker_stream_pending",
+			"Stream entries delivered but not yet acknowledged.", []string{"queue"}, nil),
+	})
+}
+
+func (qc *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- qc.length
+	ch <- qc.pending
+}
+
+func (qc *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, queueName := range qc.queueNames {
+		length, err := qc.redisClient.QueueLength(ctx, queueName)
+		if err != nil {
+			slog.Warn("Failed to read queue length", "component", "metrics", "queue", queueName, logKeyError, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(qc.length, prometheus.GaugeValue, float64(length), queueName)
+
+		if qc.redisClient.streams == nil {
+			continue
+		}
+		pending, err := qc.redisClient.streams.Pending(ctx, queueName)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(qc.pending, prometheus.GaugeValue, float64(pending.Count), queueName)
+	}
+}
+
+// ServeStatus serves /metrics, /healthz, /readyz and /loglevel on addr until
+// the process exits.
+func ServeStatus(addr string, hc *HealthChecker) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", hc.handleLive)
+	mux.HandleFunc("/readyz", hc.handleReady)
+	mux.HandleFunc("/loglevel", handleLogLevel)
+
+	logger := componentLogger("metrics")
+	logger.Info("Serving /metrics, /healthz, /readyz and /loglevel", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("Server stopped", logKeyError, err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Operation is one derivative a job asks for. Presets are sent as bare
+// names, parameterized operations as objects:
+//
+//	"thumbnail"
+//	{"op":"resize","maxWidth":1024,"format":"jpeg","quality":80}
+type Operation struct {
+	Op        string `json:"op"`
+	MaxWidth  int    `json:"maxWidth,omitempty"`
+	MaxHeight int    `json:"maxHeight,omitempty"`
+	Format    string `json:"format,omitempty"`
+	Quality   int    `json:"quality,omitempty"`
+
+	// Why the operation could not be decoded, reported by Validate.
+	decodeErr error
+}
+
+// OpResize fits the image into MaxWidth x MaxHeight, never upscaling, and
+// encodes it as Format.
+const OpResize = "resize"
+
+// Limits and defaults of the resize operation.
+const (
+	ResizeMaxDimension   = 4096
+	ResizeDefaultFormat  = "webp"
+	ResizeDefaultQuality = 80
+)
+
+// outputExtensions maps each output format to its file extension.
+var outputExtensions = map[string]string{
+	"webp": "webp",
+	"jpeg": "jpg",
+	"png":  "png",
+}
+
+// PresetOperations turns preset names into operations.
+func PresetOperations(names []string) []Operation {
+	ops := make([]Operation, len(names))
+	for i, name := range names {
+		ops[i] = Operation{Op: name}
+	}
+	return ops
+}
+
+// OperationNames returns the derivative name of each operation.
+func OperationNames(ops []Operation) []string {
+	names := make([]string, len(ops))
+	for i, op := range ops {
+		names[i] = op.Name()
+	}
+	return names
+}
+
+func (o Operation) isPreset() bool {
+	_, ok := operationProfiles[o.Op]
+	return ok
+}
+
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*o = Operation{Op: name}
+		return nil
+	}
+
+	// Problems are kept on the operation rather than returned, so the job
+	// still decodes and is failed with the reason
+	if len(bytes.TrimSpace(data)) == 0 || bytes.TrimSpace(data)[0] != '{' {
+		*o = Operation{decodeErr: fmt.Errorf("operation must be a name or an object, got %s", data)}
+		return nil
+	}
+	type plain Operation
+	var p plain
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		*o = Operation{decodeErr: fmt.Errorf("invalid operation %s: %v", data, err)}
+		return nil
+	}
+	*o = Operation(p)
+	return nil
+}
+
+// MarshalJSON writes presets as bare names, the form every producer and
+// older worker understands.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	if o.isPreset() && o == (Operation{Op: o.Op}) {
+		return json.Marshal(o.Op)
+	}
+	type plain Operation
+	return json.Marshal(plain(o))
+}
+
+func (o Operation) format() string {
+	if o.Format == "" {
+		return ResizeDefaultFormat
+	}
+	return o.Format
+}
+
+// quality is the encoder quality, 0 for lossless formats.
+func (o Operation) quality() int {
+	switch {
+	case o.format() == "png":
+		return 0
+	case o.Quality == 0:
+		return ResizeDefaultQuality
+	}
+	return o.Quality
+}
+
+// Validate checks a parameterized operation against its limits. Presets
+// take no parameters.
+func (o Operation) Validate() error {
+	if o.decodeErr != nil {
+		return o.decodeErr
+	}
+	if o.isPreset() {
+		if o != (Operation{Op: o.Op}) {
+			return fmt.Errorf("%s takes no parameters", o.Op)
+		}
+		return nil
+	}
+	if o.Op != OpResize {
+		return fmt.Errorf("invalid operation: %s", o.Op)
+	}
+
+	var errs []error
+	if o.MaxWidth == 0 && o.MaxHeight == 0 {
+		errs = append(errs, errors.New("resize needs maxWidth or maxHeight"))
+	}
+	if o.MaxWidth < 0 || o.MaxWidth > ResizeMaxDimension {
+		errs = append(errs, fmt.Errorf("resize maxWidth must be between 0 (unbounded) and %d, got %d", ResizeMaxDimension, o.MaxWidth))
+	}
+	if o.MaxHeight < 0 || o.MaxHeight > ResizeMaxDimension {
+		errs = append(errs, fmt.Errorf("resize maxHeight must be between 0 (unbounded) and %d, got %d", ResizeMaxDimension, o.MaxHeight))
+	}
+	if _, ok := outputExtensions[o.format()]; !ok {
+		errs = append(errs, fmt.Errorf("unknown resize format %q (want webp, jpeg or png)", o.Format))
+	}
+	if o.format() == "png" && o.Quality != 0 {
+		errs = append(errs, errors.New("png is lossless and takes no quality"))
+	}
+	if o.Quality < 0 || o.Quality > 100 {
+		errs = append(errs, fmt.Errorf("resize quality must be between 0 (default) and 100, got %d", o.Quality))
+	}
+	return errors.Join(errs...)
+}
+
+// Name identifies the derivative. Presets use their name; parameterized
+// operations spell out every parameter, defaults included, so equal requests
+// share a name, and with it an output file, a cache entry and a manifest
+// record: {"op":"resize","maxWidth":1024} is "resize-1024x0-webp-q80".
+func (o Operation) Name() string {
+	if o.Op != OpResize {
+		return o.Op
+	}
+	name := fmt.Sprintf("%s-%dx%d-%s", o.Op, o.MaxWidth, o.MaxHeight, o.format())
+	if q := o.quality(); q != 0 {
+		name += fmt.Sprintf("-q%d", q)
+	}
+	return name
+}
+
+// Ext is the derivative's file extension.
+func (o Operation) Ext() string {
+	if o.Op != OpResize {
+		return "webp"
+	}
+	return outputExtensions[o.format()]
+}
+
+// Profile returns the parameters the derivative is built with.
+func (o Operation) Profile() OperationProfile {
+	if profile, ok := operationProfiles[o.Op]; ok {
+		return profile
+	}
+	return OperationProfile{
+		Name:      o.Name(),
+		MaxWidth:  o.MaxWidth,
+		MaxHeight: o.MaxHeight,
+		Quality:   o.quality(),
+		Format:    o.format(),
+	}
+}
+
+var resizeNameRE = regexp.MustCompile(`^resize-(\d+)x(\d+)-(webp|jpeg|png)(?:-q(\d+))?$`)
+
+// OperationByName returns the operation a derivative name stands for, so
+// recorded derivatives can be rebuilt. It reports false for names no valid
+// operation produces.
+func OperationByName(name string) (Operation, bool) {
+	if _, ok := operationProfiles[name]; ok {
+		return Operation{Op: name}, true
+	}
+
+	m := resizeNameRE.FindStringSubmatch(name)
+	if m == nil {
+		return Operation{}, false
+	}
+	op := Operation{Op: OpResize, Format: m[3]}
+	op.MaxWidth, _ = strconv.Atoi(m[1])
+	op.MaxHeight, _ = strconv.Atoi(m[2])
+	if m[4] != "" {
+		op.Quality, _ = strconv.Atoi(m[4])
+	}
+	if op.Validate() != nil || op.Name() != name {
+		return Operation{}, false
+	}
+	return op, true
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestOperationUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    Operation
+		wantErr string // Substring of the Validate error, "" for valid
+	}{
+		{"preset name", `"thumbnail"`, Operation{Op: "thumbnail"}, ""},
+		{"preset object", `{"op":"blur"}`, Operation{Op: "blur"}, ""},
+		{"resize", `{"op":"resize","maxWidth":1024,"format":"jpeg","quality":80}`, Operation{Op: OpResize, MaxWidth: 1024, Format: "jpeg", Quality: 80}, ""},
+		{"resize height only", `{"op":"resize","maxHeight":300}`, Operation{Op: OpResize, MaxHeight: 300}, ""},
+		{"unknown name", `"sharpen"`, Operation{Op: "sharpen"}, "invalid operation: sharpen"},
+		{"preset with parameters", `{"op":"thumbnail","maxWidth":10}`, Operation{Op: "thumbnail", MaxWidth: 10}, "thumbnail takes no parameters"},
+		{"resize without bounds", `{"op":"resize"}`, Operation{Op: OpResize}, "needs maxWidth or maxHeight"},
+		{"resize too wide", `{"op":"resize","maxWidth":5000}`, Operation{Op: OpResize, MaxWidth: 5000}, "maxWidth must be between 0 (unbounded) and 4096, got 5000"},
+		{"resize negative", `{"op":"resize","maxHeight":-1}`, Operation{Op: OpResize, MaxHeight: -1}, "maxHeight must be between"},
+		{"resize unknown format", `{"op":"resize","maxWidth":10,"format":"gif"}`, Operation{Op: OpResize, MaxWidth: 10, Format: "gif"}, `unknown resize format "gif"`},
+		{"png with quality", `{"op":"resize","maxWidth":10,"format":"png","quality":50}`, Operation{Op: OpResize, MaxWidth: 10, Format: "png", Quality: 50}, "png is lossless"},
+		{"quality out of range", `{"op":"resize","maxWidth":10,"quality":101}`, Operation{Op: OpResize, MaxWidth: 10, Quality: 101}, "quality must be between"},
+		{"unknown field", `{"op":"resize","maxWidth":10,"width":5}`, Operation{}, "unknown field"},
+		{"wrong type", `42`, Operation{}, "must be a name or an object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var op Operation
+			if err := json.Unmarshal([]byte(tt.json), &op); err != nil {
+				t.Fatalf("Unmarshal(%s): %v", tt.json, err)
+			}
+
+			err := op.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate = %v, want error containing %q", err, tt.wantErr)
+			}
+
+			op.decodeErr = nil
+			if op != tt.want {
+				t.Errorf("decoded %+v, want %+v", op, tt.want)
+			}
+		})
+	}
+}
+
+func TestOperationMarshal(t *testing.T) {
+	tests := []struct {
+		op   Operation
+		want string
+	}{
+		{Operation{Op: "thumbnail"}, `"thumbnail"`},
+		{Operation{Op: "low-quality"}, `"low-quality"`},
+		{Operation{Op: OpResize, MaxWidth: 1024}, `{"op":"resize","maxWidth":1024}`},
+		{Operation{Op: OpResize, MaxHeight: 64, Format: "png"}, `{"op":"resize","maxHeight":64,"format":"png"}`},
+	}
+
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.op)
+		if err != nil {
+			t.Fatalf("Marshal(%+v): %v", tt.op, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Marshal(%+v) = %s, want %s", tt.op, got, tt.want)
+		}
+	}
+}
+
+func TestOperationNameRoundTrip(t *testing.T) {
+	tests := []struct {
+		op   Operation
+		name string
+	}{
+		{Operation{Op: "thumbnail"}, "thumbnail"},
+		{Operation{Op: "blur"}, "blur"},
+		{Operation{Op: "low-quality"}, "low-quality"},
+		{Operation{Op: OpResize, MaxWidth: 1024}, "resize-1024x0-webp-q80"},
+		{Operation{Op: OpResize, MaxWidth: 1024, Format: "jpeg", Quality: 80}, "resize-1024x0-jpeg-q80"},
+		{Operation{Op: OpResize, MaxHeight: 300, Format: "png"}, "resize-0x300-png"},
+		{Operation{Op: OpResize, MaxWidth: 4096, MaxHeight: 4096, Quality: 1}, "resize-4096x4096-webp-q1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.op.Name(); got != tt.name {
+				t.Fatalf("Name() = %q, want %q", got, tt.name)
+			}
+
+			op, ok := OperationByName(tt.name)
+			if !ok {
+				t.Fatalf("OperationByName(%q) not found", tt.name)
+			}
+			// Defaults come back spelled out, so compare what they build
+			if op.Name() != tt.name || op.Profile() != tt.op.Profile() || op.Ext() != tt.op.Ext() {
+				t.Errorf("OperationByName(%q) = %+v, want the equivalent of %+v", tt.name, op, tt.op)
+			}
+		})
+	}
+}
+
+func TestOperationByNameRejects(t *testing.T) {
+	for _, name := range []string{
+		"",
+		"sharpen",
+		"resize",
+		"resize-1024x0-webp",      // Lossy names always carry the quality
+		"resize-1024x0-png-q80",   // png takes no quality
+		"resize-5000x0-webp-q80",  // Beyond the limits
+		"resize-0x0-webp-q80",     // Unbounded on both sides
+		"resize-1024x0-gif-q80",   // Unknown format
+		"resize-01024x0-webp-q80", // Not how Name spells it
+		"resize-1024x0-webp-q0",
+	} {
+		if op, ok := OperationByName(name); ok {
+			t.Errorf("OperationByName(%q) = %+v, want not found", name, op)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityBulk   = "bulk"
+
+	QueueNameJobsHigh = "image:jobs:high"
+	QueueNameJobsBulk = "image:jobs:bulk"
+
+	DefaultLaneWeights = "high=8,normal=4,retry=2,bulk=1"
+)
+
+// Lane is one queue the worker pool drains, with its share of fetch turns.
+type Lane struct {
+	Name   string
+	Queue  string
+	Weight int
+}
+
+var laneQueues = map[string]string{
+	PriorityHigh:   QueueNameJobsHigh,
+	PriorityNormal: QueueNameJobs,
+	"retry":        QueueNameRetry,
+	PriorityBulk:   QueueNameJobsBulk,
+}
+
+// QueueForPriority maps a job priority to the list producers push it onto.
+// An empty priority is treated as normal.
+func QueueForPriority(priority string) string {
+	if priority == "" {
+		return QueueNameJobs
+	}
+	return laneQueues[priority]
+}
+
+// ParseLanes parses a "name=weight,..." spec. Every lane must be listed so no
+// queue is silently left undrained.
+func ParseLanes(spec string) ([]Lane, error) {
+	weights := make(map[string]int)
+	for _, part := range strings.Split(spec, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid lane weight %q (want name=weight)", part)
+		}
+		if _, known := laneQueues[name]; !known {
+			return nil, fmt.Errorf("unknown lane %q", name)
+		}
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid weight for lane %s: %q", name, value)
+		}
+		weights[name] = weight
+	}
+
+	lanes := make([]Lane, 0, len(laneQueues))
+	for name, queue := range laneQueues {
+		weight, ok := weights[name]
+		if !ok {
+			return nil, fmt.Errorf("missing weight for lane %s", name)
+		}
+		lanes = append(lanes, Lane{Name: name, Queue: queue, Weight: weight})
+	}
+
+	sort.SliceStable(lanes, func(i, j int) bool {
+		if lanes[i].Weight != lanes[j].Weight {
+			return lanes[i].Weight > lanes[j].Weight
+		}
+		return lanes[i].Name < lanes[j].Name
+	})
+
+	return lanes, nil
+}
+
+// laneScheduler produces the queue order for each fetch using smooth weighted
+// round-robin. The chosen lane goes first and the rest follow by weight, so a
+// blocking pop over the whole list takes high-priority work whenever there is
+// some, while every lane still leads in proportion to its weight and bulk
+// work cannot starve. Each worker owns its scheduler.
+type laneScheduler struct {
+	lanes   []Lane
+	current []int
+	total   int
+}
+
+func newLaneScheduler(lanes []Lane) *laneScheduler {
+	ls := &laneScheduler{
+		lanes:   lanes,
+		current: make([]int, len(lanes)),
+	}
+	for _, lane := range lanes {
+		ls.total += lane.Weight
+	}
+	return ls
+}
+
+// Next returns the queue names to fetch from, in preference order.
+func (ls *laneScheduler) Next() []string {
+	best := 0
+	for i, lane := range ls.lanes {
+		ls.current[i] += lane.Weight
+		if ls.current[i] > ls.current[best] {
+			best = i
+		}
+	}
+	ls.current[best] -= ls.total
+
+	queues := make([]string, 0, len(ls.lanes))
+	queues = append(queues, ls.lanes[best].Queue)
+	for i, lane := range ls.lanes {
+		if i != best {
+			queues = append(queues, lane.Queue)
+		}
+	}
+	return queues
+}
+
+// LaneQueues returns the queue names of all lanes.
+func LaneQueues(lanes []Lane) []string {
+	queues := make([]string, len(lanes))
+	for i, lane := range lanes {
+		queues[i] = lane.Queue
+	}
+	return queues
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLanes(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []string // Lane names in order, nil when an error is expected
+		wantErr string
+	}{
+		{"default", DefaultLaneWeights, []string{"high", "normal", "retry", "bulk"}, ""},
+		{"reordered", "bulk=1,retry=2,normal=4,high=8", []string{"high", "normal", "retry", "bulk"}, ""},
+		{"spaces", " high=8 , normal=4,retry=2 ,bulk=1", []string{"high", "normal", "retry", "bulk"}, ""},
+		{"ties by name", "high=1,normal=1,retry=1,bulk=1", []string{"bulk", "high", "normal", "retry"}, ""},
+		{"bulk first", "high=1,normal=2,retry=3,bulk=9", []string{"bulk", "retry", "normal", "high"}, ""},
+		{"missing lane", "high=8,normal=4,retry=2", nil, "missing weight for lane bulk"},
+		{"unknown lane", "high=8,normal=4,retry=2,bulk=1,urgent=16", nil, `unknown lane "urgent"`},
+		{"no weight", "high,normal=4,retry=2,bulk=1", nil, "want name=weight"},
+		{"zero weight", "high=0,normal=4,retry=2,bulk=1", nil, `invalid weight for lane high: "0"`},
+		{"not a number", "high=8,normal=four,retry=2,bulk=1", nil, `invalid weight for lane normal: "four"`},
+		{"empty", "", nil, "want name=weight"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lanes, err := ParseLanes(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseLanes(%q) = %v, want error containing %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLanes(%q): %v", tt.spec, err)
+			}
+
+			names := make([]string, len(lanes))
+			for i, lane := range lanes {
+				names[i] = lane.Name
+				if lane.Queue != laneQueues[lane.Name] {
+					t.Errorf("lane %s has queue %s, want %s", lane.Name, lane.Queue, laneQueues[lane.Name])
+				}
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("ParseLanes(%q) order = %v, want %v", tt.spec, names, tt.want)
+			}
+		})
+	}
+}
+
+func TestLaneSchedulerShares(t *testing.T) {
+	lanes, err := ParseLanes(DefaultLaneWeights)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := newLaneScheduler(lanes)
+
+	// One full cycle of smooth weighted round-robin leads with each lane
+	// exactly its weight times.
+	led := make(map[string]int)
+	for i := 0; i < ls.total; i++ {
+		queues := ls.Next()
+		if len(queues) != len(lanes) {
+			t.Fatalf("Next returned %d queues, want %d", len(queues), len(lanes))
+		}
+		led[queues[0]]++
+
+		// The rest follow in weight order
+		rest := make([]string, 0, len(lanes)-1)
+		for _, lane := range lanes {
+			if lane.Queue != queues[0] {
+				rest = append(rest, lane.Queue)
+			}
+		}
+		if !reflect.DeepEqual(queues[1:], rest) {
+			t.Errorf("Next = %v, want %s followed by %v", queues, queues[0], rest)
+		}
+	}
+
+	for _, lane := range lanes {
+		if led[lane.Queue] != lane.Weight {
+			t.Errorf("lane %s led %d of %d fetches, want %d", lane.Name, led[lane.Queue], ls.total, lane.Weight)
+		}
+	}
+}
+
+func TestQueueForPriority(t *testing.T) {
+	tests := map[string]string{
+		"":             QueueNameJobs,
+		PriorityNormal: QueueNameJobs,
+		PriorityHigh:   QueueNameJobsHigh,
+		PriorityBulk:   QueueNameJobsBulk,
+	}
+	for priority, want := range tests {
+		if got := QueueForPriority(priority); got != want {
+			t.Errorf("QueueForPriority(%q) = %s, want %s", priority, got, want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runProcess implements the "process" subcommand: run the processing
+// pipeline on local files without Redis and report what it produced.
+//
+//	image-worker process -in photo.jpg -out ./out -ops thumbnail,blur
+//	image-worker process -in ./photos -out ./out
+//
+// A directory is walked recursively and its layout is mirrored under -out.
+// It returns the process exit code.
+func runProcess(args []string) int {
+	fset := flag.NewFlagSet("process", flag.ContinueOnError)
+	in := fset.String("in", "", "Image file, or directory to walk recursively")
+	out := fset.String("out", "", "Directory derivatives are written to")
+	ops := fset.String("ops", "thumbnail,blur,low-quality", "Comma-separated operations to run, presets or resize names such as resize-1024x0-jpeg-q80")
+	backend := fset.String("backend", BackendCPU, "Processing backend: cpu or cuda")
+	lanes := fset.Int("dispatch-lanes", 0, "Operations executed in parallel (0 = GOMAXPROCS)")
+	timeout := fset.Duration("operation-timeout", 30*time.Second, "Maximum time for a single image operation")
+	bg := fset.String("background", DefaultBackground, "Color transparent images are flattened onto for JPEG output, as #rrggbb")
+	logLevel := fset.String("log-level", "warn", "Log level: debug, info, warn or error")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+
+	if *in == "" || *out == "" {
+		fmt.Fprintln(os.Stderr, "process: -in and -out are required")
+		fset.Usage()
+		return 2
+	}
+	var operations []Operation
+	for _, name := range strings.Split(*ops, ",") {
+		op, ok := OperationByName(name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "process: unknown operation %q\n", name)
+			return 2
+		}
+		operations = append(operations, op)
+	}
+	background, err := ParseBackground(*bg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "process: -background: %v\n", err)
+		return 2
+	}
+	if err := SetupLogging(*logLevel, "text"); err != nil {
+		fmt.Fprintf(os.Stderr, "process: %v\n", err)
+		return 2
+	}
+
+	gd := NewGPUDispatcher(DispatcherConfig{
+		Backend:          *backend,
+		Lanes:            *lanes,
+		QueueSize:        100,
+		OperationTimeout: *timeout,
+		Background:       background,
+	})
+	defer gd.Close()
+
+	info, err := os.Stat(*in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "process: %v\n", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	if !info.IsDir() {
+		if !processFile(ctx, w, gd, *in, *out, operations) {
+			return 1
+		}
+		return 0
+	}
+
+	// Derivatives are images themselves, so never walk into -out
+	outAbs, _ := filepath.Abs(*out)
+	failed := 0
+	err = filepath.WalkDir(*in, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if abs, _ := filepath.Abs(path); d.IsDir() && abs == outAbs {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !imageExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		rel, err := filepath.Rel(*in, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if !processFile(ctx, w, gd, path, filepath.Join(*out, rel), operations) {
+			failed++
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "process: %v\n", err)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// processFile runs operations on one image, writes the derivatives to
+// outputDir and prints a report. It reports whether every operation worked.
+func processFile(ctx context.Context, w *tabwriter.Writer, gd *GPUDispatcher, path, outputDir string, operations []Operation) bool {
+	defer w.Flush()
+
+	input, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(w, "%s\terror: %v\n", path, err)
+		return false
+	}
+	fmt.Fprintf(w, "%s\t%s\t%s\t\t\n", path, dimensions(input), formatSize(len(input)))
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		fmt.Fprintf(w, "\terror: %v\n", err)
+		return false
+	}
+
+	jobID := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	sizes := make(map[string]int)
+	ok := true
+
+	for _, operation := range operations {
+		op := operation.Name()
+		start := time.Now()
+		result, err := gd.ProcessImage(ctx, input, operation, jobID)
+		if err != nil {
+			fmt.Fprintf(w, "  %s\terror: %v\t\t\t\n", op, err)
+			ok = false
+			continue
+		}
+
+		outputPath := DerivativePath(outputDir, jobID, operation)
+		if err := writeFileAtomic(outputPath, result.Data, 0644); err != nil {
+			fmt.Fprintf(w, "  %s\terror: %v\t\t\t\n", op, err)
+			ok = false
+			continue
+		}
+
+		sizes[op] = len(result.Data)
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%.1f%%\t%s  %dms\n",
+			op,
+			dimensions(result.Data),
+			formatSize(len(result.Data)),
+			float64(len(result.Data))/float64(len(input))*100,
+			outputPath,
+			time.Since(start).Milliseconds())
+	}
+
+	thumbnail, hasThumb := sizes["thumbnail"]
+	blur, hasBlur := sizes["blur"]
+	lowQuality, hasLQ := sizes["low-quality"]
+	switch {
+	case !hasThumb || !hasBlur || !hasLQ:
+		fmt.Fprintf(w, "  quality order\tskipped (needs thumbnail, blur and low-quality)\t\t\t\n")
+	case ValidateQualityOrder(thumbnail, blur, lowQuality, len(input)):
+		fmt.Fprintf(w, "  quality order\tok\t\t\t\n")
+	default:
+		fmt.Fprintf(w, "  quality order\tviolated\t\t\t\n")
+	}
+
+	return ok
+}
+
+// dimensions reads the pixel size from an encoded image's header.
+func dimensions(data []byte) string {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "?"
+	}
+	return fmt.Sprintf("%dx%d", cfg.Width, cfg.Height)
+}
+
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
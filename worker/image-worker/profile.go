@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// OperationProfile holds every parameter that affects a derivative's pixels
+// or encoding. Changing any field changes Version, which marks derivatives
+// built with the old values as stale.
+type OperationProfile struct {
+	Name      string
+	MaxSize   int // Maximum width/height in pixels
+	MaxWidth  int // Resize bounds, 0 for unbounded
+	MaxHeight int
+	Blur      float64 // Gaussian blur sigma, 0 for none
+	Quality   int     // Encoder quality, 0 for lossless formats
+	Format    string  // webp, jpeg or png
+}
+
+// Quality ordering: thumbnail < blur < low-quality < original
+var operationProfiles = map[string]OperationProfile{
+	"thumbnail":   {Name: "thumbnail", MaxSize: 48, Quality: 20, Format: "webp"},
+	"blur":        {Name: "blur", MaxSize: 192, Blur: 3.0, Quality: 40, Format: "webp"},
+	"low-quality": {Name: "low-quality", MaxSize: 384, Quality: 60, Format: "webp"},
+}
+
+// DefaultOperations are the derivatives the server requests for an upload.
+var DefaultOperations = []string{"thumbnail", "blur", "low-quality"}
+
+// Version is a short hash of the profile parameters. It is recorded in the
+// manifest and cache so outdated derivatives can be found and regenerated.
+// Resize bounds are left out because the name already spells them out.
+func (p OperationProfile) Version() string {
+	params := fmt.Sprintf("%s|%d|%g|%d|%s", p.Name, p.MaxSize, p.Blur, p.Quality, p.Format)
+	sum := sha256.Sum256([]byte(params))
+	return hex.EncodeToString(sum[:4])
+}
+
+// ProfileVersion returns the current version for a derivative name, or "" if
+// no operation produces that name.
+func ProfileVersion(name string) string {
+	op, ok := OperationByName(name)
+	if !ok {
+		return ""
+	}
+	return op.Profile().Version()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"worker-common/redisstream"
+)
+
+const (
+	QueueTransportList    = "list"
+	QueueTransportStreams = "streams"
+
+	streamJobField = "job"
+)
+
+// ErrFetchTimeout is returned by JobQueue.Fetch when no job arrived within
+// RedisFetchTimeout.
+var ErrFetchTimeout = errors.New("timeout")
+
+// JobQueue abstracts how jobs are taken from and handed back to Redis so the
+// worker loop does not depend on whether producers use lists or streams.
+type JobQueue interface {
+	// Fetch blocks until a job is available on any of queueNames. When
+	// several have work, earlier names win.
+	Fetch(ctx context.Context, queueNames ...string) (*Job, error)
+	Push(ctx context.Context, queueName string, job *Job) error
+	// Ack marks the delivery a job came from as handled. It is a no-op for
+	// transports without delivery tracking.
+	Ack(ctx context.Context, job *Job) error
+}
+
+// StreamKey returns the stream that carries jobs for a list queue name.
+func StreamKey(queueName string) string {
+	return queueName + ":stream"
+}
+
+// keyspace prefixes every Redis key and channel the worker uses, so several
+// deployments can share one database. Queue names stay unprefixed in code.
+type keyspace string
+
+func (ks keyspace) key(name string) string {
+	return string(ks) + name
+}
+
+func (ks keyspace) name(key string) string {
+	return strings.TrimPrefix(key, string(ks))
+}
+
+type listQueue struct {
+	client *redis.Client
+	keys   keyspace
+}
+
+func (lq *listQueue) Fetch(ctx context.Context, queueNames ...string) (*Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, RedisFetchTimeout)
+	defer cancel()
+
+	keys := make([]string, len(queueNames))
+	for i, queueName := range queueNames {
+		keys[i] = lq.keys.key(queueName)
+	}
+
+	results, err := lq.client.BRPop(ctx, RedisFetchTimeout, keys...).Result()
+	if err != nil {
+		if err == redis.Nil || errors.Is(err, context.DeadlineExceeded) {
+			return nil, ErrFetchTimeout
+		}
+		return nil, err
+	}
+
+	if len(results) < 2 {
+		return nil, errors.New("invalid brpop result")
+	}
+
+	return decodeJob(lq.keys.name(results[0]), results[1])
+}
+
+// pop is a non-blocking Fetch. It returns a nil job when the list is empty.
+func (lq *listQueue) pop(ctx context.Context, queueName string) (*Job, error) {
+	jobJSON, err := lq.client.RPop(ctx, lq.keys.key(queueName)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return decodeJob(queueName, jobJSON)
+}
+
+func (lq *listQueue) Push(ctx context.Context, queueName string, job *Job) error {
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %v", err)
+	}
+
+	if err := lq.client.LPush(ctx, lq.keys.key(queueName), string(jobJSON)).Err(); err != nil {
+		return fmt.Errorf("failed to push to queue %s: %v", queueName, err)
+	}
+
+	return nil
+}
+
+func (lq *listQueue) Ack(ctx context.Context, job *Job) error {
+	return nil
+}
+
+// streamQueue consumes jobs through a consumer group so every delivery is
+// tracked until acknowledged. Messages left pending by a consumer that died
+// mid-job are reclaimed once they have been idle for claimIdle. While
+// producers migrate, the legacy lists of the same names are drained before
+// blocking on the streams.
+type streamQueue struct {
+	client   *redis.Client
+	keys     keyspace
+	legacy   *listQueue
+	group    string
+	consumer string
+	claimer  *redisstream.Claimer
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	buffered []*Job
+}
+
+func newStreamQueue(ctx context.Context, client *redis.Client, keys keyspace, group, consumer string, claimIdle time.Duration, queueNames ...string) (*streamQueue, error) {
+	sq := &streamQueue{
+		client:   client,
+		keys:     keys,
+		legacy:   &listQueue{client: client, keys: keys},
+		group:    group,
+		consumer: consumer,
+		claimer: &redisstream.Claimer{
+			Client:   client,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  claimIdle,
+		},
+		logger: componentLogger("stream"),
+	}
+
+	if err := redisstream.CreateGroups(ctx, client, group, sq.streams(queueNames)...); err != nil {
+		return nil, err
+	}
+
+	return sq, nil
+}
+
+// streams returns the stream keys behind queueNames.
+func (sq *streamQueue) streams(queueNames []string) []string {
+	streams := make([]string, len(queueNames))
+	for i, queueName := range queueNames {
+		streams[i] = sq.keys.key(StreamKey(queueName))
+	}
+	return streams
+}
+
+func (sq *streamQueue) Fetch(ctx context.Context, queueNames ...string) (*Job, error) {
+	if job := sq.takeBuffered(queueNames); job != nil {
+		return job, nil
+	}
+
+	if job, err := sq.reclaim(ctx, queueNames); err != nil || job != nil {
+		return job, err
+	}
+
+	for _, queueName := range queueNames {
+		job, err := sq.legacy.pop(ctx, queueName)
+		if err != nil || job != nil {
+			return job, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RedisFetchTimeout)
+	defer cancel()
+
+	args := make([]string, 0, 2*len(queueNames))
+	for _, queueName := range queueNames {
+		args = append(args, sq.keys.key(StreamKey(queueName)))
+	}
+	for range queueNames {
+		args = append(args, ">")
+	}
+
+	streams, err := sq.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    sq.group,
+		Consumer: sq.consumer,
+		Streams:  args,
+		Count:    1,
+		Block:    RedisFetchTimeout,
+	}).Result()
+	if err != nil {
+		if err == redis.Nil || errors.Is(err, context.DeadlineExceeded) {
+			return nil, ErrFetchTimeout
+		}
+		return nil, err
+	}
+
+	// XREADGROUP may return one entry per stream. They are already pending
+	// on this consumer, so keep the extras for the next Fetch and hand out
+	// the one from the earliest queue in the requested order.
+	received := make(map[string]*Job)
+	var decodeErr error
+	for _, s := range streams {
+		for _, msg := range s.Messages {
+			job, err := sq.decodeMessage(ctx, s.Stream, msg)
+			if err != nil {
+				decodeErr = err
+				continue
+			}
+			received[s.Stream] = job
+		}
+	}
+
+	var next *Job
+	for _, queueName := range queueNames {
+		job, ok := received[sq.keys.key(StreamKey(queueName))]
+		if !ok {
+			continue
+		}
+		if next == nil {
+			next = job
+		} else {
+			sq.buffer(job)
+		}
+	}
+
+	if next == nil {
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		return nil, ErrFetchTimeout
+	}
+	return next, nil
+}
+
+// reclaim takes over at most one message per call that another consumer
+// left pending for longer than claimIdle. The pending lists are scanned at
+// most every redisstream.ClaimInterval.
+func (sq *streamQueue) reclaim(ctx context.Context, queueNames []string) (*Job, error) {
+	stream, msg, err := sq.claimer.Claim(ctx, sq.streams(queueNames)...)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+
+	sq.logger.Warn("Reclaimed stuck message", "stream", stream, "id", msg.ID)
+	return sq.decodeMessage(ctx, stream, *msg)
+}
+
+func (sq *streamQueue) buffer(job *Job) {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+	sq.buffered = append(sq.buffered, job)
+}
+
+// takeBuffered returns a buffered job from the earliest queue in queueNames.
+func (sq *streamQueue) takeBuffered(queueNames []string) *Job {
+	sq.mu.Lock()
+	defer sq.mu.Unlock()
+
+	for _, queueName := range queueNames {
+		stream := sq.keys.key(StreamKey(queueName))
+		for i, job := range sq.buffered {
+			if job.streamKey == stream {
+				sq.buffered = append(sq.buffered[:i], sq.buffered[i+1:]...)
+				return job
+			}
+		}
+	}
+	return nil
+}
+
+// decodeMessage turns a stream entry into a Job bound to its delivery.
+// Malformed entries are acknowledged straight away; otherwise they would be
+// reclaimed and fail again forever.
+func (sq *streamQueue) decodeMessage(ctx context.Context, stream string, msg redis.XMessage) (*Job, error) {
+	jobJSON, ok := msg.Values[streamJobField].(string)
+	if !ok {
+		_ = sq.remove(ctx, stream, msg.ID)
+		return nil, fmt.Errorf("stream message %s has no %q field", msg.ID, streamJobField)
+	}
+
+	job, err := decodeJob(strings.TrimSuffix(sq.keys.name(stream), ":stream"), jobJSON)
+	if err != nil {
+		_ = sq.remove(ctx, stream, msg.ID)
+		return nil, err
+	}
+
+	job.streamKey = stream
+	job.streamID = msg.ID
+	return job, nil
+}
+
+func (sq *streamQueue) Push(ctx context.Context, queueName string, job *Job) error {
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %v", err)
+	}
+
+	stream := sq.keys.key(StreamKey(queueName))
+	err = sq.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]interface{}{streamJobField: string(jobJSON)},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to add to stream %s: %v", stream, err)
+	}
+
+	return nil
+}
+
+func (sq *streamQueue) Ack(ctx context.Context, job *Job) error {
+	if job.streamID == "" {
+		return nil
+	}
+
+	if err := sq.remove(ctx, job.streamKey, job.streamID); err != nil {
+		return err
+	}
+
+	job.streamKey = ""
+	job.streamID = ""
+	return nil
+}
+
+func (sq *streamQueue) remove(ctx context.Context, stream, id string) error {
+	return redisstream.Remove(ctx, sq.client, sq.group, stream, id)
+}
+
+// Pending returns the XPENDING summary for the stream behind queueName.
+func (sq *streamQueue) Pending(ctx context.Context, queueName string) (*redis.XPending, error) {
+	return sq.client.XPending(ctx, sq.keys.key(StreamKey(queueName)), sq.group).Result()
+}
+
+// Backlog returns the number of unfinished jobs on the stream behind
+// queueName: entries not yet delivered to the group (its lag) plus entries
+// delivered but not acknowledged. A stream or group that does not exist yet
+// has no backlog.
+func (sq *streamQueue) Backlog(ctx context.Context, queueName string) (int64, error) {
+	stream := sq.keys.key(StreamKey(queueName))
+	groups, err := sq.client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read groups of %s: %v", stream, err)
+	}
+	for _, group := range groups {
+		if group.Name == sq.group {
+			return group.Lag + group.Pending, nil
+		}
+	}
+	return 0, nil
+}
+
+// Monitor logs the pending-entry summary of each stream every interval until
+// ctx is cancelled.
+func (sq *streamQueue) Monitor(ctx context.Context, interval time.Duration, queueNames ...string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, queueName := range queueNames {
+			pending, err := sq.Pending(ctx, queueName)
+			if err != nil {
+				sq.logger.Error("XPENDING failed", "stream", sq.keys.key(StreamKey(queueName)), logKeyError, err)
+				continue
+			}
+			if pending.Count == 0 {
+				continue
+			}
+
+			sq.logger.Info("Pending stream entries",
+				"stream", sq.keys.key(StreamKey(queueName)),
+				"pending", pending.Count,
+				"lower", pending.Lower,
+				"higher", pending.Higher,
+				"consumers", pending.Consumers)
+		}
+	}
+}
+
+func decodeJob(queueName, jobJSON string) (*Job, error) {
+	job, err := DecodeJob([]byte(jobJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal job: %v", err)
+	}
+	job.sourceQueue = queueName
+	return job, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyspace(t *testing.T) {
+	tests := []struct {
+		prefix keyspace
+		name   string
+		key    string
+	}{
+		{"", QueueNameJobs, "image:jobs"},
+		{"staging:", QueueNameJobs, "staging:image:jobs"},
+		{"staging:", StreamKey(QueueNameRetry), "staging:image:retry:stream"},
+	}
+	for _, tt := range tests {
+		if got := tt.prefix.key(tt.name); got != tt.key {
+			t.Errorf("keyspace(%q).key(%s) = %s, want %s", tt.prefix, tt.name, got, tt.key)
+		}
+		if got := tt.prefix.name(tt.key); got != tt.name {
+			t.Errorf("keyspace(%q).name(%s) = %s, want %s", tt.prefix, tt.key, got, tt.name)
+		}
+	}
+}
+
+func TestStreamQueueTakeBuffered(t *testing.T) {
+	sq := &streamQueue{keys: "staging:"}
+	stream := func(queueName string) string { return sq.keys.key(StreamKey(queueName)) }
+
+	for _, job := range []*Job{
+		{JobID: "bulk-1", streamKey: stream(QueueNameJobsBulk)},
+		{JobID: "normal-1", streamKey: stream(QueueNameJobs)},
+		{JobID: "high-1", streamKey: stream(QueueNameJobsHigh)},
+		{JobID: "normal-2", streamKey: stream(QueueNameJobs)},
+	} {
+		sq.buffer(job)
+	}
+
+	tests := []struct {
+		queueNames []string
+		want       string // "" when nothing buffered matches
+	}{
+		// The earliest requested queue wins, whatever the arrival order
+		{[]string{QueueNameJobsHigh, QueueNameJobs, QueueNameJobsBulk}, "high-1"},
+		{[]string{QueueNameJobsHigh, QueueNameJobs, QueueNameJobsBulk}, "normal-1"},
+		{[]string{QueueNameJobsBulk, QueueNameJobs}, "bulk-1"},
+		{[]string{QueueNameRetry, QueueNameJobsHigh}, ""},
+		{[]string{QueueNameJobs}, "normal-2"},
+		{[]string{QueueNameJobs}, ""},
+	}
+
+	var got []string
+	var want []string
+	for _, tt := range tests {
+		id := ""
+		if job := sq.takeBuffered(tt.queueNames); job != nil {
+			id = job.JobID
+		}
+		got = append(got, id)
+		want = append(want, tt.want)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("takeBuffered returned %q, want %q", got, want)
+	}
+}
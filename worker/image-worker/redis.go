@@ -3,12 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"log"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"worker-common/workercfg"
 )
 
 const (
@@ -20,89 +20,122 @@ const (
 )
 
 type RedisClient struct {
-	client *redis.Client
+	client    *redis.Client
+	keys      keyspace
+	queue     JobQueue
+	streams   *streamQueue
+	retention Retention
 }
 
-func NewRedisClient(addr string, db int) *RedisClient {
-	client := redis.NewClient(&redis.Options{
-		Addr:         addr,
-		DB:           db,
-		PoolSize:     10,
-		MinIdleConns: 5,
-	})
+func NewRedisClient(cfg workercfg.RedisConfig) *RedisClient {
+	opts := cfg.Options()
+	opts.PoolSize = 10
+	opts.MinIdleConns = 5
+	client := redis.NewClient(opts)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		fatal("Failed to connect to Redis", "addr", cfg.Addr, logKeyError, err)
 	}
 
-	return &RedisClient{client: client}
+	keys := keyspace(cfg.KeyPrefix)
+	return &RedisClient{client: client, keys: keys, queue: &listQueue{client: client, keys: keys}}
 }
 
-func (rc *RedisClient) FetchJob(ctx context.Context, queueName string) (*Job, error) {
-	ctx, cancel := context.WithTimeout(ctx, RedisFetchTimeout)
-	defer cancel()
-
-	results, err := rc.client.BRPop(ctx, RedisFetchTimeout, queueName).Result()
+// EnableStreams switches job intake to Redis Streams consumer groups for the
+// given queues. The lists of the same names keep being drained so producers
+// can migrate independently.
+func (rc *RedisClient) EnableStreams(ctx context.Context, group, consumer string, claimIdle time.Duration, queueNames ...string) error {
+	sq, err := newStreamQueue(ctx, rc.client, rc.keys, group, consumer, claimIdle, queueNames...)
 	if err != nil {
-		if err == redis.Nil || errors.Is(err, context.DeadlineExceeded) {
-			return nil, errors.New("timeout")
-		}
-		return nil, err
+		return err
 	}
 
-	if len(results) < 2 {
-		return nil, errors.New("invalid brpop result")
-	}
+	rc.queue = sq
+	rc.streams = sq
+	return nil
+}
 
-	jobJSON := results[1]
-	job := &Job{}
-	if err := json.Unmarshal([]byte(jobJSON), job); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal job: %v", err)
+// MonitorStreams periodically logs XPENDING summaries. It returns immediately
+// when streams are not enabled.
+func (rc *RedisClient) MonitorStreams(ctx context.Context, interval time.Duration, queueNames ...string) {
+	if rc.streams == nil {
+		return
 	}
+	rc.streams.Monitor(ctx, interval, queueNames...)
+}
 
-	return job, nil
+// FetchJob blocks until a job is available on one of queueNames, preferring
+// earlier names when several have work.
+func (rc *RedisClient) FetchJob(ctx context.Context, queueNames ...string) (*Job, error) {
+	return rc.queue.Fetch(ctx, queueNames...)
 }
 
+// PushToQueue hands job over to queueName and acknowledges the delivery it
+// was fetched from.
 func (rc *RedisClient) PushToQueue(ctx context.Context, queueName string, job *Job) error {
+	if err := rc.queue.Push(ctx, queueName, job); err != nil {
+		return err
+	}
+
+	return rc.queue.Ack(ctx, job)
+}
+
+// MoveToSuccess records job on the done queue, subject to the retention
+// limits, and acknowledges its delivery.
+func (rc *RedisClient) MoveToSuccess(ctx context.Context, job *Job) error {
+	job.FinishedAt = time.Now().UnixMilli()
 	jobJSON, err := json.Marshal(job)
 	if err != nil {
 		return fmt.Errorf("failed to marshal job: %v", err)
 	}
 
-	if err := rc.client.LPush(ctx, queueName, string(jobJSON)).Err(); err != nil {
-		return fmt.Errorf("failed to push to queue %s: %v", queueName, err)
+	if err := rc.pushTerminal(ctx, QueueNameDone, string(jobJSON), rc.retention.DoneMaxLen, rc.retention.DoneMaxAge, "completed"); err != nil {
+		return err
 	}
 
-	return nil
+	return rc.queue.Ack(ctx, job)
 }
 
-func (rc *RedisClient) MoveToSuccess(ctx context.Context, job *Job) error {
+// MoveToFailed records job on the failed queue, subject to the retention
+// limits, and acknowledges its delivery.
+func (rc *RedisClient) MoveToFailed(ctx context.Context, job *Job) error {
+	job.FinishedAt = time.Now().UnixMilli()
 	jobJSON, err := json.Marshal(job)
 	if err != nil {
 		return fmt.Errorf("failed to marshal job: %v", err)
 	}
 
-	if err := rc.client.LPush(ctx, QueueNameDone, string(jobJSON)).Err(); err != nil {
-		return fmt.Errorf("failed to push to done queue: %v", err)
+	if err := rc.pushTerminal(ctx, QueueNameFailed, string(jobJSON), rc.retention.FailedMaxLen, rc.retention.FailedMaxAge, "failed"); err != nil {
+		return err
 	}
 
-	return nil
+	return rc.queue.Ack(ctx, job)
 }
 
-func (rc *RedisClient) MoveToFailed(ctx context.Context, job *Job) error {
-	jobJSON, err := json.Marshal(job)
+// QueueLength returns the number of jobs waiting on queueName, including the
+// backlog of its stream when the streams transport is enabled.
+func (rc *RedisClient) QueueLength(ctx context.Context, queueName string) (int64, error) {
+	length, err := rc.client.LLen(ctx, rc.keys.key(queueName)).Result()
 	if err != nil {
-		return fmt.Errorf("failed to marshal job: %v", err)
+		return 0, fmt.Errorf("failed to read length of %s: %v", queueName, err)
 	}
 
-	if err := rc.client.LPush(ctx, QueueNameFailed, string(jobJSON)).Err(); err != nil {
-		return fmt.Errorf("failed to push to failed queue: %v", err)
+	if rc.streams != nil {
+		backlog, err := rc.streams.Backlog(ctx, queueName)
+		if err != nil {
+			return 0, err
+		}
+		length += backlog
 	}
 
-	return nil
+	return length, nil
+}
+
+func (rc *RedisClient) Ping(ctx context.Context) error {
+	return rc.client.Ping(ctx).Err()
 }
 
 func (rc *RedisClient) Close() error {
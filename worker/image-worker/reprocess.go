@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"worker-common/storage"
+)
+
+// imageExtensions are the originals the worker can decode.
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".webp": true,
+}
+
+// UploadsRoot returns the directory holding <userId>/ folders. The data dir
+// may either be the server's uploads directory itself or contain it.
+func UploadsRoot(dataDir string) string {
+	uploads := filepath.Join(dataDir, "uploads")
+	if info, err := os.Stat(uploads); err == nil && info.IsDir() {
+		return uploads
+	}
+	return dataDir
+}
+
+// Original is an uploaded image and where its derivatives live.
+type Original struct {
+	UserID       string
+	JobID        string
+	Path         string
+	ProcessedDir string
+}
+
+// WalkOriginals calls fn for every decodable original under
+// root/<userId>/, skipping the processed/ folders and non-user directories
+// such as temp/.
+func WalkOriginals(root string, fn func(Original) error) error {
+	users, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if !user.IsDir() || user.Name() == "temp" {
+			continue
+		}
+
+		userDir := filepath.Join(root, user.Name())
+		entries, err := os.ReadDir(userDir)
+		if err != nil {
+			slog.Warn("Skipping user directory", "component", "walk", "dir", userDir, logKeyError, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			if !imageExtensions[ext] {
+				continue
+			}
+
+			original := Original{
+				UserID:       user.Name(),
+				JobID:        strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())),
+				Path:         filepath.Join(userDir, entry.Name()),
+				ProcessedDir: filepath.Join(userDir, "processed"),
+			}
+			if err := fn(original); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// StaleOperations returns the derivatives of an original that were built
+// with outdated profile parameters. Derivatives written before manifests
+// existed have no recorded version and are always stale. Derivatives are
+// named as in the manifest, see Operation.Name.
+func StaleOperations(original Original) ([]string, *DerivativeManifest, error) {
+	manifest, err := LoadManifest(context.Background(), storage.Local{}, ManifestPath(original.ProcessedDir, original.JobID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if manifest != nil {
+		return manifest.StaleOperations(), manifest, nil
+	}
+
+	var stale []string
+	for op := range operationProfiles {
+		if _, err := os.Stat(DerivativePath(original.ProcessedDir, original.JobID, Operation{Op: op})); err == nil {
+			stale = append(stale, op)
+		}
+	}
+	return stale, nil, nil
+}
+
+// ReprocessStale regenerates every outdated derivative under root in place
+// and updates the manifests. It returns how many derivatives were rebuilt and
+// how many failed.
+func ReprocessStale(ctx context.Context, gd *GPUDispatcher, root string) (regenerated, failed int) {
+	logger := componentLogger("reprocess")
+
+	err := WalkOriginals(root, func(original Original) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		stale, manifest, err := StaleOperations(original)
+		if err != nil {
+			logger.Error("Failed to read manifest", "path", original.Path, logKeyError, err)
+			failed++
+			return nil
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+
+		input, err := os.ReadFile(original.Path)
+		if err != nil {
+			logger.Error("Failed to read original", "path", original.Path, logKeyError, err)
+			failed += len(stale)
+			return nil
+		}
+
+		inputHash := HashContent(input)
+		if manifest == nil || manifest.SourceHash != inputHash {
+			manifest = NewManifest(original.JobID, original.Path, inputHash)
+		}
+
+		for _, op := range stale {
+			operation, ok := OperationByName(op)
+			if !ok {
+				logger.Error("Unknown derivative in manifest", logKeyJobID, original.JobID, logKeyUserID, original.UserID, logKeyOp, op)
+				failed++
+				continue
+			}
+
+			result, err := gd.ProcessImage(ctx, input, operation, original.JobID)
+			if err != nil {
+				logger.Error("Operation failed", logKeyJobID, original.JobID, logKeyUserID, original.UserID, logKeyOp, op, logKeyError, err)
+				failed++
+				continue
+			}
+
+			outputPath := DerivativePath(original.ProcessedDir, original.JobID, operation)
+			if err := writeFileAtomic(outputPath, result.Data, 0644); err != nil {
+				logger.Error("Failed to write derivative", logKeyJobID, original.JobID, "path", outputPath, logKeyError, err)
+				failed++
+				continue
+			}
+
+			manifest.Record(op, outputPath, len(result.Data))
+			regenerated++
+			logger.Info("Regenerated derivative",
+				logKeyJobID, original.JobID,
+				logKeyUserID, original.UserID,
+				logKeyOp, op,
+				logKeyBytesOut, len(result.Data),
+				"version", ProfileVersion(op))
+		}
+
+		if err := manifest.Save(ctx, storage.Local{}, ManifestPath(original.ProcessedDir, original.JobID)); err != nil {
+			logger.Error("Failed to write manifest", logKeyJobID, original.JobID, logKeyError, err)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Walk stopped", "root", root, logKeyError, err)
+	}
+
+	return regenerated, failed
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// dailyStatsKeyPrefix is followed by the UTC date, e.g. image:stats:daily:2025-01-18.
+const dailyStatsKeyPrefix = "image:stats:daily:"
+
+// Retention bounds the terminal queues image:done and image:failed. Zero
+// values keep everything.
+type Retention struct {
+	DoneMaxLen     int64
+	DoneMaxAge     time.Duration
+	FailedMaxLen   int64
+	FailedMaxAge   time.Duration
+	DailyStatsDays int // Days per-day outcome counters are kept, 0 to disable them
+}
+
+// DailyStatsKey returns the counters hash for the UTC day of t.
+func DailyStatsKey(t time.Time) string {
+	return dailyStatsKeyPrefix + t.UTC().Format(time.DateOnly)
+}
+
+// trimByAgeScript pops jobs off the old end of a terminal list while they
+// finished before ARGV[1] (Unix milliseconds), at most ARGV[2] per call so a
+// large backlog is worked off over several jobs instead of blocking Redis.
+var trimByAgeScript = redis.NewScript(`
+local popped = 0
+while popped < tonumber(ARGV[2]) do
+	local tail = redis.call('LINDEX', KEYS[1], -1)
+	if not tail then
+		break
+	end
+	local ok, job = pcall(cjson.decode, tail)
+	local finished = 0
+	if ok and type(job) == 'table' then
+		finished = tonumber(job.finishedAt) or tonumber(job.timestamp) or 0
+	end
+	if finished >= tonumber(ARGV[1]) then
+		break
+	end
+	redis.call('RPOP', KEYS[1])
+	popped = popped + 1
+end
+return popped
+`)
+
+const trimByAgeBatch = 100
+
+// SetRetention bounds the terminal queues from now on.
+func (rc *RedisClient) SetRetention(retention Retention) {
+	rc.retention = retention
+}
+
+// pushTerminal LPUSHes a finished job onto queueName, trims the list to
+// maxLen and counts outcome in today's rollup, in one round trip. Jobs that
+// finished more than maxAge ago are then dropped as well.
+func (rc *RedisClient) pushTerminal(ctx context.Context, queueName, jobJSON string, maxLen int64, maxAge time.Duration, outcome string) error {
+	_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, rc.keys.key(queueName), jobJSON)
+		if maxLen > 0 {
+			pipe.LTrim(ctx, rc.keys.key(queueName), 0, maxLen-1)
+		}
+		if rc.retention.DailyStatsDays > 0 {
+			statsKey := rc.keys.key(DailyStatsKey(time.Now()))
+			pipe.HIncrBy(ctx, statsKey, outcome, 1)
+			pipe.Expire(ctx, statsKey, time.Duration(rc.retention.DailyStatsDays)*24*time.Hour)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to push to %s: %v", queueName, err)
+	}
+
+	// The job itself is recorded, so a failed trim must not fail it
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge).UnixMilli()
+		err := trimByAgeScript.Run(ctx, rc.client, []string{rc.keys.key(queueName)}, cutoff, trimByAgeBatch).Err()
+		if err != nil {
+			componentLogger("retention").Warn("Failed to expire old jobs", "queue", queueName, logKeyError, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until SetupTracing installs an exporting provider.
+var tracer = otel.Tracer("image-worker")
+
+// SetupTracing exports spans over OTLP/HTTP to endpoint (for example
+// http://localhost:4318). With an empty endpoint the standard
+// OTEL_EXPORTER_OTLP_* variables are used, and if those are unset tracing
+// stays disabled. Trace context carried by jobs is propagated either way.
+// The returned function flushes pending spans.
+func SetupTracing(ctx context.Context, serviceName, endpoint string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var opts []otlptracehttp.Option
+	switch {
+	case endpoint != "":
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "":
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serviceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// TraceContext returns ctx carrying the span context of the producer that
+// enqueued the job, so worker spans join the producer's trace.
+func (j *Job) TraceContext(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{}
+	if j.Traceparent != "" {
+		carrier.Set("traceparent", j.Traceparent)
+	}
+	if j.Tracestate != "" {
+		carrier.Set("tracestate", j.Tracestate)
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// failSpan marks the span in ctx as failed with err.
+func failSpan(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"path/filepath"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"worker-common/storage"
 )
 
 type WorkerPool struct {
@@ -16,138 +21,320 @@ type WorkerPool struct {
 	gpuDispatcher *GPUDispatcher
 	maxRetries    int
 	dataDir       string
+	lanes         []Lane
+	fair          *FairScheduler
+	storage       storage.Storage
 }
 
-func NewWorkerPool(workerCount int, rc *RedisClient, gd *GPUDispatcher, maxRetries int, dataDir string) *WorkerPool {
+func NewWorkerPool(workerCount int, rc *RedisClient, gd *GPUDispatcher, maxRetries int, dataDir string, lanes []Lane) *WorkerPool {
 	return &WorkerPool{
 		workerCount:   workerCount,
 		redisClient:   rc,
 		gpuDispatcher: gd,
 		maxRetries:    maxRetries,
 		dataDir:       dataDir,
+		lanes:         lanes,
+		storage:       storage.Local{},
 	}
 }
 
-func (wp *WorkerPool) Start(ctx context.Context) {
+// SetStorage replaces the local filesystem as the source of inputs and the
+// destination of derivatives, e.g. with storage that also serves s3:// URIs.
+func (wp *WorkerPool) SetStorage(st storage.Storage) {
+	wp.storage = st
+}
+
+// EnableFairScheduling routes fetched jobs through a FairScheduler so workers
+// serve users round-robin instead of in queue order.
+func (wp *WorkerPool) EnableFairScheduling(perUserBuffer, perUserCap int) {
+	wp.fair = NewFairScheduler(wp.redisClient, wp.lanes, wp.workerCount*2, perUserBuffer, perUserCap)
+}
+
+// Start runs the workers until ctx is cancelled and every in-flight job has
+// finished. Cancelling ctx only stops fetching; cancelling jobCtx as well
+// aborts in-flight jobs, which are then requeued unchanged.
+func (wp *WorkerPool) Start(ctx, jobCtx context.Context) {
 	var wg sync.WaitGroup
 
+	if wp.fair != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wp.fair.Run(ctx)
+		}()
+	}
+
 	for i := 0; i < wp.workerCount; i++ {
 		wg.Add(1)
 		go func(workerID int) {
 			defer wg.Done()
-			wp.runWorker(ctx, workerID)
+			wp.runWorker(ctx, jobCtx, workerID)
 		}(i)
 	}
 
 	wg.Wait()
-	log.Println("[POOL] All workers stopped")
+	componentLogger("pool").Info("All workers stopped")
 }
 
-func (wp *WorkerPool) runWorker(ctx context.Context, workerID int) {
-	logger := log.New(os.Stdout, fmt.Sprintf("[WORKER-%d] ", workerID), log.LstdFlags)
-	logger.Println("Started")
+func (wp *WorkerPool) runWorker(ctx, jobCtx context.Context, workerID int) {
+	logger := componentLogger("worker").With(logKeyWorkerID, workerID)
+	logger.Info("Started")
+
+	scheduler := newLaneScheduler(wp.lanes)
 
 	for {
 		select {
 		case <-ctx.Done():
-			logger.Println("Stopped")
+			logger.Info("Stopped")
 			return
 		default:
 		}
 
-		job, err := wp.redisClient.FetchJob(ctx, QueueNameJobs)
+		if wp.fair != nil {
+			job, err := wp.fair.Next(ctx)
+			if err != nil {
+				continue
+			}
+			wp.processJobSafe(jobCtx, logger, job)
+			wp.fair.Done(job)
+			continue
+		}
+
+		// One blocking fetch across all lanes in weighted order
+		job, err := wp.redisClient.FetchJob(ctx, scheduler.Next()...)
 		if err != nil {
-			if err.Error() == "timeout" {
-				job, err = wp.redisClient.FetchJob(ctx, QueueNameRetry)
-				if err != nil {
-					if err.Error() != "timeout" {
-						logger.Printf("Error fetching from retry queue: %v", err)
-						time.Sleep(1 * time.Second)
-					}
-					continue
-				}
-			} else {
-				logger.Printf("Error fetching job: %v", err)
+			if !errors.Is(err, ErrFetchTimeout) {
+				logger.Error("Error fetching job", logKeyError, err)
 				time.Sleep(1 * time.Second)
-				continue
 			}
+			continue
 		}
 
-		wp.processJobSafe(ctx, logger, job)
+		wp.processJobSafe(jobCtx, logger, job)
 	}
 }
 
-func (wp *WorkerPool) processJobSafe(ctx context.Context, logger *log.Logger, job *Job) {
+func (wp *WorkerPool) processJobSafe(ctx context.Context, logger *slog.Logger, job *Job) {
+	ctx, span := tracer.Start(job.TraceContext(ctx), "image.job",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("job.id", job.JobID),
+			attribute.String("user.id", job.Owner()),
+			attribute.String("messaging.destination.name", job.Queue()),
+			attribute.String("job.priority", job.Priority),
+			attribute.Int("job.retry_count", job.RetryCount),
+			attribute.StringSlice("job.operations", OperationNames(job.Operations)),
+		))
+	defer span.End()
+
+	if job.Timestamp > 0 {
+		span.SetAttributes(attribute.Int64("job.queue_wait_ms", time.Now().UnixMilli()-job.Timestamp))
+	}
+
+	logger = logger.With(logKeyJobID, job.JobID, logKeyUserID, job.Owner())
+	if span.SpanContext().HasTraceID() {
+		logger = logger.With("trace_id", span.SpanContext().TraceID().String())
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
-			logger.Printf("PANIC in job %s: %v - moving to retry", job.JobID, r)
-			_ = wp.retryJob(ctx, job)
+			logger.Error("Panic while processing job, moving to retry", logKeyError, fmt.Sprint(r))
+			_ = wp.retryJob(context.WithoutCancel(ctx), job, fmt.Errorf("panic: %v", r))
 		}
 	}()
 
 	wp.processJob(ctx, logger, job)
 }
 
-func (wp *WorkerPool) processJob(ctx context.Context, logger *log.Logger, job *Job) {
-	logger.Printf("Processing job %s with operations: %v", job.JobID, job.Operations)
+// processJob stops between operations once ctx is cancelled. Bookkeeping
+// in Redis uses rctx, which outlives ctx so an aborted job is still requeued.
+func (wp *WorkerPool) processJob(ctx context.Context, logger *slog.Logger, job *Job) {
+	logger.Info("Processing job", "type", job.Type, "operations", OperationNames(job.Operations), "priority", job.Priority)
 	startTime := time.Now()
+	rctx := context.WithoutCancel(ctx)
+
+	wp.publishEvent(rctx, job, &JobEvent{Type: EventJobStarted})
 
 	if err := job.Validate(); err != nil {
-		logger.Printf("Job %s validation failed: %v", job.JobID, err)
-		_ = wp.redisClient.MoveToFailed(ctx, job)
+		logger.Error("Job validation failed", logKeyError, err)
+		wp.failJob(rctx, job, err)
 		return
 	}
+	wp.setConvertStatus(rctx, job, "status", "PROCESSING", "progress", "0")
 
 	// Use the outputDir provided by the server (server/uploads/<userId>/processed)
 	outputDir := job.OutputDir
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		logger.Printf("Failed to create output dir for job %s: %v", job.JobID, err)
-		_ = wp.retryJob(ctx, job)
+	if err := wp.prepareOutputDir(outputDir); err != nil {
+		logger.Error("Failed to create output dir", "dir", outputDir, logKeyError, err)
+		_ = wp.retryJob(rctx, job, err)
 		return
 	}
 
-	inputImageBytes, err := os.ReadFile(job.InputPath)
+	_, readSpan := tracer.Start(ctx, "image.read", trace.WithAttributes(attribute.String("file.path", job.InputPath)))
+	inputImageBytes, err := storage.ReadAll(ctx, wp.storage, job.InputPath)
+	readSpan.SetAttributes(attribute.Int("file.size", len(inputImageBytes)))
+	readSpan.End()
+	if err != nil && ctx.Err() != nil {
+		wp.requeueJob(rctx, logger, job)
+		return
+	}
 	if err != nil {
-		logger.Printf("Failed to read input image %s: %v", job.InputPath, err)
-		_ = wp.retryJob(ctx, job)
+		logger.Error("Failed to read input image", "path", job.InputPath, logKeyError, err)
+		_ = wp.retryJob(rctx, job, err)
 		return
 	}
 
-	logger.Printf("Input image read: %d bytes", len(inputImageBytes))
+	logger.Debug("Input image read", logKeyBytesIn, len(inputImageBytes))
+
+	if job.Type == JobTypeConvert {
+		wp.finishConvert(ctx, rctx, logger, job, inputImageBytes, startTime)
+		return
+	}
+
+	// An edit job writes a new version of the original; the derivatives are
+	// then built from, and named after, that version
+	jobID, inputPath := job.JobID, job.InputPath
+	if job.Type == JobTypeEdit {
+		edited, err := wp.writeEditedVersion(ctx, job, inputImageBytes)
+		if errors.Is(err, errInvalidEdit) {
+			logger.Error("Edits do not apply to this image", logKeyError, err)
+			wp.failJob(rctx, job, err)
+			return
+		}
+		if err != nil && ctx.Err() != nil {
+			wp.requeueJob(rctx, logger, job)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to edit image", logKeyError, err)
+			_ = wp.retryJob(rctx, job, err)
+			return
+		}
+		logger.Info("Edited version written", "path", job.OutputPath, "edits", len(job.Edits), logKeyBytesOut, len(edited))
+		inputImageBytes = edited
+		jobID, inputPath = versionJobID(job.OutputPath), job.OutputPath
+	}
 
 	// Track output sizes for quality validation
 	outputSizes := make(map[string]int)
+	outputPaths := make(map[string]string)
 	originalSize := len(inputImageBytes)
 
+	// Derivatives already produced from identical content (a repeated job, or
+	// the same file uploaded by another user) are reused instead of re-encoded
+	inputHash := HashContent(inputImageBytes)
+	cached, err := wp.redisClient.GetDerivatives(ctx, inputHash, job.Operations)
+	if err != nil {
+		logger.Warn("Derivative cache lookup failed", logKeyError, err)
+	}
+	reused := 0
+
+	manifestPath := ManifestPath(outputDir, jobID)
+	manifest, err := LoadManifest(ctx, wp.storage, manifestPath)
+	if err != nil || manifest == nil || manifest.SourceHash != inputHash {
+		manifest = NewManifest(jobID, inputPath, inputHash)
+	}
+
 	// Process each operation from the ORIGINAL image to ensure consistent quality ordering:
 	// thumbnail (smallest) < blur < low-quality < original
 	// Each operation starts from the original to guarantee size hierarchy
-	for _, op := range job.Operations {
+	for i, operation := range job.Operations {
+		op := operation.Name()
+		// jobId already contains the unique identifier from the server (UUID-filename)
+		outputPath := DerivativePath(outputDir, jobID, operation)
+
+		// Reuse hardlinks or copies files, so it only applies on local disk
+		if cachedPath, ok := cached[op]; ok && !storage.IsS3URI(cachedPath) && !storage.IsS3URI(outputPath) {
+			size, err := reuseDerivative(cachedPath, outputPath)
+			if err == nil {
+				outputSizes[op] = int(size)
+				outputPaths[op] = outputPath
+				manifest.Record(op, outputPath, int(size))
+				reused++
+				operationsTotal.WithLabelValues(operation.Op, "reused").Inc()
+				trace.SpanFromContext(ctx).AddEvent("derivative reused", trace.WithAttributes(
+					attribute.String("image.operation", op),
+					attribute.String("file.path", cachedPath),
+				))
+
+				logger.Info("Reused cached derivative", logKeyOp, op, "path", cachedPath, logKeyBytesOut, size)
+
+				wp.publishEvent(rctx, job, &JobEvent{
+					Type:      EventJobProgress,
+					Operation: op,
+					Progress:  (i + 1) * 100 / len(job.Operations),
+				})
+				continue
+			}
+			logger.Warn("Cached derivative unusable, regenerating", logKeyOp, op, "path", cachedPath, logKeyError, err)
+		}
+
+		if ctx.Err() != nil {
+			wp.requeueJob(rctx, logger, job)
+			return
+		}
+
 		// Always use original image as input for each operation
 		// This ensures: thumbnail < blur < low-quality < original (in file size)
-		result, err := wp.gpuDispatcher.ProcessImage(ctx, inputImageBytes, op, job.JobID)
+		opCtx, opSpan := tracer.Start(ctx, "image.process", trace.WithAttributes(attribute.String("image.operation", op)))
+		result, err := wp.gpuDispatcher.ProcessImage(opCtx, inputImageBytes, operation, job.JobID)
 		if err != nil {
-			logger.Printf("GPU processing failed for job %s operation %s: %v", job.JobID, op, err)
-			_ = wp.cleanupOutputFiles(outputDir)
-			_ = wp.retryJob(ctx, job)
+			failSpan(opCtx, err)
+		}
+		opSpan.End()
+		if err != nil && ctx.Err() != nil {
+			wp.requeueJob(rctx, logger, job)
+			return
+		}
+		if err != nil {
+			logger.Error("Processing failed", logKeyOp, op, logKeyError, err)
+			wp.cleanupOutputs(rctx, logger, outputPaths)
+			_ = wp.retryJob(rctx, job, err)
 			return
 		}
 
 		// Track output size for validation
 		outputSizes[op] = len(result.Data)
 
-		// Follow server naming convention: jobId_operation.webp
-		// jobId already contains the unique identifier from the server (UUID-filename)
-		outputPath := filepath.Join(outputDir, fmt.Sprintf("%s_%s.webp", job.JobID, op))
-		if err := os.WriteFile(outputPath, result.Data, 0644); err != nil {
-			logger.Printf("Failed to write output file %s: %v", outputPath, err)
-			_ = wp.cleanupOutputFiles(outputDir)
-			_ = wp.retryJob(ctx, job)
+		_, writeSpan := tracer.Start(ctx, "image.write", trace.WithAttributes(
+			attribute.String("image.operation", op),
+			attribute.String("file.path", outputPath),
+			attribute.Int("file.size", len(result.Data)),
+		))
+		err = storage.WriteAll(ctx, wp.storage, outputPath, result.Data)
+		writeSpan.End()
+		if err != nil && ctx.Err() != nil {
+			wp.requeueJob(rctx, logger, job)
 			return
 		}
+		if err != nil {
+			logger.Error("Failed to write output file", logKeyOp, op, "path", outputPath, logKeyError, err)
+			wp.cleanupOutputs(rctx, logger, outputPaths)
+			_ = wp.retryJob(rctx, job, err)
+			return
+		}
+		outputPaths[op] = outputPath
+		manifest.Record(op, outputPath, len(result.Data))
 
-		logger.Printf("Operation %s complete: %s (%d bytes) - Quality order: thumbnail < blur < low-quality < original",
-			op, outputPath, len(result.Data))
+		if err := wp.redisClient.RecordDerivative(rctx, inputHash, op, outputPath); err != nil {
+			logger.Warn("Failed to record derivative", logKeyOp, op, logKeyError, err)
+		}
+
+		logger.Info("Operation written", logKeyOp, op, "path", outputPath, logKeyBytesOut, len(result.Data))
+
+		wp.publishEvent(rctx, job, &JobEvent{
+			Type:      EventJobProgress,
+			Operation: op,
+			Progress:  (i + 1) * 100 / len(job.Operations),
+		})
+	}
+
+	if err := manifest.Save(rctx, wp.storage, manifestPath); err != nil {
+		logger.Warn("Failed to write manifest", logKeyError, err)
+	}
+
+	if reused == len(job.Operations) {
+		logger.Info("All derivatives already present, nothing encoded", "source_hash", inputHash[:12])
 	}
 
 	// Validate quality ordering if all three operations were performed
@@ -161,48 +348,113 @@ func (wp *WorkerPool) processJob(ctx context.Context, logger *log.Logger, job *J
 		// Log individual size comparisons for partial operations
 		for op, size := range outputSizes {
 			ratio := float64(size) / float64(originalSize) * 100
-			logger.Printf("Job %s operation %s: %d bytes (%.1f%% of original %d bytes)",
-				job.JobID, op, size, ratio, originalSize)
+			logger.Debug("Derivative size",
+				logKeyOp, op,
+				logKeyBytesIn, originalSize,
+				logKeyBytesOut, size,
+				"ratio_pct", fmt.Sprintf("%.1f", ratio))
 		}
 	}
 
-	if err := wp.redisClient.MoveToSuccess(ctx, job); err != nil {
-		logger.Printf("Failed to mark job %s as done: %v", job.JobID, err)
+	if err := wp.redisClient.MoveToSuccess(rctx, job); err != nil {
+		logger.Error("Failed to mark job as done", logKeyError, err)
 		return
 	}
 
 	duration := time.Since(startTime)
-	logger.Printf("Job %s completed successfully in %v", job.JobID, duration)
+	jobsTotal.WithLabelValues(job.Kind(), "completed").Inc()
+	logger.Info("Job completed",
+		logKeyDurationMS, duration.Milliseconds(),
+		logKeyBytesIn, originalSize,
+		"reused", reused)
+
+	wp.publishEvent(rctx, job, &JobEvent{
+		Type:     EventJobCompleted,
+		Progress: 100,
+		Outputs:  outputPaths,
+		Versions: manifest.Versions(),
+		Edited:   job.OutputPath,
+	})
+}
+
+// failJob moves a job that cannot succeed on retry straight to image:failed.
+func (wp *WorkerPool) failJob(ctx context.Context, job *Job, err error) {
+	failSpan(ctx, err)
+	job.RecordError(err)
+	_ = wp.redisClient.MoveToFailed(ctx, job)
+	jobsTotal.WithLabelValues(job.Kind(), "failed").Inc()
+	wp.publishEvent(ctx, job, &JobEvent{Type: EventJobFailed, Error: err.Error()})
+	wp.setConvertStatus(ctx, job, "status", "FAILED", "message", err.Error())
+}
+
+// requeueJob hands a job interrupted by shutdown back to the queue it came
+// from without counting it as a failed attempt. Derivatives already written
+// are reused by whichever worker picks it up next.
+func (wp *WorkerPool) requeueJob(ctx context.Context, logger *slog.Logger, job *Job) {
+	trace.SpanFromContext(ctx).AddEvent("job requeued on shutdown")
+	if err := wp.redisClient.PushToQueue(ctx, job.Queue(), job); err != nil {
+		logger.Error("Failed to requeue interrupted job", logKeyError, err)
+		return
+	}
+	wp.setConvertStatus(ctx, job, "status", "PENDING", "progress", "0", "message", "Queued")
+	jobsTotal.WithLabelValues(job.Kind(), "requeued").Inc()
+	logger.Warn("Job interrupted by shutdown, requeued", "queue", job.Queue())
 }
 
-func (wp *WorkerPool) retryJob(ctx context.Context, job *Job) error {
+func (wp *WorkerPool) retryJob(ctx context.Context, job *Job, cause error) error {
 	job.RetryCount++
+	job.RecordError(cause)
+	failSpan(ctx, cause)
 
 	if job.RetryCount >= wp.maxRetries {
-		log.Printf("[RETRY] Job %s exceeded max retries (%d), moving to failed", job.JobID, wp.maxRetries)
+		componentLogger("retry").Error("Job exceeded max retries, moving to failed",
+			logKeyJobID, job.JobID,
+			logKeyUserID, job.Owner(),
+			"max_retries", wp.maxRetries,
+			logKeyError, cause)
+		jobsTotal.WithLabelValues(job.Kind(), "failed").Inc()
+		wp.publishEvent(ctx, job, &JobEvent{Type: EventJobFailed, Error: cause.Error()})
+		wp.setConvertStatus(ctx, job, "status", "FAILED", "message", cause.Error())
 		return wp.redisClient.MoveToFailed(ctx, job)
 	}
 
-	log.Printf("[RETRY] Job %s retry attempt %d/%d", job.JobID, job.RetryCount, wp.maxRetries)
+	componentLogger("retry").Warn("Retrying job",
+		logKeyJobID, job.JobID,
+		logKeyUserID, job.Owner(),
+		"attempt", job.RetryCount,
+		"max_retries", wp.maxRetries,
+		logKeyError, cause)
+	jobsTotal.WithLabelValues(job.Kind(), "retried").Inc()
+	wp.publishEvent(ctx, job, &JobEvent{Type: EventJobRetrying, Error: cause.Error()})
+	wp.setConvertStatus(ctx, job, "status", "PENDING", "message", fmt.Sprintf("Retrying after attempt %d: %v", job.RetryCount, cause))
 	return wp.redisClient.PushToQueue(ctx, QueueNameRetry, job)
 }
 
-func (wp *WorkerPool) cleanupOutputFiles(outputDir string) error {
-	if _, err := os.Stat(outputDir); os.IsNotExist(err) {
-		return nil
+// publishEvent stamps event with the job and its owner and publishes it. It
+// is best effort: a missed event must never fail or retry a job.
+func (wp *WorkerPool) publishEvent(ctx context.Context, job *Job, event *JobEvent) {
+	event.JobID = job.JobID
+	event.UserID = job.Owner()
+	if err := wp.redisClient.PublishEvent(ctx, event); err != nil {
+		componentLogger("events").Warn("Failed to publish event", "type", event.Type, logKeyJobID, event.JobID, logKeyError, err)
 	}
+}
 
-	entries, err := os.ReadDir(outputDir)
-	if err != nil {
-		return err
+// prepareOutputDir creates a local output directory. Object stores have no
+// directories to create.
+func (wp *WorkerPool) prepareOutputDir(outputDir string) error {
+	if storage.IsS3URI(outputDir) {
+		return nil
 	}
+	return os.MkdirAll(outputDir, 0755)
+}
 
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			path := filepath.Join(outputDir, entry.Name())
-			_ = os.Remove(path)
+// cleanupOutputs removes the derivatives a failed attempt wrote. Other files
+// in the output directory, including other jobs' derivatives, are left alone.
+func (wp *WorkerPool) cleanupOutputs(ctx context.Context, logger *slog.Logger, outputPaths map[string]string) {
+	for op, path := range outputPaths {
+		if err := wp.storage.Remove(ctx, path); err != nil {
+			logger.Warn("Failed to remove derivative of failed job", logKeyOp, op, "path", path, logKeyError, err)
 		}
 	}
-
-	return nil
 }
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// errUsage is returned for invalid arguments; the command's usage has
+// already been printed.
+var errUsage = errors.New("invalid usage")
+
+// command is one worker-admin subcommand.
+type command struct {
+	args    string
+	summary string
+	run     func(ctx context.Context, a *admin, args []string) error
+}
+
+// commands is filled in init because the commands' usage refers back to it.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"queues":  {"", "Show the length of every queue", runQueues},
+		"list":    {"[-offset n] [-limit n] [-json] <queue>", "Page through the jobs in a queue", runList},
+		"show":    {"[-queue name] <jobId>", "Show a job with its error history", runShow},
+		"requeue": {"[-from queue] [-to queue] [-all] [jobId...]", "Requeue failed jobs with their retry count reset", runRequeue},
+		"purge":   {"[-older-than d] [-match glob] [-dry-run] <queue>", "Delete jobs by age or job ID pattern", runPurge},
+		"move":    {"[-all] <from> <to> [jobId...]", "Move jobs between queues unchanged", runMove},
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: worker-admin %s %s\n", name, commands[name].args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func usageError(fs *flag.FlagSet, format string, args ...any) error {
+	fmt.Fprintf(fs.Output(), format+"\n", args...)
+	fs.Usage()
+	return errUsage
+}
+
+func checkQueue(fs *flag.FlagSet, name string) error {
+	if !isKnownQueue(name) {
+		return usageError(fs, "unknown queue %q (known: %s)", name, strings.Join(knownQueues, ", "))
+	}
+	return nil
+}
+
+// age formats how long ago a millisecond timestamp was.
+func age(timestamp int64) string {
+	if timestamp == 0 {
+		return "-"
+	}
+	return time.Since(time.UnixMilli(timestamp)).Truncate(time.Second).String()
+}
+
+// lastError returns the most recent recorded failure of a job.
+func lastError(job jobSummary) string {
+	if len(job.Errors) == 0 {
+		return ""
+	}
+	return job.Errors[len(job.Errors)-1].Error
+}
+
+func runQueues(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("queues")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "QUEUE\tLIST\tSTREAM")
+	for _, queue := range knownQueues {
+		listLen, err := a.rdb.LLen(ctx, a.key(queue)).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read length of %s: %v", queue, err)
+		}
+		streamLen, err := a.rdb.XLen(ctx, a.key(queue+":stream")).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read length of %s:stream: %v", queue, err)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\n", queue, listLen, streamLen)
+	}
+	return nil
+}
+
+func runList(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("list")
+	offset := fs.Int64("offset", 0, "Index of the first job to show; 0 is the left end of the list")
+	limit := fs.Int64("limit", 20, "Number of jobs to show")
+	asJSON := fs.Bool("json", false, "Print the stored job JSON, one per line")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "list takes exactly one queue")
+	}
+	queue := fs.Arg(0)
+	if err := checkQueue(fs, queue); err != nil {
+		return err
+	}
+
+	// Stream-backed queues list their stream entries after the list
+	total, err := a.rdb.LLen(ctx, a.key(queue)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read length of %s: %v", queue, err)
+	}
+	if streamQueues[queue] {
+		streamLen, err := a.rdb.XLen(ctx, a.key(queue+":stream")).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read length of %s:stream: %v", queue, err)
+		}
+		total += streamLen
+	}
+
+	var entries []entry
+	var n int64
+	err = a.scan(ctx, queue, func(e entry) bool {
+		if n >= *offset {
+			entries = append(entries, e)
+		}
+		n++
+		return int64(len(entries)) < *limit
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		for _, e := range entries {
+			fmt.Println(e.Raw)
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tJOB ID\tUSER\tRETRIES\tAGE\tLAST ERROR")
+	for _, e := range entries {
+		index := fmt.Sprint(e.Index)
+		if e.StreamID != "" {
+			index = "stream " + e.StreamID
+			if e.Consumer != "" {
+				index += " (pending)"
+			}
+		}
+		if e.Err != nil {
+			fmt.Fprintf(w, "%s\t(invalid job: %v)\t\t\t\t\n", index, e.Err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", index, e.Job.JobID, e.Job.UserID, e.Job.RetryCount, age(e.Job.Timestamp), lastError(e.Job))
+	}
+	w.Flush()
+
+	fmt.Printf("%d-%d of %d\n", min(*offset+1, total), min(*offset+int64(len(entries)), total), total)
+	return nil
+}
+
+func runShow(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("show")
+	only := fs.String("queue", "", "Queue to search (default: all of them)")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "show takes exactly one job ID")
+	}
+	jobID := fs.Arg(0)
+
+	queues := knownQueues
+	if *only != "" {
+		if err := checkQueue(fs, *only); err != nil {
+			return err
+		}
+		queues = []string{*only}
+	}
+
+	found := 0
+	for _, queue := range queues {
+		err := a.scan(ctx, queue, func(e entry) bool {
+			if e.Job.JobID != jobID {
+				return true
+			}
+			found++
+			printJob(queue, e)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Zip jobs keep their state and failure message in a status hash
+	status, err := a.rdb.HGetAll(ctx, a.key("zip:job:"+jobID)).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read zip status: %v", err)
+	}
+	if len(status) > 0 {
+		found++
+		fmt.Printf("zip status: %s (progress %s%%) %s\n", status["status"], status["progress"], status["message"])
+	}
+
+	if found == 0 {
+		return fmt.Errorf("job %s not found", jobID)
+	}
+	return nil
+}
+
+func printJob(queue string, e entry) {
+	fmt.Println(e.Where(queue))
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, []byte(e.Raw), "  ", "  "); err != nil {
+		fmt.Printf("  %s\n", e.Raw)
+	} else {
+		fmt.Printf("  %s\n", pretty.String())
+	}
+
+	if len(e.Job.Errors) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  ATTEMPT\tWHEN\tERROR")
+		for _, jobErr := range e.Job.Errors {
+			fmt.Fprintf(w, "  %d\t%s\t%s\n", jobErr.Attempt, time.UnixMilli(jobErr.Timestamp).Format(time.RFC3339), jobErr.Error)
+		}
+		w.Flush()
+	}
+	fmt.Println()
+}
+
+// selectJobs reads the entries of queue whose job ID is in ids, or every
+// entry when all is set. IDs that are not in the queue are reported.
+func (a *admin) selectJobs(ctx context.Context, queue string, ids []string, all bool) ([]entry, error) {
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	var selected []entry
+	seen := make(map[string]bool)
+	err := a.scan(ctx, queue, func(e entry) bool {
+		if all || wanted[e.Job.JobID] {
+			selected = append(selected, e)
+			seen[e.Job.JobID] = true
+		}
+		return true
+	})
+	for _, id := range ids {
+		if !seen[id] {
+			fmt.Fprintf(os.Stderr, "job %s not found in %s\n", id, queue)
+		}
+	}
+	return selected, err
+}
+
+func runRequeue(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("requeue")
+	from := fs.String("from", "image:failed", "Queue to take the jobs from")
+	to := fs.String("to", "", "Queue to put them on (default: the queue for each job's priority)")
+	all := fs.Bool("all", false, "Requeue every job in -from")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if *all == (fs.NArg() > 0) {
+		return usageError(fs, "requeue takes either job IDs or -all")
+	}
+	if err := checkQueue(fs, *from); err != nil {
+		return err
+	}
+	if *to != "" {
+		if err := checkQueue(fs, *to); err != nil {
+			return err
+		}
+	}
+
+	selected, err := a.selectJobs(ctx, *from, fs.Args(), *all)
+	if err != nil {
+		return err
+	}
+
+	requeued := 0
+	for _, e := range selected {
+		dest := *to
+		if dest == "" {
+			dest = targetQueue(*from, e.Job)
+		}
+		if dest == "" {
+			fmt.Fprintf(os.Stderr, "job %s: unknown priority %q, pass -to\n", e.Job.JobID, e.Job.Priority)
+			continue
+		}
+
+		updated, err := resetRetries(e.Raw)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "job %s: %v\n", e.Job.JobID, err)
+			continue
+		}
+		moved, err := a.move(ctx, *from, dest, e, updated)
+		if errors.Is(err, errInProgress) {
+			fmt.Fprintf(os.Stderr, "job %s: %v, skipped\n", e.Job.JobID, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if moved {
+			requeued++
+			fmt.Printf("requeued %s to %s\n", e.Job.JobID, dest)
+		}
+	}
+
+	fmt.Printf("Requeued %d of %d jobs\n", requeued, len(selected))
+	return nil
+}
+
+// targetQueue is where a requeued job goes by default: zip jobs back to
+// zip:jobs, image jobs to the queue for their priority.
+func targetQueue(from string, job jobSummary) string {
+	if strings.HasPrefix(from, "zip:") {
+		return "zip:jobs"
+	}
+	return priorityQueues[job.Priority]
+}
+
+func runPurge(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("purge")
+	olderThan := fs.Duration("older-than", 0, "Only delete jobs created longer ago than this")
+	match := fs.String("match", "", "Only delete jobs whose ID matches this glob, e.g. \"*.png\"")
+	dryRun := fs.Bool("dry-run", false, "List the jobs that would be deleted")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() != 1 {
+		return usageError(fs, "purge takes exactly one queue")
+	}
+	if *olderThan <= 0 && *match == "" {
+		return usageError(fs, "purge needs -older-than or -match (use -match '*' to delete everything)")
+	}
+	if _, err := path.Match(*match, ""); err != nil {
+		return usageError(fs, "invalid -match pattern: %v", err)
+	}
+	queue := fs.Arg(0)
+	if err := checkQueue(fs, queue); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-*olderThan).UnixMilli()
+	var selected []entry
+	err := a.scan(ctx, queue, func(e entry) bool {
+		if *olderThan > 0 && (e.Job.Timestamp == 0 || e.Job.Timestamp > cutoff) {
+			return true
+		}
+		if *match != "" {
+			if ok, _ := path.Match(*match, e.Job.JobID); !ok {
+				return true
+			}
+		}
+		selected = append(selected, e)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	purged := 0
+	for _, e := range selected {
+		if *dryRun {
+			fmt.Printf("would delete %s (%s old)\n", e.Job.JobID, age(e.Job.Timestamp))
+			continue
+		}
+		removed, err := a.remove(ctx, queue, e)
+		if errors.Is(err, errInProgress) {
+			fmt.Fprintf(os.Stderr, "job %s: %v, skipped\n", e.Job.JobID, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if removed {
+			purged++
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("Would delete %d jobs from %s\n", len(selected), queue)
+	} else {
+		fmt.Printf("Deleted %d jobs from %s\n", purged, queue)
+	}
+	return nil
+}
+
+func runMove(ctx context.Context, a *admin, args []string) error {
+	fs := newFlagSet("move")
+	all := fs.Bool("all", false, "Move every job in <from>")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() < 2 {
+		return usageError(fs, "move takes a source and a destination queue")
+	}
+	from, to, ids := fs.Arg(0), fs.Arg(1), fs.Args()[2:]
+	if *all == (len(ids) > 0) {
+		return usageError(fs, "move takes either job IDs or -all")
+	}
+	if err := checkQueue(fs, from); err != nil {
+		return err
+	}
+	if err := checkQueue(fs, to); err != nil {
+		return err
+	}
+	if from == to {
+		return usageError(fs, "source and destination are the same queue")
+	}
+
+	selected, err := a.selectJobs(ctx, from, ids, *all)
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	for _, e := range selected {
+		ok, err := a.move(ctx, from, to, e, e.Raw)
+		if errors.Is(err, errInProgress) {
+			fmt.Fprintf(os.Stderr, "job %s: %v, skipped\n", e.Job.JobID, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	fmt.Printf("Moved %d of %d jobs from %s to %s\n", moved, len(selected), from, to)
+	return nil
+}
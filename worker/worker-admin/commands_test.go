@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestTargetQueue(t *testing.T) {
+	tests := []struct {
+		from     string
+		priority string
+		want     string
+	}{
+		{"image:failed", "", "image:jobs"},
+		{"image:failed", "normal", "image:jobs"},
+		{"image:failed", "high", "image:jobs:high"},
+		{"image:retry", "bulk", "image:jobs:bulk"},
+		{"image:failed", "urgent", ""}, // Unknown priorities need -to
+		{"zip:jobs", "high", "zip:jobs"},
+	}
+	for _, tt := range tests {
+		if got := targetQueue(tt.from, jobSummary{Priority: tt.priority}); got != tt.want {
+			t.Errorf("targetQueue(%s, %q) = %q, want %q", tt.from, tt.priority, got, tt.want)
+		}
+	}
+}
+
+func TestIsKnownQueue(t *testing.T) {
+	for _, queue := range knownQueues {
+		if !isKnownQueue(queue) {
+			t.Errorf("isKnownQueue(%s) = false", queue)
+		}
+	}
+	for _, queue := range []string{"", "image:job", "image:jobs:stream", "zip:job:1"} {
+		if isKnownQueue(queue) {
+			t.Errorf("isKnownQueue(%q) = true", queue)
+		}
+	}
+}
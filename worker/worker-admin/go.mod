@@ -0,0 +1,16 @@
+module worker-admin
+
+go 1.25.5
+
+require (
+	github.com/redis/go-redis/v9 v9.17.3
+	worker-common v0.0.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace worker-common => ../common
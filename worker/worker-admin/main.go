@@ -0,0 +1,81 @@
+// Command worker-admin inspects and repairs the image and zip job queues in
+// Redis, replacing hand-run LRANGE/LREM and hand-edited job JSON.
+//
+//	worker-admin list image:failed
+//	worker-admin show <jobId>
+//	worker-admin requeue -all
+//	worker-admin purge -older-than 720h image:done
+//	worker-admin move image:jobs image:jobs:bulk <jobId>
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: worker-admin [flags] <command> [command flags] [args]")
+	fmt.Fprintln(out, "\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-8s %s\n", name, commands[name].summary)
+	}
+
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nThe Redis flags default to the environment the workers read: REDIS_ADDR")
+	fmt.Fprintln(out, "(or REDIS_HOST and REDIS_PORT), REDIS_PASSWORD, REDIS_DB, REDIS_TLS,")
+	fmt.Fprintln(out, "REDIS_TLS_SKIP_VERIFY and REDIS_KEY_PREFIX.")
+}
+
+func main() {
+	var cfg Config
+	cfg.registerFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+	if err := cfg.loadConfig(flag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "worker-admin: %v\n", err)
+		os.Exit(2)
+	}
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "worker-admin: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	a, err := newAdmin(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "worker-admin: %v\n", err)
+		os.Exit(1)
+	}
+	defer a.rdb.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := cmd.run(ctx, a, flag.Args()[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "worker-admin: %v\n", err)
+		os.Exit(1)
+	}
+}
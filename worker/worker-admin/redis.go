@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+
+	"worker-common/workercfg"
+)
+
+// knownQueues are the lists the workers and the server use. Commands refuse
+// other names so a typo does not create a stray key.
+var knownQueues = []string{
+	"image:jobs:high",
+	"image:jobs",
+	"image:retry",
+	"image:jobs:bulk",
+	"image:failed",
+	"image:done",
+	"zip:jobs",
+}
+
+// priorityQueues maps an image job's priority to the queue producers push it
+// onto, mirroring the image-worker.
+var priorityQueues = map[string]string{
+	"":       "image:jobs",
+	"high":   "image:jobs:high",
+	"normal": "image:jobs",
+	"bulk":   "image:jobs:bulk",
+}
+
+// streamQueues are the queues the workers also read from a <queue>:stream
+// stream when run with -queue-transport=streams: the intake queues and the
+// image-worker's retry lane. image:failed and image:done are always lists.
+var streamQueues = map[string]bool{
+	"image:jobs:high": true,
+	"image:jobs":      true,
+	"image:retry":     true,
+	"image:jobs:bulk": true,
+	"zip:jobs":        true,
+}
+
+// errInProgress is returned for a stream entry a worker has been delivered
+// and not yet acknowledged; taking it would run the job twice.
+var errInProgress = errors.New("job is being processed by a worker")
+
+func isKnownQueue(name string) bool {
+	for _, queue := range knownQueues {
+		if queue == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Config holds the connection settings, shared in name and environment
+// with both workers through workercfg, and the transport moved jobs are
+// pushed with.
+type Config struct {
+	Redis     workercfg.RedisConfig
+	Transport string
+}
+
+// registerFlags binds the settings to flags on fs.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	c.Redis.RegisterFlags(fs)
+	fs.StringVar(&c.Transport, "queue-transport", "list", "How requeued and moved jobs are pushed: list or streams")
+}
+
+// loadConfig applies the environment the workers and the server read under
+// the flags explicitly set on the already parsed fs.
+func (c *Config) loadConfig(fs *flag.FlagSet) error {
+	if err := workercfg.Load(fs, "", nil, workercfg.RedisEnv); err != nil {
+		return err
+	}
+	if err := errors.Join(c.Redis.Validate()...); err != nil {
+		return err
+	}
+	if c.Transport != "list" && c.Transport != "streams" {
+		return fmt.Errorf("unknown queue transport %q (want list or streams)", c.Transport)
+	}
+	return nil
+}
+
+// admin runs commands against one Redis database.
+type admin struct {
+	rdb       *redis.Client
+	prefix    string
+	transport string
+}
+
+func newAdmin(cfg Config) (*admin, error) {
+	rdb := workercfg.NewRedisClient(cfg.Redis)
+
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("failed to connect to Redis at %s: %v", cfg.Redis.Addr, err)
+	}
+
+	return &admin{rdb: rdb, prefix: cfg.Redis.KeyPrefix, transport: cfg.Transport}, nil
+}
+
+func (a *admin) key(name string) string {
+	return a.prefix + name
+}
+
+// jobError is one failed attempt recorded by the image-worker.
+type jobError struct {
+	Attempt   int    `json:"attempt"`
+	Error     string `json:"error"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// jobSummary holds the fields of image and zip jobs the commands look at.
+type jobSummary struct {
+	JobID      string            `json:"jobId"`
+	UserID     string            `json:"userId"`
+	Priority   string            `json:"priority"`
+	RetryCount int               `json:"retryCount"`
+	Timestamp  int64             `json:"timestamp"`
+	Operations []json.RawMessage `json:"operations"` // names or objects
+	Items      []json.RawMessage `json:"items"`
+	Errors     []jobError        `json:"errors"`
+}
+
+// entry is one job in a list or stream. Raw is kept exactly as stored, both
+// to remove it with LREM and so fields this tool does not know survive a
+// move. Stream entries are identified by StreamID instead of Index.
+type entry struct {
+	Index    int64
+	StreamID string
+	Consumer string // the worker a stream entry is pending on, if any
+	Raw      string
+	Job      jobSummary
+	Err      error // set when Raw is not a valid job
+}
+
+// Where reports the position of e in queue for listings.
+func (e entry) Where(queue string) string {
+	if e.StreamID == "" {
+		return fmt.Sprintf("%s [%d]", queue, e.Index)
+	}
+	if e.Consumer != "" {
+		return fmt.Sprintf("%s:stream [%s] pending on %s", queue, e.StreamID, e.Consumer)
+	}
+	return fmt.Sprintf("%s:stream [%s]", queue, e.StreamID)
+}
+
+const scanPageSize = 500
+
+// scan calls fn for every entry of queue, from the left end of the list and
+// then, for stream-backed queues, from the oldest stream entry, until fn
+// returns false.
+func (a *admin) scan(ctx context.Context, queue string, fn func(entry) bool) error {
+	for start := int64(0); ; start += scanPageSize {
+		values, err := a.rdb.LRange(ctx, a.key(queue), start, start+scanPageSize-1).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", queue, err)
+		}
+
+		for i, raw := range values {
+			e := entry{Index: start + int64(i), Raw: raw}
+			e.Err = json.Unmarshal([]byte(raw), &e.Job)
+			if !fn(e) {
+				return nil
+			}
+		}
+		if len(values) < scanPageSize {
+			break
+		}
+	}
+
+	if !streamQueues[queue] {
+		return nil
+	}
+	stream := a.key(queue + ":stream")
+	pending, err := a.pending(ctx, stream)
+	if err != nil {
+		return err
+	}
+	for start := "-"; ; {
+		msgs, err := a.rdb.XRangeN(ctx, stream, start, "+", scanPageSize).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read %s:stream: %v", queue, err)
+		}
+
+		for _, msg := range msgs {
+			e := entry{StreamID: msg.ID, Consumer: pending[msg.ID]}
+			e.Raw, _ = msg.Values["job"].(string)
+			e.Err = json.Unmarshal([]byte(e.Raw), &e.Job)
+			if !fn(e) {
+				return nil
+			}
+		}
+		if len(msgs) < scanPageSize {
+			return nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+// pending maps the IDs of the entries of stream delivered to a worker and
+// not yet acknowledged, in any consumer group, to that worker.
+func (a *admin) pending(ctx context.Context, stream string) (map[string]string, error) {
+	groups, err := a.rdb.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read groups of %s: %v", stream, err)
+	}
+
+	pending := make(map[string]string)
+	for _, group := range groups {
+		for start := "-"; ; {
+			page, err := a.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: stream,
+				Group:  group.Name,
+				Start:  start,
+				End:    "+",
+				Count:  scanPageSize,
+			}).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read pending entries of %s: %v", stream, err)
+			}
+			for _, p := range page {
+				pending[p.ID] = group.Name + "/" + p.Consumer
+			}
+			if len(page) < scanPageSize {
+				break
+			}
+			start = "(" + page[len(page)-1].ID
+		}
+	}
+	return pending, nil
+}
+
+// takeScript defines take(key, raw, id), which removes one exact job from a
+// list, or the entry id from a stream unless a consumer group has it pending.
+// It returns 1 when the job was removed, 0 when it was already gone, e.g.
+// taken by a worker since it was read, and -1 when it is being processed.
+const takeScript = `
+local function take(key, raw, id)
+	if id == '' then
+		return redis.call('LREM', key, 1, raw)
+	end
+	if redis.call('EXISTS', key) == 0 then
+		return 0
+	end
+	for _, group in ipairs(redis.call('XINFO', 'GROUPS', key)) do
+		for i = 1, #group, 2 do
+			if group[i] == 'name' and #redis.call('XPENDING', key, group[i + 1], id, id, 1) > 0 then
+				return -1
+			end
+		end
+	end
+	return redis.call('XDEL', key, id)
+end
+`
+
+// moveScript takes one job and pushes its replacement onto another list or
+// stream, atomically.
+var moveScript = redis.NewScript(takeScript + `
+local taken = take(KEYS[1], ARGV[1], ARGV[4])
+if taken ~= 1 then
+	return taken
+end
+if ARGV[3] == 'streams' then
+	redis.call('XADD', KEYS[2], '*', 'job', ARGV[2])
+else
+	redis.call('RPUSH', KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+var removeScript = redis.NewScript(takeScript + `
+return take(KEYS[1], ARGV[1], ARGV[2])
+`)
+
+// source is the key e is stored under in queue.
+func (a *admin) source(queue string, e entry) string {
+	if e.StreamID != "" {
+		return a.key(queue + ":stream")
+	}
+	return a.key(queue)
+}
+
+// move replaces the job e in from with updated in to. Jobs go onto the
+// stream of to only with -queue-transport=streams and when the workers read
+// to as a stream. It reports whether the job was still there, and returns
+// errInProgress for a stream entry a worker has pending.
+func (a *admin) move(ctx context.Context, from, to string, e entry, updated string) (bool, error) {
+	dest := a.key(to)
+	if a.transport == "streams" && streamQueues[to] {
+		dest = a.key(to + ":stream")
+	}
+
+	moved, err := moveScript.Run(ctx, a.rdb, []string{a.source(from, e), dest}, e.Raw, updated, a.transport, e.StreamID).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to move job from %s to %s: %v", from, to, err)
+	}
+	if moved < 0 {
+		return false, errInProgress
+	}
+	return moved == 1, nil
+}
+
+// remove deletes the job e from queue. It reports whether the job was still
+// there, and returns errInProgress for a stream entry a worker has pending.
+func (a *admin) remove(ctx context.Context, queue string, e entry) (bool, error) {
+	removed, err := removeScript.Run(ctx, a.rdb, []string{a.source(queue, e)}, e.Raw, e.StreamID).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to remove job from %s: %v", queue, err)
+	}
+	if removed < 0 {
+		return false, errInProgress
+	}
+	return removed == 1, nil
+}
+
+// resetRetries returns raw with retryCount set to 0, keeping every other
+// field, including the error history, as is. Jobs without a retry count,
+// such as zip jobs, are returned unchanged.
+func resetRetries(raw string) (string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil {
+		return "", fmt.Errorf("invalid job: %v", err)
+	}
+	if _, ok := fields["retryCount"]; !ok {
+		return raw, nil
+	}
+	fields["retryCount"] = json.RawMessage("0")
+
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
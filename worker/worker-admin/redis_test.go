@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"worker-common/workercfg"
+)
+
+func TestResetRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]any // nil when raw comes back unchanged
+		wantErr bool
+	}{
+		{
+			name: "retried image job",
+			raw:  `{"jobId":"a","retryCount":3,"priority":"high","errors":[{"attempt":1,"error":"boom","timestamp":1}]}`,
+			want: map[string]any{
+				"jobId":      "a",
+				"retryCount": float64(0),
+				"priority":   "high",
+				"errors":     []any{map[string]any{"attempt": float64(1), "error": "boom", "timestamp": float64(1)}},
+			},
+		},
+		{
+			name: "unknown fields survive",
+			raw:  `{"jobId":"a","retryCount":1,"futureField":{"x":[1,2]}}`,
+			want: map[string]any{"jobId": "a", "retryCount": float64(0), "futureField": map[string]any{"x": []any{float64(1), float64(2)}}},
+		},
+		{
+			name: "zip job without retry count",
+			raw:  `{"jobId":"zip_1","items":[]}`,
+		},
+		{
+			name:    "not JSON",
+			raw:     `not a job`,
+			wantErr: true,
+		},
+		{
+			name:    "not an object",
+			raw:     `["a"]`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resetRetries(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resetRetries(%s) = %s, want error", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resetRetries(%s): %v", tt.raw, err)
+			}
+
+			if tt.want == nil {
+				if got != tt.raw {
+					t.Errorf("resetRetries(%s) = %s, want it unchanged", tt.raw, got)
+				}
+				return
+			}
+			var fields map[string]any
+			if err := json.Unmarshal([]byte(got), &fields); err != nil {
+				t.Fatalf("resetRetries returned invalid JSON %s: %v", got, err)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("resetRetries(%s) = %s", tt.raw, got)
+			}
+		})
+	}
+}
+
+func TestEntryWhere(t *testing.T) {
+	tests := []struct {
+		e    entry
+		want string
+	}{
+		{entry{Index: 4}, "image:failed [4]"},
+		{entry{StreamID: "1700000000000-0"}, "image:failed:stream [1700000000000-0]"},
+		{entry{StreamID: "1700000000000-0", Consumer: "image-workers/host-1"}, "image:failed:stream [1700000000000-0] pending on image-workers/host-1"},
+	}
+	for _, tt := range tests {
+		if got := tt.e.Where("image:failed"); got != tt.want {
+			t.Errorf("Where = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+// testAdmin connects to the Redis named by REDIS_ADDR and scopes every key
+// to a prefix of its own, deleted after the test. The test is skipped when
+// REDIS_ADDR is unset, e.g.
+//
+//	docker run -p 6379:6379 redis
+//	REDIS_ADDR=localhost:6379 go test .
+func testAdmin(t *testing.T, transport string) *admin {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+
+	cfg := Config{
+		Redis:     workercfg.RedisConfig{Addr: addr, KeyPrefix: fmt.Sprintf("worker-admin-test-%d:", time.Now().UnixNano())},
+		Transport: transport,
+	}
+	a, err := newAdmin(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		keys, _ := a.rdb.Keys(ctx, cfg.Redis.KeyPrefix+"*").Result()
+		if len(keys) > 0 {
+			a.rdb.Del(ctx, keys...)
+		}
+		a.rdb.Close()
+	})
+	return a
+}
+
+func TestMoveList(t *testing.T) {
+	a := testAdmin(t, "list")
+	ctx := context.Background()
+
+	for _, raw := range []string{`{"jobId":"a"}`, `{"jobId":"b"}`} {
+		a.rdb.RPush(ctx, a.key("image:failed"), raw)
+	}
+	e := entry{Index: 1, Raw: `{"jobId":"b"}`}
+
+	moved, err := a.move(ctx, "image:failed", "image:jobs", e, `{"jobId":"b","retryCount":0}`)
+	if err != nil || !moved {
+		t.Fatalf("move = %v, %v, want true", moved, err)
+	}
+	if got := a.rdb.LRange(ctx, a.key("image:failed"), 0, -1).Val(); !reflect.DeepEqual(got, []string{`{"jobId":"a"}`}) {
+		t.Errorf("image:failed = %v", got)
+	}
+	if got := a.rdb.LRange(ctx, a.key("image:jobs"), 0, -1).Val(); !reflect.DeepEqual(got, []string{`{"jobId":"b","retryCount":0}`}) {
+		t.Errorf("image:jobs = %v", got)
+	}
+
+	// A job taken since it was listed is not pushed again
+	moved, err = a.move(ctx, "image:failed", "image:jobs", e, e.Raw)
+	if err != nil || moved {
+		t.Errorf("second move = %v, %v, want false", moved, err)
+	}
+	if n := a.rdb.LLen(ctx, a.key("image:jobs")).Val(); n != 1 {
+		t.Errorf("image:jobs has %d jobs after the second move, want 1", n)
+	}
+}
+
+func TestMoveToStream(t *testing.T) {
+	a := testAdmin(t, "streams")
+	ctx := context.Background()
+
+	a.rdb.RPush(ctx, a.key("image:failed"), `{"jobId":"a"}`)
+	moved, err := a.move(ctx, "image:failed", "image:jobs", entry{Raw: `{"jobId":"a"}`}, `{"jobId":"a"}`)
+	if err != nil || !moved {
+		t.Fatalf("move = %v, %v, want true", moved, err)
+	}
+
+	msgs := a.rdb.XRange(ctx, a.key("image:jobs:stream"), "-", "+").Val()
+	if len(msgs) != 1 || msgs[0].Values["job"] != `{"jobId":"a"}` {
+		t.Errorf("image:jobs:stream = %v", msgs)
+	}
+	if n := a.rdb.LLen(ctx, a.key("image:jobs")).Val(); n != 0 {
+		t.Errorf("image:jobs list has %d jobs, want 0", n)
+	}
+}
+
+func TestRemoveStreamEntry(t *testing.T) {
+	a := testAdmin(t, "streams")
+	ctx := context.Background()
+	stream := a.key("image:jobs:stream")
+
+	add := func(id string) entry {
+		raw := fmt.Sprintf(`{"jobId":%q}`, id)
+		streamID := a.rdb.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: map[string]any{"job": raw}}).Val()
+		return entry{StreamID: streamID, Raw: raw}
+	}
+	idle := add("idle")
+	a.rdb.XGroupCreate(ctx, stream, "image-workers", "$")
+	delivered := add("delivered")
+
+	// A worker reads delivered, so it is pending and must not be taken
+	if err := a.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "image-workers",
+		Consumer: "host-1",
+		Streams:  []string{stream, ">"},
+		Count:    1,
+	}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.remove(ctx, "image:jobs", delivered); !errors.Is(err, errInProgress) {
+		t.Errorf("remove(delivered) = %v, want errInProgress", err)
+	}
+	if removed, err := a.remove(ctx, "image:jobs", idle); err != nil || !removed {
+		t.Errorf("remove(idle) = %v, %v, want true", removed, err)
+	}
+	if removed, err := a.remove(ctx, "image:jobs", idle); err != nil || removed {
+		t.Errorf("second remove(idle) = %v, %v, want false", removed, err)
+	}
+	if n := a.rdb.XLen(ctx, stream).Val(); n != 1 {
+		t.Errorf("stream has %d entries, want 1", n)
+	}
+}
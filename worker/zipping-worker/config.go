@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"worker-common/workercfg"
+)
+
+// Config is the worker's effective configuration, resolved by
+// workercfg.Load.
+type Config struct {
+	Redis workercfg.RedisConfig `yaml:"redis"`
+	S3    workercfg.S3Config    `yaml:"s3"`
+
+	Concurrency int    `yaml:"concurrency"`
+	DataDir     string `yaml:"data_dir"`
+
+	QueueTransport  string        `yaml:"queue_transport"`
+	StreamGroup     string        `yaml:"stream_group"`
+	StreamClaimIdle time.Duration `yaml:"stream_claim_idle"`
+
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"`
+
+	MetricsAddr string `yaml:"metrics_addr"`
+	LogLevel    string `yaml:"log_level"`
+	LogFormat   string `yaml:"log_format"`
+}
+
+// configEnv maps each worker-specific flag to the environment variable
+// overriding it. The Redis and S3 variables are workercfg's.
+var configEnv = map[string]string{
+	"concurrency": "ZIP_CONCURRENCY",
+	"data-dir":    "ZIP_DATA_DIR",
+
+	"queue-transport":   "ZIP_QUEUE_TRANSPORT",
+	"stream-group":      "ZIP_STREAM_GROUP",
+	"stream-claim-idle": "ZIP_STREAM_CLAIM_IDLE",
+
+	"shutdown-grace": "ZIP_SHUTDOWN_GRACE",
+
+	"metrics-addr": "ZIP_METRICS_ADDR",
+	"log-level":    "ZIP_LOG_LEVEL",
+	"log-format":   "ZIP_LOG_FORMAT",
+}
+
+// registerFlags binds every config setting to a flag on fs.
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	c.Redis.RegisterFlags(fs)
+	c.S3.RegisterFlags(fs)
+
+	fs.IntVar(&c.Concurrency, "concurrency", 1, "Number of archives built in parallel")
+	fs.StringVar(&c.DataDir, "data-dir", "", "Directory archives are written to, checked by /readyz (default: taken from the first job)")
+
+	fs.StringVar(&c.QueueTransport, "queue-transport", "list", "Job intake transport: list or streams")
+	fs.StringVar(&c.StreamGroup, "stream-group", "zip-workers", "Consumer group name when -queue-transport=streams")
+	fs.DurationVar(&c.StreamClaimIdle, "stream-claim-idle", 10*time.Minute, "Reclaim stream messages pending longer than this")
+
+	fs.DurationVar(&c.ShutdownGrace, "shutdown-grace", 30*time.Second, "How long in-flight archives may run after SIGTERM before they are requeued")
+
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", ":9102", "Address to serve /metrics, /healthz and /readyz on (empty or \"off\" to disable)")
+	fs.StringVar(&c.LogLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.StringVar(&c.LogFormat, "log-format", "json", "Log format: json or text")
+}
+
+// loadConfig layers the config file at path and the environment under the
+// flags explicitly set on the already parsed fs, then validates the result.
+func (c *Config) loadConfig(fs *flag.FlagSet, path string) error {
+	if err := workercfg.Load(fs, path, c, workercfg.RedisEnv, workercfg.S3Env, configEnv); err != nil {
+		return err
+	}
+
+	if c.MetricsAddr == "off" {
+		c.MetricsAddr = ""
+	}
+
+	return c.validate()
+}
+
+// validate reports every invalid setting at once.
+func (c *Config) validate() error {
+	errs := append(c.Redis.Validate(), c.S3.Validate()...)
+	if c.Concurrency < 1 {
+		errs = append(errs, fmt.Errorf("concurrency must be at least 1, got %d", c.Concurrency))
+	}
+	if c.DataDir != "" {
+		if info, err := os.Stat(c.DataDir); err != nil {
+			errs = append(errs, fmt.Errorf("data_dir: %v", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("data_dir %s is not a directory", c.DataDir))
+		}
+	}
+	if c.QueueTransport != "list" && c.QueueTransport != "streams" {
+		errs = append(errs, fmt.Errorf("unknown queue_transport %q (want list or streams)", c.QueueTransport))
+	}
+	if c.StreamGroup == "" {
+		errs = append(errs, errors.New("stream_group is empty"))
+	}
+	if c.StreamClaimIdle <= 0 {
+		errs = append(errs, fmt.Errorf("stream_claim_idle must be positive, got %s", c.StreamClaimIdle))
+	}
+	if c.ShutdownGrace < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_grace must not be negative, got %s", c.ShutdownGrace))
+	}
+	errs = append(errs, workercfg.ValidateLogging(c.LogLevel, c.LogFormat)...)
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy safe to log or print.
+func (c Config) redacted() Config {
+	c.Redis = c.Redis.Redacted()
+	c.S3 = c.S3.Redacted()
+	return c
+}
+
+// toYAML renders the config in config file format.
+func (c Config) toYAML() string {
+	return workercfg.YAML(c)
+}
+
+// LogValue logs the redacted config under its config file keys.
+func (c Config) LogValue() slog.Value {
+	return workercfg.LogValue(c.redacted())
+}
+
+// keyPrefix namespaces every Redis key and channel the worker touches.
+var keyPrefix string
+
+func key(name string) string {
+	return keyPrefix + name
+}
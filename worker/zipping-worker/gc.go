@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"worker-common/workercfg"
+)
+
+// archiveJobID returns the job a file in the data dir belongs to. tmp is set
+// for partial archives a worker left behind before renaming them into place.
+func archiveJobID(name string) (jobID string, tmp, ok bool) {
+	if base, found := strings.CutSuffix(name, ".tmp"); found {
+		name, tmp = base, true
+	}
+	jobID, ok = strings.CutSuffix(name, ".zip")
+	if !ok || jobID == "" {
+		return "", false, false
+	}
+	return jobID, tmp, true
+}
+
+// collectGarbage removes archives in dir older than grace that can no longer
+// be downloaded: their status hash has expired or the job failed. Archives of
+// pending, running and ready jobs are kept. Partial archives are removed
+// once older than grace whatever their job's status, as a running job keeps
+// writing to its own. It returns how many files and bytes were removed, or
+// would have been in dry-run mode.
+func collectGarbage(rdb *redis.Client, dir string, grace time.Duration, dryRun bool) (int, int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var files int
+	var bytes int64
+	cutoff := time.Now().Add(-grace)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		jobID, tmp, ok := archiveJobID(entry.Name())
+		if !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if !tmp {
+			status, err := rdb.HGet(ctx, key("zip:job:"+jobID), "status").Result()
+			if err != nil && err != redis.Nil {
+				return files, bytes, fmt.Errorf("failed to read status of %s: %v", jobID, err)
+			}
+			if err == nil && status != "FAILED" {
+				continue
+			}
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				slog.Error("Failed to remove orphaned archive", "path", path, logKeyError, err)
+				continue
+			}
+		}
+
+		files++
+		bytes += info.Size()
+		slog.Debug("Removed orphaned archive", logKeyJobID, jobID, "path", path, "size", info.Size(), "dry_run", dryRun)
+	}
+
+	return files, bytes, nil
+}
+
+// runGC implements the "gc" subcommand. It takes the worker's config file,
+// environment and flags; -data-dir names the directory archives are written
+// to and is required.
+//
+//	zipping-worker gc -data-dir ./server/uploads/temp -grace 24h -dry-run
+//
+// It returns the process exit code.
+func runGC(args []string) int {
+	fset := flag.NewFlagSet("gc", flag.ContinueOnError)
+	var cfg Config
+	cfg.registerFlags(fset)
+	configPath := fset.String("config", os.Getenv("ZIP_CONFIG"), "YAML config file (env ZIP_CONFIG)")
+	grace := fset.Duration("grace", 24*time.Hour, "Only remove archives last modified longer ago than this")
+	dryRun := fset.Bool("dry-run", false, "Report what would be removed without deleting anything")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := cfg.loadConfig(fset, *configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 2
+	}
+	if cfg.DataDir == "" {
+		fmt.Fprintln(os.Stderr, "gc: -data-dir (or ZIP_DATA_DIR) is required")
+		return 2
+	}
+	if err := setupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		return 2
+	}
+
+	keyPrefix = cfg.Redis.KeyPrefix
+	rdb := workercfg.NewRedisClient(cfg.Redis)
+	defer rdb.Close()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		slog.Error("Failed to connect to Redis", "addr", cfg.Redis.Addr, logKeyError, err)
+		return 1
+	}
+
+	slog.Info("Collecting orphaned archives", "dir", cfg.DataDir, "grace", grace.String(), "dry_run", *dryRun)
+	files, bytes, err := collectGarbage(rdb, cfg.DataDir, *grace, *dryRun)
+	if err != nil {
+		slog.Error("Garbage collection stopped", "files", files, "bytes", bytes, logKeyError, err)
+		return 1
+	}
+
+	slog.Info("Garbage collection complete", "files", files, "bytes", bytes, "dry_run", *dryRun)
+	return 0
+}
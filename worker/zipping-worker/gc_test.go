@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveJobID(t *testing.T) {
+	tests := []struct {
+		name  string
+		jobID string
+		tmp   bool
+		ok    bool
+	}{
+		{"abc123.zip", "abc123", false, true},
+		{"abc123.zip.tmp", "abc123", true, true},
+		{"zip_1700000000_x.zip", "zip_1700000000_x", false, true},
+		{".zip", "", false, false},
+		{".zip.tmp", "", false, false},
+		{"abc123.tmp", "", false, false},
+		{"abc123.zip.part", "", false, false},
+		{"upload_chunk_0", "", false, false},
+		{"photo.webp", "", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobID, tmp, ok := archiveJobID(tt.name)
+			if jobID != tt.jobID || tmp != tt.tmp || ok != tt.ok {
+				t.Errorf("archiveJobID(%q) = %q, %v, %v, want %q, %v, %v", tt.name, jobID, tmp, ok, tt.jobID, tt.tmp, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCollectGarbageRemovesStalePartials(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+
+	files := []struct {
+		name    string
+		stale   bool
+		removed bool
+	}{
+		{"crashed.zip.tmp", true, true},
+		{"running.zip.tmp", false, false},
+		{"upload_chunk_0", true, false},
+		{"other.tmp", true, false},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if f.stale {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Partial archives never need their job's status, so no Redis client
+	n, size, err := collectGarbage(nil, dir, 24*time.Hour, false)
+	if err != nil {
+		t.Fatalf("collectGarbage: %v", err)
+	}
+	if n != 1 || size != int64(len("partial")) {
+		t.Errorf("collectGarbage removed %d files, %d bytes, want 1, %d", n, size, len("partial"))
+	}
+
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if gone := errors.Is(err, os.ErrNotExist); gone != f.removed {
+			t.Errorf("%s: removed = %v, want %v", f.name, gone, f.removed)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"worker-common/healthcheck"
+	"worker-common/storage"
+)
+
+// loopStallTimeout is how long the consumer loop may go without polling
+// while idle before it is reported as hung. Fetch returns at least every 5s.
+const loopStallTimeout = time.Minute
+
+// jobStallTimeout is how long an archive may go without reading an item or
+// writing a byte before the job is reported as hung. Large archives are fine
+// as long as they keep moving.
+const jobStallTimeout = 5 * time.Minute
+
+// workerHealth tracks the consumer loops and their jobs for /healthz and
+// /readyz.
+type workerHealth struct {
+	rdb *redis.Client
+
+	mu        sync.Mutex
+	started   bool
+	lastPoll  time.Time
+	outputDir string
+	// Last progress of each job being built, by job ID.
+	jobs map[string]time.Time
+}
+
+var health = &workerHealth{}
+
+// polled records that a consumer loop is about to wait for a job.
+func (h *workerHealth) polled() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = true
+	h.lastPoll = time.Now()
+}
+
+// processing records that a loop is building the archive of jobID into
+// outputDir.
+func (h *workerHealth) processing(jobID, outputDir string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.jobs == nil {
+		h.jobs = make(map[string]time.Time)
+	}
+	h.jobs[jobID] = time.Now()
+	h.outputDir = outputDir
+}
+
+// progressed records that the archive of jobID is still moving.
+func (h *workerHealth) progressed(jobID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.jobs[jobID]; ok {
+		h.jobs[jobID] = time.Now()
+	}
+}
+
+// finished records that a loop is done with the archive of jobID.
+func (h *workerHealth) finished(jobID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.jobs, jobID)
+}
+
+// live fails when the consumer loops have stopped polling while idle, or
+// when an archive has made no progress for jobStallTimeout.
+func (h *workerHealth) live() map[string]error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var err error
+	switch {
+	case !h.started:
+		err = errors.New("consumer loop not started")
+	case len(h.jobs) == 0 && time.Since(h.lastPoll) > loopStallTimeout:
+		err = fmt.Errorf("consumer loop has not polled for %v", time.Since(h.lastPoll).Round(time.Second))
+	}
+
+	var stalled []string
+	for jobID, last := range h.jobs {
+		if time.Since(last) > jobStallTimeout {
+			stalled = append(stalled, jobID)
+		}
+	}
+	var jobsErr error
+	if len(stalled) > 0 {
+		sort.Strings(stalled)
+		jobsErr = fmt.Errorf("no progress for over %v on jobs %v", jobStallTimeout, stalled)
+	}
+	return map[string]error{"consumer": err, "jobs": jobsErr}
+}
+
+// ready adds Redis and, once -data-dir or a job has revealed where archives
+// go, the writability of that directory.
+func (h *workerHealth) ready(r *http.Request) map[string]error {
+	checks := h.live()
+
+	pingCtx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	checks["redis"] = h.rdb.Ping(pingCtx).Err()
+
+	h.mu.Lock()
+	outputDir := h.outputDir
+	h.mu.Unlock()
+	if outputDir != "" && !storage.IsS3URI(outputDir) {
+		checks["output_dir"] = healthcheck.Writable(outputDir)
+	}
+	return checks
+}
+
+func (h *workerHealth) handleLive(w http.ResponseWriter, r *http.Request) {
+	healthcheck.Write(w, h.live())
+}
+
+func (h *workerHealth) handleReady(w http.ResponseWriter, r *http.Request) {
+	healthcheck.Write(w, h.ready(r))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log field names shared with the image-worker and the server's JSON logs.
+const (
+	logKeyJobID      = "job_id"
+	logKeyUserID     = "user_id"
+	logKeyDurationMS = "duration_ms"
+	logKeyBytesIn    = "bytes_in"
+	logKeyBytesOut   = "bytes_out"
+	logKeyError      = "error"
+)
+
+// setupLogging installs a slog handler writing format ("json" or "text") at
+// level (debug, info, warn or error) to stdout as the default logger.
+func setupLogging(level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %v", level, err)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("invalid log format %q (want json or text)", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
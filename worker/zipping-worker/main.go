@@ -4,16 +4,27 @@ import (
 	"archive/zip"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"worker-common/jobjson"
+	"worker-common/storage"
+	"worker-common/workercfg"
 )
 
 type JobItem struct {
@@ -21,122 +32,332 @@ type JobItem struct {
 	Target string `json:"target"`
 }
 
+// jobVersion is the payload version this worker understands. Payloads
+// without a version predate versioning; see schemas/zip-job.schema.json.
+const jobVersion = 1
+
 type Job struct {
+	Version   int       `json:"version"`
 	JobId     string    `json:"jobId"`
 	Items     []JobItem `json:"items"`
 	UserId    string    `json:"userId"`
 	OutputDir string    `json:"outputDir"`
+	Timestamp int64     `json:"timestamp,omitempty"`
+
+	// W3C trace context of the producer
+	Traceparent string `json:"traceparent,omitempty"`
+	Tracestate  string `json:"tracestate,omitempty"`
+
+	// Why the payload was rejected on decode; processJob fails the job with it
+	decodeErr error
+}
+
+// decodeJob parses a queued payload. Malformed JSON is an error. Mistyped
+// and unknown fields and unsupported versions are recorded on the job, so
+// its status hash is set to FAILED with the reason instead of the job
+// silently staying PENDING.
+func decodeJob(data []byte) (Job, error) {
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			return job, err
+		}
+		job.decodeErr = fmt.Errorf("invalid %s: got %s, want %s", typeErr.Field, typeErr.Value, typeErr.Type)
+		return job, nil
+	}
+
+	var raw struct {
+		Items []map[string]json.RawMessage `json:"items"`
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return job, err
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return job, err
+	}
+	unknown := jobjson.Unknown(fields, jobFields, "")
+	for i, item := range raw.Items {
+		unknown = append(unknown, jobjson.Unknown(item, itemFields, fmt.Sprintf("items[%d].", i))...)
+	}
+	if len(unknown) > 0 {
+		job.decodeErr = fmt.Errorf("unknown job fields: %s", strings.Join(unknown, ", "))
+		return job, nil
+	}
+
+	switch {
+	case job.Version > jobVersion:
+		job.decodeErr = fmt.Errorf("unsupported job version %d (this worker handles up to %d)", job.Version, jobVersion)
+	case job.Version < 0:
+		job.decodeErr = fmt.Errorf("invalid job version %d", job.Version)
+	case job.Version == 0:
+		// Version 0 payloads are the same format without the field
+		job.Version = jobVersion
+	}
+	return job, nil
+}
+
+var (
+	jobFields  = jobjson.Fields(reflect.TypeOf(Job{}))
+	itemFields = jobjson.Fields(reflect.TypeOf(JobItem{}))
+)
+
+// JobEvent is published on the zip:events channel as a job progresses so the
+// server can push updates to the browser instead of polling getZipJob.
+type JobEvent struct {
+	Type      string `json:"type"`
+	JobId     string `json:"jobId"`
+	UserId    string `json:"userId,omitempty"`
+	Progress  int    `json:"progress"`
+	FilePath  string `json:"filePath,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Timestamp int64  `json:"timestamp"`
 }
 
-// Global context for graceful shutdown
+const eventChannel = "zip:events"
+
+// Context for Redis status updates and events. It is never cancelled, so
+// bookkeeping still happens while the worker shuts down.
 var ctx = context.Background()
 
+// store reads archive sources and writes archives, locally or to S3.
+var store storage.Storage
+
+// errJobInterrupted is returned by processJob when shutdown aborted the job.
+var errJobInterrupted = errors.New("interrupted by shutdown")
+
+var (
+	configPath  = flag.String("config", os.Getenv("ZIP_CONFIG"), "YAML config file (env ZIP_CONFIG)")
+	printConfig = flag.Bool("print-config", false, "Print the effective configuration as YAML and exit")
+)
+
 func main() {
-	// Initialize Redis
-	redisHost := os.Getenv("REDIS_HOST")
-	if redisHost == "" {
-		redisHost = "localhost"
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		os.Exit(runGC(os.Args[2:]))
 	}
-	redisPort := os.Getenv("REDIS_PORT")
-	if redisPort == "" {
-		redisPort = "6379"
+
+	var cfg Config
+	cfg.registerFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := cfg.loadConfig(flag.CommandLine, *configPath); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if *printConfig {
+		fmt.Print(cfg.redacted().toYAML())
+		return
 	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%s", redisHost, redisPort),
-		DB:   0,
-	})
+	if err := setupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	slog.Info("Starting zip worker", "config", cfg)
+
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		fatal("Failed to set up tracing", logKeyError, err)
+	}
+	defer shutdownTracing(ctx)
+
+	// Initialize Redis
+	keyPrefix = cfg.Redis.KeyPrefix
+	rdb := workercfg.NewRedisClient(cfg.Redis)
 
 	// Check connection
-	_, err := rdb.Ping(ctx).Result()
+	_, err = rdb.Ping(ctx).Result()
+	if err != nil {
+		fatal("Failed to connect to Redis", "addr", cfg.Redis.Addr, logKeyError, err)
+	}
+	slog.Info("Connected to Redis", "addr", cfg.Redis.Addr, "db", cfg.Redis.DB)
+
+	store, err = storage.New(cfg.S3)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		fatal("Failed to set up storage", logKeyError, err)
 	}
-	log.Printf("Connected to Redis at %s:%s", redisHost, redisPort)
 
 	// Setup graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
-	// Consumer loop
-	log.Println("Worker started. Waiting for jobs...")
-	go func() {
-		for {
-			// Blocking pop from list
-			// timeout 0 blocks indefinitely, but we can't cancel it easily in some clients?
-			// Actually go-redis BLPOP takes a timeout. We loop with 5 seconds to check for signals?
-			result, err := rdb.BLPop(ctx, 5*time.Second, "zip:jobs").Result()
-			if err != nil {
-				if err == redis.Nil {
-					continue // Timeout, loop again
-				}
-				// If context canceled (during shutdown)
-				if ctx.Err() != nil {
-					return
-				}
-				log.Printf("Redis error: %v", err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
-
-			// result[0] is key, result[1] is value
-			jobJSON := result[1]
-			var job Job
-			if err := json.Unmarshal([]byte(jobJSON), &job); err != nil {
-				log.Printf("Failed to unmarshal job: %v", err)
-				continue
-			}
+	// Select job intake transport
+	var queue JobQueue = &listQueue{rdb: rdb}
+	streamGroup := ""
+	if cfg.QueueTransport == "streams" {
+		streamGroup = cfg.StreamGroup
+		hostname, _ := os.Hostname()
+		consumer := fmt.Sprintf("%s-%d", hostname, os.Getpid())
 
-			log.Printf("Processing job: %s (Items: %d)", job.JobId, len(job.Items))
-			processJob(rdb, job)
+		sq, err := newStreamQueue(rdb, cfg.StreamGroup, consumer, cfg.StreamClaimIdle)
+		if err != nil {
+			fatal("Failed to enable stream transport", logKeyError, err)
 		}
+		go sq.monitor(time.Minute)
+		queue = sq
+		slog.Info("Stream transport enabled", "group", cfg.StreamGroup, "consumer", consumer)
+	}
+
+	// Metrics and health endpoints
+	if cfg.MetricsAddr != "" {
+		health.rdb = rdb
+		health.outputDir = cfg.DataDir
+		go serveStatus(rdb, streamGroup, cfg.MetricsAddr)
+	}
+
+	// Shutdown happens in two phases: stopFetching lets in-flight archives
+	// finish, abortJobs interrupts them once the grace period is over
+	fetchCtx, stopFetching := context.WithCancel(ctx)
+	defer stopFetching()
+	abortCtx, abortJobs := context.WithCancel(ctx)
+	defer abortJobs()
+
+	// Consumer loops
+	slog.Info("Worker started. Waiting for jobs...", "concurrency", cfg.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consume(fetchCtx, abortCtx, queue, rdb)
+		}()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
 	}()
 
 	// Wait for shutdown signal
 	<-quit
-	log.Println("Shutting down worker...")
-	// Cancel context if we used one for BLPOP
+	slog.Info("Shutting down worker, draining in-flight jobs", "grace", cfg.ShutdownGrace.String())
+	stopFetching()
+
+	select {
+	case <-stopped:
+	case <-time.After(cfg.ShutdownGrace):
+		slog.Warn("Shutdown grace period expired, requeueing unfinished jobs")
+		abortJobs()
+		<-stopped
+	case <-quit:
+		slog.Warn("Second signal received, requeueing unfinished jobs")
+		abortJobs()
+		<-stopped
+	}
+	slog.Info("Worker shutdown complete")
+}
+
+// consume runs one consumer loop until fetchCtx is cancelled. Cancelling
+// abortCtx interrupts the archive being built and requeues its job.
+func consume(fetchCtx, abortCtx context.Context, queue JobQueue, rdb *redis.Client) {
+	for {
+		health.polled()
+		delivery, err := queue.Fetch(fetchCtx)
+		if err != nil {
+			// If context canceled (during shutdown)
+			if fetchCtx.Err() != nil {
+				return
+			}
+			slog.Error("Redis error", logKeyError, err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		if delivery == nil {
+			continue // Timeout, loop again
+		}
+
+		job := delivery.Job
+		slog.Info("Processing job", logKeyJobID, job.JobId, logKeyUserID, job.UserId, "items", len(job.Items))
+		health.processing(job.JobId, job.OutputDir)
+		jobCtx, span := startJobSpan(abortCtx, job)
+		err = processJob(jobCtx, rdb, job)
+		span.End()
+		health.finished(job.JobId)
+
+		if errors.Is(err, errJobInterrupted) {
+			if err := queue.Requeue(delivery); err != nil {
+				slog.Error("Failed to requeue interrupted job", logKeyJobID, job.JobId, logKeyError, err)
+				continue
+			}
+			archivesTotal.WithLabelValues("requeued").Inc()
+			slog.Warn("Job interrupted by shutdown, requeued", logKeyJobID, job.JobId, logKeyUserID, job.UserId)
+			continue
+		}
+		if err := queue.Ack(delivery); err != nil {
+			slog.Warn("Failed to ack job", logKeyJobID, job.JobId, logKeyError, err)
+		}
+	}
 }
 
-func processJob(rdb *redis.Client, job Job) {
-	statusKey := fmt.Sprintf("zip:job:%s", job.JobId)
+// processJob builds the archive for job. Failures are recorded in the job's
+// status hash; only an interruption by shutdown is returned, with the partial
+// archive removed and the status reset so the job can be requeued.
+func processJob(jobCtx context.Context, rdb *redis.Client, job Job) error {
+	statusKey := key("zip:job:" + job.JobId)
+	startTime := time.Now()
+	logger := slog.With(logKeyJobID, job.JobId, logKeyUserID, job.UserId)
+	var bytesIn int64
+
+	if job.decodeErr != nil {
+		failJob(jobCtx, rdb, job, fmt.Sprintf("Invalid job: %v", job.decodeErr))
+		return nil
+	}
 
 	// Update status to PROCESSING
 	rdb.HSet(ctx, statusKey, "status", "PROCESSING")
 	rdb.HSet(ctx, statusKey, "progress", "0")
+	publishEvent(rdb, JobEvent{Type: "job.started", JobId: job.JobId, UserId: job.UserId})
 
-	// Create output dir if not exists
-	if err := os.MkdirAll(job.OutputDir, 0755); err != nil {
-		failJob(rdb, statusKey, fmt.Sprintf("Failed to create output directory: %v", err))
-		return
-	}
-
-	outputPath := filepath.Join(job.OutputDir, fmt.Sprintf("%s.zip", job.JobId))
+	outputPath := storage.JoinURI(job.OutputDir, fmt.Sprintf("%s.zip", job.JobId))
 	
-	// Create zip file
-	zipFile, err := os.Create(outputPath)
+	// Create zip file, written locally or uploaded to S3 as it is built
+	zipFile, err := store.Create(ctx, outputPath)
 	if err != nil {
-		failJob(rdb, statusKey, fmt.Sprintf("Failed to create zip file: %v", err))
-		return
+		failJob(jobCtx, rdb, job, fmt.Sprintf("Failed to create zip file: %v", err))
+		return nil
 	}
-	defer zipFile.Close() // Ensure close if we error out, though we close explicitly later
+	defer zipFile.Abort() // Discard the partial archive if we error out; no-op once stored
 
-	archive := zip.NewWriter(zipFile)
+	out := &countingWriter{w: zipFile, progressed: func() { health.progressed(job.JobId) }}
+	archive := zip.NewWriter(out)
 	defer archive.Close()
 
 	totalItems := len(job.Items)
+	skipped := 0
+	_, writeSpan := tracer.Start(jobCtx, "zip.write", trace.WithAttributes(attribute.String("file.path", outputPath)))
+
+	// interrupt discards the partial archive once jobCtx is cancelled,
+	// whether that is noticed between items or as a failed read
+	interrupt := func() error {
+		writeSpan.AddEvent("job interrupted by shutdown")
+		writeSpan.End()
+		zipFile.Abort()
+		rdb.HSet(ctx, statusKey, "status", "PENDING", "progress", "0", "message", "Queued")
+		return errJobInterrupted
+	}
 	
 	for i, item := range job.Items {
+		if jobCtx.Err() != nil {
+			return interrupt()
+		}
+
 		// Update progress
+		health.progressed(job.JobId)
 		if i%10 == 0 || i == totalItems-1 {
-			progress := fmt.Sprintf("%d", (i * 100) / totalItems)
-			rdb.HSet(ctx, statusKey, "progress", progress)
+			progress := (i * 100) / totalItems
+			rdb.HSet(ctx, statusKey, "progress", fmt.Sprintf("%d", progress))
+			publishEvent(rdb, JobEvent{Type: "job.progress", JobId: job.JobId, UserId: job.UserId, Progress: progress})
 		}
 
 		// Open source file
-		f, err := os.Open(item.Source)
+		f, err := store.Open(jobCtx, item.Source)
 		if err != nil {
-			log.Printf("Warning: Failed to open file %s: %v", item.Source, err)
+			if jobCtx.Err() != nil {
+				return interrupt()
+			}
+			logger.Warn("Failed to open file, skipping", "source", item.Source, logKeyError, err)
+			skippedItemsTotal.Inc()
+			skipped++
+			writeSpan.AddEvent("item skipped", trace.WithAttributes(attribute.String("file.path", item.Source)))
 			continue // Skip missing files? Or fail? Let's skip and log.
 		}
 
@@ -144,40 +365,110 @@ func processJob(rdb *redis.Client, job Job) {
 		w, err := archive.Create(item.Target)
 		if err != nil {
 			f.Close()
-			log.Printf("Warning: Failed to add file to zip %s: %v", item.Target, err)
+			logger.Warn("Failed to add file to zip, skipping", "target", item.Target, logKeyError, err)
+			skippedItemsTotal.Inc()
+			skipped++
+			writeSpan.AddEvent("item skipped", trace.WithAttributes(attribute.String("file.path", item.Source)))
 			continue
 		}
 
 		// Copy content
-		if _, err := io.Copy(w, f); err != nil {
+		written, err := io.Copy(w, f)
+		bytesZippedTotal.Add(float64(written))
+		bytesIn += written
+		if err != nil {
 			f.Close()
-			log.Printf("Warning: Failed to write file content %s: %v", item.Target, err)
+			if jobCtx.Err() != nil {
+				return interrupt()
+			}
+			logger.Warn("Failed to write file content, skipping", "target", item.Target, logKeyError, err)
+			skippedItemsTotal.Inc()
+			skipped++
+			writeSpan.AddEvent("item skipped", trace.WithAttributes(attribute.String("file.path", item.Source)))
 			continue
 		}
 		f.Close()
 	}
+	if jobCtx.Err() != nil {
+		return interrupt()
+	}
 
 	// Close archive to flush
-	if err := archive.Close(); err != nil {
-		zipFile.Close() // Close before removing
-		os.Remove(outputPath) // Cleanup
-		failJob(rdb, statusKey, fmt.Sprintf("Failed to finalize zip: %v", err))
-		return
+	err = archive.Close()
+	writeSpan.SetAttributes(
+		attribute.Int64("zip.bytes_in", bytesIn),
+		attribute.Int("zip.skipped_items", skipped),
+	)
+	writeSpan.End()
+	if err != nil {
+		zipFile.Abort()
+		failJob(jobCtx, rdb, job, fmt.Sprintf("Failed to finalize zip: %v", err))
+		return nil
 	}
 	
-	// Ensure file is closed
-	zipFile.Close()
+	// Store the archive: rename into place, or complete the multipart upload
+	if err := zipFile.Close(); err != nil {
+		failJob(jobCtx, rdb, job, fmt.Sprintf("Failed to store zip: %v", err))
+		return nil
+	}
 
 	// Update status to READY
 	rdb.HSet(ctx, statusKey, "status", "READY")
 	rdb.HSet(ctx, statusKey, "progress", "100")
 	rdb.HSet(ctx, statusKey, "filePath", outputPath)
+	archivesTotal.WithLabelValues("ready").Inc()
+	archiveDuration.Observe(time.Since(startTime).Seconds())
+	publishEvent(rdb, JobEvent{Type: "job.completed", JobId: job.JobId, UserId: job.UserId, Progress: 100, FilePath: outputPath})
 	
-	log.Printf("Job %s completed. File: %s", job.JobId, outputPath)
+	logger.Info("Job completed",
+		"file", outputPath,
+		logKeyDurationMS, time.Since(startTime).Milliseconds(),
+		logKeyBytesIn, bytesIn,
+		logKeyBytesOut, out.n)
+
+	return nil
+}
+
+// countingWriter counts the bytes written through it and reports each
+// write to progressed, which feeds the liveness check.
+type countingWriter struct {
+	w          io.Writer
+	n          int64
+	progressed func()
 }
 
-func failJob(rdb *redis.Client, key, message string) {
-	log.Printf("Job failed: %s", message)
-	rdb.HSet(ctx, key, "status", "FAILED")
-	rdb.HSet(ctx, key, "message", message)
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if n > 0 && c.progressed != nil {
+		c.progressed()
+	}
+	return n, err
+}
+
+func failJob(jobCtx context.Context, rdb *redis.Client, job Job, message string) {
+	statusKey := key("zip:job:" + job.JobId)
+
+	slog.Error("Job failed", logKeyJobID, job.JobId, logKeyUserID, job.UserId, logKeyError, message)
+	rdb.HSet(ctx, statusKey, "status", "FAILED")
+	rdb.HSet(ctx, statusKey, "message", message)
+	archivesTotal.WithLabelValues("failed").Inc()
+	failSpan(jobCtx, message)
+	publishEvent(rdb, JobEvent{Type: "job.failed", JobId: job.JobId, UserId: job.UserId, Error: message})
+}
+
+// publishEvent is best effort; the status hash remains the source of truth
+// for clients that are not subscribed.
+func publishEvent(rdb *redis.Client, event JobEvent) {
+	event.Timestamp = time.Now().UnixMilli()
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		slog.Warn("Failed to marshal event", "type", event.Type, logKeyError, err)
+		return
+	}
+
+	if err := rdb.Publish(ctx, key(eventChannel), string(eventJSON)).Err(); err != nil {
+		slog.Warn("Failed to publish event", "type", event.Type, logKeyJobID, event.JobId, logKeyError, err)
+	}
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	archivesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "zip_worker_archives_total",
+		Help: "Zip jobs handled, by result (ready, failed, requeued).",
+	}, []string{"result"})
+
+	bytesZippedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zip_worker_bytes_zipped_total",
+		Help: "Source bytes written into archives.",
+	})
+
+	skippedItemsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zip_worker_skipped_items_total",
+		Help: "Job items left out of an archive because they could not be read or written.",
+	})
+
+	archiveDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "zip_worker_archive_duration_seconds",
+		Help:    "Time taken to build an archive.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+)
+
+// queueCollector reports the zip:jobs backlog at scrape time. When the stream
+// transport is used, the consumer group's lag and pending entries are
+// included; the stream length is no measure of waiting work.
+type queueCollector struct {
+	rdb    *redis.Client
+	group  string // Stream consumer group, empty for the list transport
+	length *prometheus.Desc
+}
+
+func (qc *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- qc.length
+}
+
+func (qc *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	scrapeCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	length, err := qc.rdb.LLen(scrapeCtx, key(jobQueueName)).Result()
+	if err != nil {
+		slog.Warn("Failed to read queue length", "queue", jobQueueName, logKeyError, err)
+		return
+	}
+	if qc.group != "" {
+		groups, err := qc.rdb.XInfoGroups(scrapeCtx, key(jobQueueName+":stream")).Result()
+		if err != nil && !strings.Contains(err.Error(), "no such key") {
+			slog.Warn("Failed to read stream groups", "queue", jobQueueName, logKeyError, err)
+			return
+		}
+		for _, g := range groups {
+			if g.Name == qc.group {
+				length += g.Lag + g.Pending
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(qc.length, prometheus.GaugeValue, float64(length), jobQueueName)
+}
+
+// serveStatus registers the queue collector and serves /metrics, /healthz
+// and /readyz on addr. group is the stream consumer group, empty when jobs
+// are read from the list only.
+func serveStatus(rdb *redis.Client, group, addr string) {
+	prometheus.MustRegister(&queueCollector{
+		rdb:   rdb,
+		group: group,
+		length: prometheus.NewDesc("zip_worker_queue_length",
+			"Zip jobs waiting in Redis.", []string{"queue"}, nil),
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.handleLive)
+	mux.HandleFunc("/readyz", health.handleReady)
+
+	slog.Info("Serving /metrics, /healthz and /readyz", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Metrics server stopped", logKeyError, err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"worker-common/redisstream"
+)
+
+const jobQueueName = "zip:jobs"
+
+// Delivery is a job taken from the queue together with what is needed to
+// acknowledge it once processed.
+type Delivery struct {
+	Job    Job
+	stream string
+	id     string
+}
+
+// JobQueue hides whether zip jobs arrive on a plain list or a stream consumer
+// group. Fetch returns a nil Delivery when nothing arrived before the poll
+// timeout, and stops early when fetchCtx is cancelled. Requeue hands back a
+// job that was interrupted by shutdown.
+type JobQueue interface {
+	Fetch(fetchCtx context.Context) (*Delivery, error)
+	Ack(d *Delivery) error
+	Requeue(d *Delivery) error
+}
+
+type listQueue struct {
+	rdb *redis.Client
+}
+
+func (lq *listQueue) Fetch(fetchCtx context.Context) (*Delivery, error) {
+	// go-redis BLPOP takes a timeout, so we loop every 5 seconds instead of
+	// blocking indefinitely.
+	result, err := lq.rdb.BLPop(fetchCtx, 5*time.Second, key(jobQueueName)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// result[0] is key, result[1] is value
+	return decodeDelivery(result[1])
+}
+
+func (lq *listQueue) Ack(d *Delivery) error {
+	return nil
+}
+
+// Requeue puts the job back at the head of the list so it is picked up next.
+func (lq *listQueue) Requeue(d *Delivery) error {
+	return pushFront(lq.rdb, d.Job)
+}
+
+func pushFront(rdb *redis.Client, job Job) error {
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %v", err)
+	}
+	return rdb.LPush(ctx, key(jobQueueName), string(jobJSON)).Err()
+}
+
+// streamQueue reads zip jobs through a consumer group on zip:jobs:stream.
+// Messages a crashed worker never acknowledged are reclaimed after claimIdle,
+// looking for them at most every redisstream.ClaimInterval, and the legacy
+// zip:jobs list is drained first so list producers keep working during
+// migration.
+type streamQueue struct {
+	rdb     *redis.Client
+	stream  string
+	group   string
+	claimer *redisstream.Claimer
+}
+
+func newStreamQueue(rdb *redis.Client, group, consumer string, claimIdle time.Duration) (*streamQueue, error) {
+	sq := &streamQueue{
+		rdb:    rdb,
+		stream: key(jobQueueName + ":stream"),
+		group:  group,
+		claimer: &redisstream.Claimer{
+			Client:   rdb,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  claimIdle,
+		},
+	}
+
+	if err := redisstream.CreateGroups(ctx, rdb, group, sq.stream); err != nil {
+		return nil, err
+	}
+
+	return sq, nil
+}
+
+func (sq *streamQueue) Fetch(fetchCtx context.Context) (*Delivery, error) {
+	_, claimed, err := sq.claimer.Claim(fetchCtx, sq.stream)
+	if err != nil {
+		return nil, err
+	}
+	if claimed != nil {
+		slog.Warn("Reclaimed stuck message", "stream", sq.stream, "id", claimed.ID)
+		return sq.decodeMessage(*claimed)
+	}
+
+	jobJSON, err := sq.rdb.LPop(fetchCtx, key(jobQueueName)).Result()
+	if err == nil {
+		return decodeDelivery(jobJSON)
+	}
+	if err != redis.Nil {
+		return nil, err
+	}
+
+	streams, err := sq.rdb.XReadGroup(fetchCtx, &redis.XReadGroupArgs{
+		Group:    sq.group,
+		Consumer: sq.claimer.Consumer,
+		Streams:  []string{sq.stream, ">"},
+		Count:    1,
+		Block:    5 * time.Second,
+	}).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(streams) == 0 || len(streams[0].Messages) == 0 {
+		return nil, nil
+	}
+
+	return sq.decodeMessage(streams[0].Messages[0])
+}
+
+func (sq *streamQueue) decodeMessage(msg redis.XMessage) (*Delivery, error) {
+	jobJSON, _ := msg.Values["job"].(string)
+
+	d, err := decodeDelivery(jobJSON)
+	if err != nil {
+		// Acknowledge malformed entries so they are not reclaimed forever
+		sq.remove(sq.stream, msg.ID)
+		return nil, err
+	}
+
+	d.stream = sq.stream
+	d.id = msg.ID
+	return d, nil
+}
+
+func (sq *streamQueue) Ack(d *Delivery) error {
+	if d.id == "" {
+		return nil
+	}
+	return sq.remove(d.stream, d.id)
+}
+
+func (sq *streamQueue) remove(stream, id string) error {
+	return redisstream.Remove(ctx, sq.rdb, sq.group, stream, id)
+}
+
+// Requeue adds the job to the stream again and acknowledges the original
+// entry, so another worker gets it now rather than after claimIdle. Jobs
+// drained from the legacy list go back there.
+func (sq *streamQueue) Requeue(d *Delivery) error {
+	if d.id == "" {
+		return pushFront(sq.rdb, d.Job)
+	}
+
+	jobJSON, err := json.Marshal(d.Job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %v", err)
+	}
+	err = sq.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: d.stream,
+		Values: map[string]interface{}{"job": string(jobJSON)},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to add to stream %s: %v", d.stream, err)
+	}
+	return sq.Ack(d)
+}
+
+// monitor logs the XPENDING summary every interval.
+func (sq *streamQueue) monitor(interval time.Duration) {
+	for range time.Tick(interval) {
+		pending, err := sq.rdb.XPending(ctx, sq.stream, sq.group).Result()
+		if err != nil {
+			slog.Error("XPENDING failed", "stream", sq.stream, logKeyError, err)
+			continue
+		}
+		if pending.Count > 0 {
+			slog.Info("Pending stream entries",
+				"stream", sq.stream,
+				"pending", pending.Count,
+				"lower", pending.Lower,
+				"higher", pending.Higher,
+				"consumers", pending.Consumers)
+		}
+	}
+}
+
+func decodeDelivery(jobJSON string) (*Delivery, error) {
+	job, err := decodeJob([]byte(jobJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal job: %v", err)
+	}
+	return &Delivery{Job: job}, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("zipping-worker")
+
+// setupTracing exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT
+// (or the traces-specific variant) is set. Trace context carried by jobs is
+// propagated either way. The returned function flushes pending spans.
+func setupTracing() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "zipping-worker"),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// startJobSpan starts the span covering one zip job as a child of the
+// producer's span carried in the job payload. The returned context is
+// cancelled along with parent.
+func startJobSpan(parent context.Context, job Job) (context.Context, trace.Span) {
+	carrier := propagation.MapCarrier{}
+	if job.Traceparent != "" {
+		carrier.Set("traceparent", job.Traceparent)
+	}
+	if job.Tracestate != "" {
+		carrier.Set("tracestate", job.Tracestate)
+	}
+	parent = otel.GetTextMapPropagator().Extract(parent, carrier)
+
+	return tracer.Start(parent, "zip.job",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("job.id", job.JobId),
+			attribute.String("user.id", job.UserId),
+			attribute.Int("job.items", len(job.Items)),
+		))
+}
+
+// failSpan marks the span in spanCtx as failed.
+func failSpan(spanCtx context.Context, message string) {
+	span := trace.SpanFromContext(spanCtx)
+	span.RecordError(fmt.Errorf("%s", message))
+	span.SetStatus(codes.Error, message)
+}